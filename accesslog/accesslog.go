@@ -0,0 +1,257 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FormatJSON     = "json"
+	FormatCommon   = "common"
+	FormatCombined = "combined"
+)
+
+type Config struct {
+	Format     string    // json, common or combined, default json
+	File       string    // written to Output or stdout if empty
+	Output     io.Writer // instead of File
+	MaxSize    int64     // rotate File when it grows beyond, default 100MiB
+	MaxBackups int       // rotated files to keep, default 5
+	// SampleRate is the share of the transactions logged, default 1. The
+	// decision is made on the txn so all hops log the same transactions,
+	// responses with status >= 500 are always logged.
+	SampleRate float64
+}
+
+func (cfg *Config) setDefaults() {
+	if cfg.Format == "" {
+		cfg.Format = FormatJSON
+	}
+	if cfg.MaxSize == 0 {
+		cfg.MaxSize = 100 * 1024 * 1024
+	}
+	if cfg.MaxBackups == 0 {
+		cfg.MaxBackups = 5
+	}
+	if cfg.SampleRate == 0 {
+		cfg.SampleRate = 1
+	}
+}
+
+// Entry is one access log line.
+type Entry struct {
+	Time       time.Time
+	Component  string
+	Txn        string
+	ClientAddr string
+	Method     string
+	URI        string
+	InProto    string
+	OutProto   string
+	Backend    string
+	Upstream   string
+	Status     int
+	BytesIn    int64
+	BytesOut   int64
+	Attempts   int
+	Duration   time.Duration
+	// per hop, like backend and upstream
+	Timings   map[string]time.Duration
+	Referer   string
+	UserAgent string
+}
+
+func (e *Entry) AddTiming(hop string, d time.Duration) {
+	if e == nil {
+		return
+	}
+	if e.Timings == nil {
+		e.Timings = map[string]time.Duration{}
+	}
+	e.Timings[hop] = d
+}
+
+type jsonEntry struct {
+	Time       string             `json:"time"`
+	Component  string             `json:"component"`
+	Txn        string             `json:"txn"`
+	ClientAddr string             `json:"client_addr"`
+	Method     string             `json:"method"`
+	URI        string             `json:"uri"`
+	InProto    string             `json:"in_proto"`
+	OutProto   string             `json:"out_proto,omitempty"`
+	Backend    string             `json:"backend,omitempty"`
+	Upstream   string             `json:"upstream,omitempty"`
+	Status     int                `json:"status"`
+	BytesIn    int64              `json:"bytes_in"`
+	BytesOut   int64              `json:"bytes_out"`
+	Attempts   int                `json:"attempts,omitempty"`
+	DurationMs float64            `json:"duration_ms"`
+	TimingsMs  map[string]float64 `json:"timings_ms,omitempty"`
+	Referer    string             `json:"referer,omitempty"`
+	UserAgent  string             `json:"user_agent,omitempty"`
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func (e *Entry) json() []byte {
+	je := jsonEntry{
+		Time:       e.Time.Format(time.RFC3339Nano),
+		Component:  e.Component,
+		Txn:        e.Txn,
+		ClientAddr: e.ClientAddr,
+		Method:     e.Method,
+		URI:        e.URI,
+		InProto:    e.InProto,
+		OutProto:   e.OutProto,
+		Backend:    e.Backend,
+		Upstream:   e.Upstream,
+		Status:     e.Status,
+		BytesIn:    e.BytesIn,
+		BytesOut:   e.BytesOut,
+		Attempts:   e.Attempts,
+		DurationMs: ms(e.Duration),
+		Referer:    e.Referer,
+		UserAgent:  e.UserAgent,
+	}
+	if len(e.Timings) > 0 {
+		je.TimingsMs = map[string]float64{}
+		for hop, d := range e.Timings {
+			je.TimingsMs[hop] = ms(d)
+		}
+	}
+	out, _ := json.Marshal(je)
+	return append(out, '\n')
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func quote(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, `\`, `\\`), `"`, `\"`)
+}
+
+func (e *Entry) common() string {
+	host := e.ClientAddr
+	if i := strings.LastIndex(host, ":"); i > 0 && !strings.HasSuffix(host, "]") {
+		host = strings.Trim(host[:i], "[]")
+	}
+	size := "-"
+	if e.BytesOut > 0 {
+		size = fmt.Sprint(e.BytesOut)
+	}
+	return fmt.Sprintf(`%s - - [%s] "%s %s %s" %d %s`, orDash(host),
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"), e.Method, quote(e.URI), e.InProto, e.Status, size)
+}
+
+func (e *Entry) line(format string) []byte {
+	switch format {
+	case FormatCommon:
+		return []byte(e.common() + "\n")
+	case FormatCombined:
+		return []byte(fmt.Sprintf("%s \"%s\" \"%s\"\n", e.common(), quote(orDash(e.Referer)), quote(orDash(e.UserAgent))))
+	}
+	return e.json()
+}
+
+type Logger struct {
+	cfg   Config
+	mutex sync.Mutex
+	out   io.Writer
+	file  *rotatingFile
+}
+
+func New(config *Config) (*Logger, error) {
+	cfg := Config{}
+	if config != nil {
+		cfg = *config
+	}
+	cfg.setDefaults()
+	switch cfg.Format {
+	case FormatJSON, FormatCommon, FormatCombined:
+	default:
+		return nil, fmt.Errorf("unknown access log format: %s", cfg.Format)
+	}
+	l := &Logger{cfg: cfg, out: cfg.Output}
+	if cfg.Output == nil && cfg.File != "" {
+		file, err := openRotatingFile(cfg.File, cfg.MaxSize, cfg.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		l.file = file
+		l.out = file
+	}
+	if l.out == nil {
+		l.out = os.Stdout
+	}
+	return l, nil
+}
+
+// sampled decides by the txn, so every hop keeps the same transactions.
+func (l *Logger) sampled(e *Entry) bool {
+	if l.cfg.SampleRate >= 1 || e.Status >= 500 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(e.Txn))
+	return float64(h.Sum32())/float64(1<<32) < l.cfg.SampleRate
+}
+
+func (l *Logger) Log(e *Entry) {
+	if !l.sampled(e) {
+		return
+	}
+	line := e.line(l.cfg.Format)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.out.Write(line)
+}
+
+func (l *Logger) Close() error {
+	if l.file != nil {
+		return l.file.Close()
+	}
+	return nil
+}
+
+// ServerTiming is a Server-Timing metric for a hop, the next hop towards
+// the client reads it back with ParseServerTiming.
+func ServerTiming(hop string, d time.Duration) string {
+	return fmt.Sprintf("h123-%s;dur=%.3f", hop, ms(d))
+}
+
+func ParseServerTiming(header http.Header, hop string) (time.Duration, bool) {
+	for _, value := range header.Values("Server-Timing") {
+		for _, metric := range strings.Split(value, ",") {
+			params := strings.Split(strings.TrimSpace(metric), ";")
+			if params[0] != "h123-"+hop {
+				continue
+			}
+			for _, param := range params[1:] {
+				key, dur, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if key != "dur" {
+					continue
+				}
+				f, err := strconv.ParseFloat(dur, 64)
+				if err == nil {
+					return time.Duration(f * float64(time.Millisecond)), true
+				}
+			}
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,121 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Formats(t *testing.T) {
+	e := &Entry{
+		Time:       time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC),
+		Txn:        "t1",
+		ClientAddr: "[::1]:4711",
+		Method:     "GET",
+		URI:        "/a?b=c",
+		InProto:    "HTTP/3.0",
+		Status:     200,
+		BytesOut:   12,
+		UserAgent:  `x"y`,
+	}
+	expected := `::1 - - [01/Jul/2022:10:00:00 +0000] "GET /a?b=c HTTP/3.0" 200 12` + "\n"
+	if got := string(e.line(FormatCommon)); got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+	expected = strings.TrimSpace(expected) + ` "-" "x\"y"` + "\n"
+	if got := string(e.line(FormatCombined)); got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+	e.AddTiming("backend", 1500*time.Microsecond)
+	line := map[string]interface{}{}
+	json.Unmarshal(e.line(FormatJSON), &line)
+	if line["txn"] != "t1" || line["timings_ms"].(map[string]interface{})["backend"] != 1.5 {
+		t.Errorf("Unexpected json %v", line)
+	}
+	_, err := New(&Config{Format: "xml"})
+	if err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+}
+
+func Test_Sampling(t *testing.T) {
+	out := &bytes.Buffer{}
+	l, _ := New(&Config{Format: FormatCommon, SampleRate: 0.5, Output: out})
+	other, _ := New(&Config{Format: FormatCommon, SampleRate: 0.5, Output: &bytes.Buffer{}})
+	logged := 0
+	for i := 0; i < 1000; i++ {
+		e := &Entry{Txn: fmt.Sprintf("txn-%d", i), Status: 200}
+		if l.sampled(e) != other.sampled(e) {
+			t.Fatalf("Expected the same decision for %s", e.Txn)
+		}
+		if l.sampled(e) {
+			logged++
+		}
+	}
+	if logged < 400 || logged > 600 {
+		t.Errorf("Expected about half sampled, got %d", logged)
+	}
+	for i := 0; i < 100; i++ {
+		l.Log(&Entry{Txn: fmt.Sprintf("txn-%d", i), Status: 502})
+	}
+	if strings.Count(out.String(), "\n") != 100 {
+		t.Errorf("Expected all errors logged, got %d", strings.Count(out.String(), "\n"))
+	}
+}
+
+func Test_Rotation(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "access.log")
+	l, err := New(&Config{File: name, Format: FormatCommon, MaxSize: 100, MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		l.Log(&Entry{Method: "GET", URI: "/", InProto: "HTTP/1.1", Status: 200})
+	}
+	l.Close()
+	for _, file := range []string{name, name + ".1", name + ".2"} {
+		info, err := os.Stat(file)
+		if err != nil || info.Size() > 100 {
+			t.Errorf("Unexpected %s: %v %v", file, info, err)
+		}
+	}
+	if _, err := os.Stat(name + ".3"); err == nil {
+		t.Error("Expected only two backups")
+	}
+}
+
+func Test_Handler(t *testing.T) {
+	out := &bytes.Buffer{}
+	l, _ := New(&Config{Output: out})
+	h := Handler(l, "frontend", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		entry := FromContext(r.Context())
+		entry.Backend = "https://mux"
+		entry.AddTiming("upstream", time.Millisecond)
+		w.Header().Add("Server-Timing", ServerTiming("upstream", 2*time.Millisecond))
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	}))
+	req := httptest.NewRequest("POST", "/x", strings.NewReader("body"))
+	req.Header.Set("X-H123-Txn", "t2")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	line := map[string]interface{}{}
+	json.Unmarshal(out.Bytes(), &line)
+	if line["txn"] != "t2" || line["component"] != "frontend" || line["backend"] != "https://mux" ||
+		line["status"] != 201.0 || line["bytes_in"] != 4.0 || line["bytes_out"] != 5.0 {
+		t.Errorf("Unexpected line %s", out.String())
+	}
+	d, ok := ParseServerTiming(rec.Header(), "upstream")
+	if !ok || d != 2*time.Millisecond {
+		t.Errorf("Unexpected server timing %v %v", d, ok)
+	}
+}
@@ -0,0 +1,65 @@
+package accesslog
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/mabels/h123-reflector/utils"
+)
+
+type entryKey struct{}
+
+// FromContext is the Entry of a request served by Handler, handlers add
+// what only they know like the backend or upstream. It is nil without
+// access log.
+func FromContext(ctx context.Context) *Entry {
+	e, _ := ctx.Value(entryKey{}).(*Entry)
+	return e
+}
+
+type handler struct {
+	log       *Logger
+	component string
+	handler   http.Handler
+}
+
+// Handler writes an access log line for every request, without log the
+// handler is returned as it is.
+func Handler(log *Logger, component string, h http.Handler) http.Handler {
+	if log == nil {
+		return h
+	}
+	return handler{log: log, component: component, handler: h}
+}
+
+func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e := &Entry{
+		Time:       time.Now(),
+		Component:  h.component,
+		Txn:        r.Header.Get("X-H123-Txn"),
+		ClientAddr: r.RemoteAddr,
+		Method:     r.Method,
+		URI:        r.RequestURI,
+		InProto:    r.Proto,
+		Referer:    r.Referer(),
+		UserAgent:  r.UserAgent(),
+	}
+	if e.URI == "" {
+		e.URI = r.URL.RequestURI()
+	}
+	rw := utils.NewResponseWriter(w)
+	var body *utils.RequestBody
+	if r.Body != nil && r.Body != http.NoBody {
+		body = &utils.RequestBody{ReadCloser: r.Body}
+		r.Body = body
+	}
+	h.handler.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), entryKey{}, e)))
+	e.Duration = time.Since(e.Time)
+	e.Status = rw.StatusOrOK()
+	e.BytesOut = rw.Bytes
+	if body != nil {
+		e.BytesIn = body.Bytes
+	}
+	h.log.Log(e)
+}
@@ -0,0 +1,197 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mabels/h123-reflector/utils"
+)
+
+type Config struct {
+	// Listen without host binds to the loopback, like :9180
+	Listen string
+	// Token is required as Bearer token, without it only loopback
+	// listeners are allowed.
+	Token string
+}
+
+// Error answers a request with Status instead of 500.
+type Error struct {
+	Status int
+	Err    error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func BadRequest(format string, args ...interface{}) error {
+	return &Error{Status: http.StatusBadRequest, Err: fmt.Errorf(format, args...)}
+}
+
+func NotFound(format string, args ...interface{}) error {
+	return &Error{Status: http.StatusNotFound, Err: fmt.Errorf(format, args...)}
+}
+
+// HandlerFunc returns the value written as JSON.
+type HandlerFunc func(r *http.Request) (interface{}, error)
+
+type Server struct {
+	cfg      Config
+	log      *utils.Logger
+	mutex    sync.Mutex
+	routes   map[string]map[string]HandlerFunc
+	listener net.Listener
+	srv      *http.Server
+}
+
+func listenAddr(listen string) (string, bool, error) {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return "", false, err
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	ip := net.ParseIP(host)
+	loopback := host == "localhost" || (ip != nil && ip.IsLoopback())
+	return net.JoinHostPort(host, port), loopback, nil
+}
+
+// New creates the admin server with the log level endpoints of log, the
+// components add theirs with Handle.
+func New(config *Config, log *utils.Logger) (*Server, error) {
+	cfg := *config
+	listen, loopback, err := listenAddr(cfg.Listen)
+	if err != nil {
+		return nil, err
+	}
+	if !loopback && cfg.Token == "" {
+		return nil, fmt.Errorf("admin listener %s needs a token", cfg.Listen)
+	}
+	cfg.Listen = listen
+	s := &Server{
+		cfg:    cfg,
+		log:    log.Component("admin"),
+		routes: map[string]map[string]HandlerFunc{},
+	}
+	s.Handle(http.MethodGet, "/log-levels", func(r *http.Request) (interface{}, error) {
+		return log.Levels(), nil
+	})
+	s.Handle(http.MethodPut, "/log-levels", func(r *http.Request) (interface{}, error) {
+		err := log.SetLevel(r.URL.Query().Get("component"), r.URL.Query().Get("level"))
+		if err != nil {
+			return nil, BadRequest("%v", err)
+		}
+		return log.Levels(), nil
+	})
+	return s, nil
+}
+
+func (s *Server) Handle(method string, path string, fn HandlerFunc) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.routes[path] == nil {
+		s.routes[path] = map[string]HandlerFunc{}
+	}
+	s.routes[path][method] = fn
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	if s.cfg.Token == "" {
+		return true
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.Token)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	out, _ := json.MarshalIndent(v, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(out)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid token"})
+		return
+	}
+	s.mutex.Lock()
+	methods, found := s.routes[r.URL.Path]
+	fn := methods[r.Method]
+	allowed := make([]string, 0, len(methods))
+	for method := range methods {
+		allowed = append(allowed, method)
+	}
+	s.mutex.Unlock()
+	if !found {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown path " + r.URL.Path})
+		return
+	}
+	if fn == nil {
+		sort.Strings(allowed)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	res, err := fn(r)
+	if err != nil {
+		status := http.StatusInternalServerError
+		var aerr *Error
+		if errors.As(err, &aerr) {
+			status = aerr.Status
+		}
+		s.log.Warn().Str("path", r.URL.Path).Int("status", status).Err(err).Msg("admin request failed")
+		writeJSON(w, status, map[string]string{"error": err.Error()})
+		return
+	}
+	event := s.log.Info()
+	if r.Method == http.MethodGet {
+		event = s.log.Debug()
+	}
+	event.Str("method", r.Method).Str("path", r.URL.Path).Str("query", r.URL.RawQuery).Msg("admin request")
+	writeJSON(w, http.StatusOK, res)
+}
+
+// Start listens and serves in the background.
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.cfg.Listen)
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+	s.srv = &http.Server{Handler: s}
+	go func() {
+		if err := s.srv.Serve(listener); err != http.ErrServerClosed {
+			s.log.Error().Str("listen", s.cfg.Listen).Err(err).Msg("admin listener failed")
+		}
+	}()
+	return nil
+}
+
+// Addr is the address listened on, useful with port 0.
+func (s *Server) Addr() string {
+	if s.listener == nil {
+		return s.cfg.Listen
+	}
+	return s.listener.Addr().String()
+}
+
+func (s *Server) Close() error {
+	if s.srv == nil {
+		return nil
+	}
+	return s.srv.Close()
+}
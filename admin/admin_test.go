@@ -0,0 +1,63 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mabels/h123-reflector/utils"
+)
+
+func Test_AdminServer(t *testing.T) {
+	_, err := New(&Config{Listen: "0.0.0.0:0"}, utils.NewLogger())
+	if err == nil {
+		t.Error("Expected an error for a public listener without token")
+	}
+	log := utils.NewLogger(&utils.LogConfig{Output: io.Discard})
+	s, err := New(&Config{Listen: ":0", Token: "secret"}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Addr() != "127.0.0.1:0" {
+		t.Errorf("Expected loopback listener, got %s", s.Addr())
+	}
+	s.Handle(http.MethodGet, "/fail", func(r *http.Request) (interface{}, error) {
+		return nil, NotFound("nothing")
+	})
+	do := func(method string, path string, token string) (int, map[string]string) {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		res := map[string]string{}
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return w.Code, res
+	}
+	for _, c := range []struct {
+		method string
+		path   string
+		token  string
+		status int
+	}{
+		{"GET", "/log-levels", "wrong", http.StatusUnauthorized},
+		{"GET", "/unknown", "secret", http.StatusNotFound},
+		{"POST", "/log-levels", "secret", http.StatusMethodNotAllowed},
+		{"PUT", "/log-levels?level=loud", "secret", http.StatusBadRequest},
+		{"GET", "/fail", "secret", http.StatusNotFound},
+	} {
+		status, res := do(c.method, c.path, c.token)
+		if status != c.status || res["error"] == "" {
+			t.Errorf("%s %s: expected %d with error, got %d %v", c.method, c.path, c.status, status, res)
+		}
+	}
+	status, res := do("PUT", "/log-levels?component=mux&level=debug", "secret")
+	if status != http.StatusOK || res["mux"] != "debug" {
+		t.Errorf("Unexpected %d %v", status, res)
+	}
+	if fmt.Sprint(log.Levels()["mux"]) != "debug" {
+		t.Errorf("Expected changed level, got %v", log.Levels())
+	}
+}
@@ -0,0 +1,87 @@
+package backend
+
+import (
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/mabels/h123-reflector/admin"
+	"github.com/mabels/h123-reflector/models"
+)
+
+func (bd *Backend) Uplinks() []models.UplinkInfo {
+	bd.UplinkConnectionMutex.Lock()
+	defer bd.UplinkConnectionMutex.Unlock()
+	ret := make([]models.UplinkInfo, 0, len(bd.UplinkConnections))
+	for _, uc := range bd.UplinkConnections {
+		ret = append(ret, models.UplinkInfo{
+			ID:          uc.ID,
+			RemoteAddr:  uc.RemoteAddr,
+			Frontend:    uc.Frontend,
+			Requests:    atomic.LoadUint64(&uc.Requests),
+			LastRequest: uc.LastRequest,
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].RemoteAddr < ret[j].RemoteAddr })
+	return ret
+}
+
+func (bd *Backend) adminRoutes(s *admin.Server) {
+	s.Handle(http.MethodGet, "/status", func(r *http.Request) (interface{}, error) {
+		state := models.ServerStatus{
+			MuxEndPointUrl: bd.Config.MuxEndPointUrl,
+			Tunnel:         bd.Config.Tunnel,
+			Upstreams:      bd.ConnectionPool.UpstreamStatus(),
+			Now:            time.Now(),
+			Quic:           bd.QuicStatus(),
+			Region:         bd.Config.Region,
+			Zone:           bd.Config.Zone,
+			Labels:         bd.Config.Labels,
+		}
+		state.FrontendConnections, state.Requests = bd.lenAndRequests()
+		state.Status, state.DrainDeadline = bd.status()
+		bd.setCapacity(&state)
+		return state, nil
+	})
+	s.Handle(http.MethodGet, "/uplinks", func(r *http.Request) (interface{}, error) {
+		return bd.Uplinks(), nil
+	})
+	// DELETE /uplinks?id= or ?remote= closes the connection, the frontend
+	// dials a new one
+	s.Handle(http.MethodDelete, "/uplinks", func(r *http.Request) (interface{}, error) {
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			id = r.URL.Query().Get("remote")
+		}
+		uc := bd.DeleteUplinkConnectionWithLock(id)
+		if uc == nil {
+			return nil, admin.NotFound("no uplink %q", id)
+		}
+		uc.close(0, "closed by admin")
+		return bd.Uplinks(), nil
+	})
+	s.Handle(http.MethodGet, "/pool", func(r *http.Request) (interface{}, error) {
+		return bd.ConnectionPool.Connections(), nil
+	})
+	s.Handle(http.MethodDelete, "/pool", func(r *http.Request) (interface{}, error) {
+		key := r.URL.Query().Get("key")
+		if !bd.ConnectionPool.Remove(key) {
+			return nil, admin.NotFound("no pooled connection %q", key)
+		}
+		return bd.ConnectionPool.Connections(), nil
+	})
+	s.Handle(http.MethodPost, "/drain", func(r *http.Request) (interface{}, error) {
+		var timeout time.Duration
+		if t := r.URL.Query().Get("timeout"); t != "" {
+			var err error
+			timeout, err = time.ParseDuration(t)
+			if err != nil {
+				return nil, admin.BadRequest("invalid timeout: %v", err)
+			}
+		}
+		bd.Drain(timeout)
+		status, deadline := bd.status()
+		return map[string]interface{}{"Status": status, "DrainDeadline": deadline}, nil
+	})
+}
@@ -0,0 +1,82 @@
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mabels/h123-reflector/admin"
+	"github.com/mabels/h123-reflector/models"
+)
+
+func Test_AdminEndpoints(t *testing.T) {
+	bd, err := NewBackend(BackendConfig{
+		BrokerUrl:   "mqtt://127.0.0.1:1883/",
+		RefreshFreq: 10 * time.Millisecond,
+		Listen:      "127.0.0.1:4708",
+		Admin:       &admin.Config{Listen: "127.0.0.1:0"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	con, _ := bd.ConnectionPool.Setup("http", upstream.Listener.Addr().String())
+	req, _ := http.NewRequest("GET", upstream.URL, nil)
+	res, err := con.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	handler := connectionPoolHandler{backend: bd}
+	handler.handleWaitConnection(nil, httptest.NewRequest("GET", "/", nil))
+
+	do := func(method string, path string, v interface{}) int {
+		w := httptest.NewRecorder()
+		bd.admin.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		json.Unmarshal(w.Body.Bytes(), v)
+		return w.Code
+	}
+	pool := []models.PooledConnection{}
+	do("GET", "/pool", &pool)
+	if len(pool) != 1 || pool[0].Protocol != "HTTP/1.1" || pool[0].Requests != 1 {
+		t.Errorf("Unexpected pool %v", pool)
+	}
+	if do("DELETE", "/pool?key="+pool[0].Key, &pool) != http.StatusOK || len(pool) != 0 {
+		t.Errorf("Expected empty pool, got %v", pool)
+	}
+	uplinks := []models.UplinkInfo{}
+	do("GET", "/uplinks", &uplinks)
+	if len(uplinks) != 1 || uplinks[0].Requests != 1 {
+		t.Errorf("Unexpected uplinks %v", uplinks)
+	}
+	if do("DELETE", "/uplinks?remote=unknown", &uplinks) != http.StatusNotFound {
+		t.Error("Expected unknown uplink")
+	}
+	state := models.ServerStatus{}
+	if do("POST", "/drain?timeout=1s", &state) != http.StatusOK || state.Status != "draining" {
+		t.Errorf("Expected draining, got %v", state)
+	}
+}
+
+func Test_UplinkCloseAfterStreams(t *testing.T) {
+	bd := &Backend{UplinkConnections: map[interface{}]*WaitForClose{}}
+	handler := connectionPoolHandler{backend: bd}
+	busy := handler.handleWaitConnection(nil, httptest.NewRequest("GET", "/", nil))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-H123-Uplink-Close", "true")
+	uc := handler.handleWaitConnection(nil, r)
+	if uc != busy || len(bd.UplinkConnections) != 0 {
+		t.Fatalf("Expected the uplink removed, got %v", bd.UplinkConnections)
+	}
+	uc.done()
+	if uc.closing != 1 {
+		t.Error("Expected the uplink kept open for the other request")
+	}
+	busy.done()
+	if uc.closing != 2 {
+		t.Error("Expected the uplink closed after the last request")
+	}
+}
@@ -0,0 +1,33 @@
+package backend
+
+import (
+	"net/http"
+	"strings"
+)
+
+// cacheOutcome is hit or the fwd reason of a Cache-Status header.
+func cacheOutcome(status string) string {
+	for _, param := range strings.Split(status, ";")[1:] {
+		param = strings.TrimSpace(param)
+		if param == "hit" {
+			return "hit"
+		}
+		if strings.HasPrefix(param, "fwd=") {
+			return strings.TrimPrefix(param, "fwd=")
+		}
+	}
+	return "none"
+}
+
+// cached answers from the cache before it coalesces to the upstream.
+func (cph connectionPoolHandler) cached(bSchema string, bHost string, w http.ResponseWriter, r *http.Request) {
+	c := cph.backend.cache
+	if c == nil {
+		cph.coalesce(bSchema, bHost, w, r)
+		return
+	}
+	c.Serve(w, r, bSchema+"://"+bHost+r.URL.RequestURI(), func(w http.ResponseWriter, r *http.Request) {
+		cph.coalesce(bSchema, bHost, w, r)
+	})
+	cph.backend.cached.Inc(cacheOutcome(w.Header().Get("Cache-Status")))
+}
@@ -0,0 +1,44 @@
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mabels/h123-reflector/cache"
+)
+
+func Test_CacheInFrontOfUpstream(t *testing.T) {
+	bd, err := NewBackend(BackendConfig{
+		BrokerUrl: "mqtt://127.0.0.1:1883/",
+		Listen:    "127.0.0.1:4711",
+		Cache:     &cache.Config{Enabled: true, Dir: t.TempDir()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hits := int32(0)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("config"))
+	}))
+	defer upstream.Close()
+	request := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/config", nil)
+		req.Header.Set("X-H123-Backend-Host", upstream.URL)
+		req.Header.Set("X-H123-Txn", "t1")
+		w := httptest.NewRecorder()
+		connectionPoolHandler{backend: bd}.ServeHTTP(w, req)
+		return w
+	}
+	request()
+	w := request()
+	if w.Body.String() != "config" || cacheOutcome(w.Header().Get("Cache-Status")) != "hit" || w.Header().Get("Server-Timing") != "" {
+		t.Errorf("Expected a hit, got %q %v", w.Body.String(), w.Header())
+	}
+	if hits != 1 {
+		t.Errorf("Expected one upstream request, got %d", hits)
+	}
+}
@@ -0,0 +1,97 @@
+package backend
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mabels/h123-reflector/models"
+)
+
+const defaultWeight = 100
+
+// CapacityConfig is announced in the status, the frontends share the
+// requests by Weight and send none to a saturated backend.
+type CapacityConfig struct {
+	Weight               *int     // default 100, 0 takes no requests
+	MaxConcurrentStreams int64    // saturated with more active streams, 0 is unlimited
+	MaxLoad              float64  // saturated above this load average per CPU, 0 is unlimited
+	MaxMemoryBytes       uint64   // saturated above this memory of the process, 0 is unlimited
+	Features             []string // announced with the ones of the config
+}
+
+func (cc *CapacityConfig) validate() error {
+	if cc.MaxConcurrentStreams < 0 || cc.MaxLoad < 0 {
+		return fmt.Errorf("negative capacity %+v", *cc)
+	}
+	if cc.Weight == nil {
+		weight := defaultWeight
+		cc.Weight = &weight
+	}
+	if *cc.Weight < 0 {
+		return fmt.Errorf("negative weight %d", *cc.Weight)
+	}
+	return nil
+}
+
+// loadAverage is the 1 minute load average per CPU, 0 without
+// /proc/loadavg.
+func loadAverage() float64 {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0
+	}
+	load, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0
+	}
+	return load / float64(runtime.NumCPU())
+}
+
+// features are the configured ones and the ones the config enables.
+func (bd *Backend) features() []string {
+	set := map[string]bool{}
+	for _, feature := range bd.Config.Capacity.Features {
+		set[feature] = true
+	}
+	set["early-data"] = true
+	if bd.Config.AllowConnect {
+		set["connect"] = true
+		set["connect-udp"] = true
+	}
+	if bd.cache != nil {
+		set["cache"] = true
+	}
+	if bd.Config.Decompress {
+		set["decompress"] = true
+	}
+	ret := make([]string, 0, len(set))
+	for feature := range set {
+		ret = append(ret, feature)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// setCapacity sets the capacity and the current load of state.
+func (bd *Backend) setCapacity(state *models.ServerStatus) {
+	cc := &bd.Config.Capacity
+	mem := runtime.MemStats{}
+	runtime.ReadMemStats(&mem)
+	state.Weight = cc.Weight
+	state.MaxConcurrentStreams = cc.MaxConcurrentStreams
+	state.ActiveStreams = bd.ActiveStreams()
+	state.Load = loadAverage()
+	state.MemoryBytes = mem.Sys
+	state.Features = bd.features()
+	state.Saturated = (cc.MaxConcurrentStreams > 0 && state.ActiveStreams >= cc.MaxConcurrentStreams) ||
+		(cc.MaxLoad > 0 && state.Load >= cc.MaxLoad) ||
+		(cc.MaxMemoryBytes > 0 && state.MemoryBytes >= cc.MaxMemoryBytes)
+}
@@ -0,0 +1,45 @@
+package backend
+
+import (
+	"sort"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mabels/h123-reflector/models"
+)
+
+func Test_Capacity(t *testing.T) {
+	weight := -1
+	if _, err := NewBackend(BackendConfig{BrokerUrl: "mqtt://127.0.0.1:1883/", Capacity: CapacityConfig{Weight: &weight}}); err == nil {
+		t.Error("Expected an error for a negative weight")
+	}
+	cc := CapacityConfig{Weight: new(int)}
+	if err := cc.validate(); err != nil || *cc.Weight != 0 {
+		t.Errorf("Expected weight 0 kept, got %v %v", *cc.Weight, err)
+	}
+	bd, err := NewBackend(BackendConfig{
+		BrokerUrl:    "mqtt://127.0.0.1:1883/",
+		Listen:       "127.0.0.1:4716",
+		AllowConnect: true,
+		Capacity:     CapacityConfig{MaxConcurrentStreams: 2, Features: []string{"gpu"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := models.ServerStatus{}
+	bd.setCapacity(&state)
+	if *state.Weight != 100 || state.MaxConcurrentStreams != 2 || state.Saturated || state.MemoryBytes == 0 {
+		t.Errorf("Expected the default weight and no saturation, got %+v", state)
+	}
+	if i := sort.SearchStrings(state.Features, "gpu"); i == len(state.Features) || state.Features[i] != "gpu" {
+		t.Errorf("Expected the configured feature, got %v", state.Features)
+	}
+	if i := sort.SearchStrings(state.Features, "connect"); i == len(state.Features) || state.Features[i] != "connect" {
+		t.Errorf("Expected connect, got %v", state.Features)
+	}
+	atomic.AddInt64(&bd.activeStreams, 2)
+	bd.setCapacity(&state)
+	if !state.Saturated || state.ActiveStreams != 2 {
+		t.Errorf("Expected saturation at MaxConcurrentStreams, got %+v", state)
+	}
+}
@@ -0,0 +1,305 @@
+package backend
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/mabels/h123-reflector/accesslog"
+	"github.com/mabels/h123-reflector/cache"
+)
+
+type CoalesceConfig struct {
+	Enabled bool
+	// KeyHeaders are part of the key, default Accept, Accept-Encoding and
+	// Accept-Language. Range is always part of it.
+	KeyHeaders []string
+	// AllowCredentials coalesces requests with Authorization or Cookie
+	AllowCredentials bool
+	// MaxBodyBytes stops joining a fetch once its response got larger,
+	// default 8MiB
+	MaxBodyBytes int64
+}
+
+func (cc *CoalesceConfig) setDefaults() {
+	if cc.KeyHeaders == nil {
+		cc.KeyHeaders = []string{"Accept", "Accept-Encoding", "Accept-Language"}
+	}
+	if cc.MaxBodyBytes == 0 {
+		cc.MaxBodyBytes = 8 * 1024 * 1024
+	}
+}
+
+// flight is one upstream fetch, the response is kept for the followers
+// which read it while it arrives. Once no more followers can join, the
+// part all of them have sent is dropped.
+type flight struct {
+	mutex     sync.Mutex
+	cond      *sync.Cond
+	header    http.Header
+	status    int
+	body      []byte
+	offset    int // of body in the response
+	done      bool
+	closed    bool // no more followers
+	private   bool // the response is not shared
+	aborted   bool // the response broke off
+	followers map[*follower]bool
+}
+
+// follower is the position of a follower in the response.
+type follower struct {
+	sent int
+}
+
+func newFlight() *flight {
+	f := &flight{followers: map[*follower]bool{}}
+	f.cond = sync.NewCond(&f.mutex)
+	return f
+}
+
+// trim drops the body all followers have sent, f.mutex is held.
+func (f *flight) trim() {
+	if !f.closed {
+		// a new follower starts at the beginning
+		return
+	}
+	sent := f.offset + len(f.body)
+	for fl := range f.followers {
+		if fl.sent < sent {
+			sent = fl.sent
+		}
+	}
+	if n := sent - f.offset; n > 0 {
+		f.body = append(f.body[:0:0], f.body[n:]...)
+		f.offset = sent
+	}
+}
+
+type coalescer struct {
+	cfg     CoalesceConfig
+	mutex   sync.Mutex
+	flights map[string]*flight
+}
+
+func newCoalescer(cfg CoalesceConfig) *coalescer {
+	if !cfg.Enabled {
+		return nil
+	}
+	cfg.setDefaults()
+	return &coalescer{cfg: cfg, flights: map[string]*flight{}}
+}
+
+// key is empty for requests which must not be coalesced.
+func (c *coalescer) key(upstream string, r *http.Request) string {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return ""
+	}
+	if r.ContentLength > 0 {
+		return ""
+	}
+	if !c.cfg.AllowCredentials && (r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != "") {
+		return ""
+	}
+	parts := []string{r.Method, upstream, r.URL.RequestURI(), r.Header.Get("Range")}
+	for _, h := range c.cfg.KeyHeaders {
+		parts = append(parts, strings.Join(r.Header.Values(h), ","))
+	}
+	return strings.Join(parts, "\n")
+}
+
+// join returns the running flight of key with the follower, or a new one
+// without follower for the leader.
+func (c *coalescer) join(key string) (*flight, *follower) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	f, found := c.flights[key]
+	if found {
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		if !f.closed {
+			fl := &follower{}
+			f.followers[fl] = true
+			return f, fl
+		}
+	}
+	f = newFlight()
+	c.flights[key] = f
+	return f, nil
+}
+
+func (c *coalescer) leave(key string, f *flight) {
+	c.mutex.Lock()
+	if c.flights[key] == f {
+		delete(c.flights, key)
+	}
+	c.mutex.Unlock()
+}
+
+// flightWriter passes the response of the leader to the flight.
+type flightWriter struct {
+	http.ResponseWriter
+	flight   *flight
+	maxBytes int64
+	gone     bool // the leader client
+}
+
+func (fw *flightWriter) WriteHeader(status int) {
+	f := fw.flight
+	f.mutex.Lock()
+	if f.status == 0 {
+		f.status = status
+		f.header = fw.ResponseWriter.Header().Clone()
+		if cache.Private(f.header) {
+			// the followers fetch their own
+			f.private = true
+			f.closed = true
+		}
+		f.cond.Broadcast()
+	}
+	f.mutex.Unlock()
+	fw.ResponseWriter.WriteHeader(status)
+}
+
+func (fw *flightWriter) Write(p []byte) (int, error) {
+	f := fw.flight
+	f.mutex.Lock()
+	if f.status == 0 {
+		f.mutex.Unlock()
+		fw.WriteHeader(http.StatusOK)
+		f.mutex.Lock()
+	}
+	if !f.private && (!f.closed || len(f.followers) > 0) {
+		f.body = append(f.body, p...)
+		if int64(f.offset+len(f.body)) > fw.maxBytes {
+			f.closed = true
+		}
+		f.trim()
+	}
+	followers := len(f.followers)
+	f.cond.Broadcast()
+	f.mutex.Unlock()
+	if fw.gone {
+		return len(p), nil
+	}
+	n, err := fw.ResponseWriter.Write(p)
+	if err != nil && followers > 0 {
+		// the followers still want the response
+		fw.gone = true
+		return len(p), nil
+	}
+	return n, err
+}
+
+// Abort passes a broken off response to the followers and the cache.
+func (fw *flightWriter) Abort() {
+	f := fw.flight
+	f.mutex.Lock()
+	f.aborted = true
+	f.mutex.Unlock()
+	cache.Abort(fw.ResponseWriter)
+}
+
+func (fw *flightWriter) Flush() {
+	if f, ok := fw.ResponseWriter.(http.Flusher); ok && !fw.gone {
+		f.Flush()
+	}
+}
+
+func (f *flight) finish() {
+	f.mutex.Lock()
+	f.done = true
+	f.closed = true
+	if f.status == 0 {
+		f.status = http.StatusBadGateway
+		f.header = http.Header{}
+	}
+	f.cond.Broadcast()
+	f.mutex.Unlock()
+}
+
+// replay writes the response of the flight while it arrives, it returns
+// false without writing anything if the response is private.
+func (f *flight) replay(fl *follower, w http.ResponseWriter) bool {
+	f.mutex.Lock()
+	defer func() {
+		f.mutex.Lock()
+		delete(f.followers, fl)
+		f.trim()
+		f.mutex.Unlock()
+	}()
+	for f.status == 0 {
+		f.cond.Wait()
+	}
+	if f.private {
+		f.mutex.Unlock()
+		return false
+	}
+	for k, vs := range f.header {
+		w.Header()[k] = vs
+	}
+	w.Header().Set("X-H123-Coalesced", "true")
+	status := f.status
+	f.mutex.Unlock()
+	w.WriteHeader(status)
+	flusher, _ := w.(http.Flusher)
+	for {
+		f.mutex.Lock()
+		for fl.sent == f.offset+len(f.body) && !f.done {
+			f.cond.Wait()
+		}
+		chunk := f.body[fl.sent-f.offset:]
+		done := f.done
+		aborted := f.aborted
+		f.mutex.Unlock()
+		if len(chunk) > 0 {
+			_, err := w.Write(chunk)
+			if err != nil {
+				return true
+			}
+			f.mutex.Lock()
+			fl.sent += len(chunk)
+			f.trim()
+			f.mutex.Unlock()
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if done {
+			if aborted {
+				cache.Abort(w)
+			}
+			return true
+		}
+	}
+}
+
+// coalesce proxies the request once for all identical requests in flight.
+func (cph connectionPoolHandler) coalesce(bSchema string, bHost string, w http.ResponseWriter, r *http.Request) {
+	c := cph.backend.coalescer
+	key := ""
+	if c != nil {
+		key = c.key(bSchema+"://"+bHost, r)
+	}
+	if key == "" {
+		cph.proxy(bSchema, bHost, w, r)
+		return
+	}
+	f, fl := c.join(key)
+	if fl != nil {
+		if entry := accesslog.FromContext(r.Context()); entry != nil {
+			entry.Upstream = bHost
+		}
+		if f.replay(fl, w) {
+			cph.backend.coalesced.Inc("follower")
+			return
+		}
+		cph.backend.coalesced.Inc("private")
+		cph.proxy(bSchema, bHost, w, r)
+		return
+	}
+	cph.backend.coalesced.Inc("leader")
+	defer c.leave(key, f)
+	defer f.finish()
+	cph.proxy(bSchema, bHost, &flightWriter{ResponseWriter: w, flight: f, maxBytes: c.cfg.MaxBodyBytes}, r)
+}
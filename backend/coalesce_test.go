@@ -0,0 +1,159 @@
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_CoalesceIdenticalGets(t *testing.T) {
+	bd, err := NewBackend(BackendConfig{
+		BrokerUrl: "mqtt://127.0.0.1:1883/",
+		Listen:    "127.0.0.1:4710",
+		Coalesce:  CoalesceConfig{Enabled: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hits := int32(0)
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("config"))
+	}))
+	defer upstream.Close()
+	request := func(header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/config", nil)
+		req.Header.Set("X-H123-Backend-Host", upstream.URL)
+		req.Header.Set("X-H123-Txn", "t1")
+		if len(header) == 2 {
+			req.Header.Set(header[0], header[1])
+		}
+		w := httptest.NewRecorder()
+		connectionPoolHandler{backend: bd}.ServeHTTP(w, req)
+		return w
+	}
+	followers := func() int {
+		bd.coalescer.mutex.Lock()
+		defer bd.coalescer.mutex.Unlock()
+		for _, f := range bd.coalescer.flights {
+			f.mutex.Lock()
+			defer f.mutex.Unlock()
+			return len(f.followers)
+		}
+		return -1
+	}
+	results := make([]*httptest.ResponseRecorder, 3)
+	wg := sync.WaitGroup{}
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = request()
+		}(i)
+		// the first one leads
+		for followers() != i {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	// credentials are not shared
+	go func() {
+		for atomic.LoadInt32(&hits) < 2 {
+			time.Sleep(time.Millisecond)
+		}
+		close(release)
+	}()
+	private := request("Authorization", "Bearer x")
+	wg.Wait()
+	if hits != 2 || private.Body.String() != "config" {
+		t.Errorf("Expected one shared and one private fetch, got %d", hits)
+	}
+	coalesced := 0
+	for _, w := range results {
+		if w.Code != http.StatusOK || w.Body.String() != "config" || w.Header().Get("Content-Type") != "text/plain" {
+			t.Errorf("Unexpected response %d %q %v", w.Code, w.Body.String(), w.Header())
+		}
+		if w.Header().Get("X-H123-Coalesced") != "" {
+			coalesced++
+		}
+	}
+	if coalesced != 2 {
+		t.Errorf("Expected two coalesced responses, got %d", coalesced)
+	}
+}
+
+func Test_CoalescePrivate(t *testing.T) {
+	bd, err := NewBackend(BackendConfig{
+		BrokerUrl: "mqtt://127.0.0.1:1883/",
+		Listen:    "127.0.0.1:4719",
+		Coalesce:  CoalesceConfig{Enabled: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hits := int32(0)
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) == 1 {
+			<-release
+		}
+		w.Header().Set("Set-Cookie", "session=1")
+		w.Write([]byte("mine"))
+	}))
+	defer upstream.Close()
+	results := make([]*httptest.ResponseRecorder, 2)
+	wg := sync.WaitGroup{}
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := httptest.NewRequest("GET", "/session", nil)
+			req.Header.Set("X-H123-Backend-Host", upstream.URL)
+			req.Header.Set("X-H123-Txn", "t1")
+			results[i] = httptest.NewRecorder()
+			connectionPoolHandler{backend: bd}.ServeHTTP(results[i], req)
+		}(i)
+		for i == 0 && atomic.LoadInt32(&hits) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	for _, w := range results {
+		if w.Body.String() != "mine" || w.Header().Get("X-H123-Coalesced") != "" {
+			t.Errorf("Expected an own response, got %q %v", w.Body.String(), w.Header())
+		}
+	}
+	if hits != 2 {
+		t.Errorf("Expected two fetches, got %d", hits)
+	}
+}
+
+func Test_CoalesceTrimsBody(t *testing.T) {
+	f := newFlight()
+	fw := &flightWriter{ResponseWriter: httptest.NewRecorder(), flight: f, maxBytes: 4}
+	fl := &follower{}
+	f.followers[fl] = true
+	fw.Write([]byte("abcdef"))
+	if !f.closed || len(f.body) != 6 {
+		t.Fatalf("Expected the body kept for the follower, got %q", f.body)
+	}
+	fl.sent = 4
+	f.trim()
+	if f.offset != 4 || string(f.body) != "ef" {
+		t.Errorf("Expected the sent part dropped, got %d %q", f.offset, f.body)
+	}
+	delete(f.followers, fl)
+	fw.Write([]byte("gh"))
+	if f.offset != 4 || string(f.body) != "ef" {
+		t.Errorf("Expected no buffering without followers, got %d %q", f.offset, f.body)
+	}
+}
@@ -3,20 +3,30 @@ package backend
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/logging"
+	"github.com/mabels/h123-reflector/models"
 	"github.com/mabels/h123-reflector/utils"
 )
 
 type Connection struct {
-	Client   http.Client  `json:"-"`
-	Creating sync.RWMutex `json:"-"`
+	Client   http.Client           `json:"-"`
+	Creating sync.RWMutex          `json:"-"`
+	Circuit  *utils.CircuitBreaker `json:"-"`
 	Schema   string
 	Host     string
 	IsQuic   bool
 	Request  int
+	requests int64
+	proto    atomic.Value // of the last response
 }
 
 type Action string
@@ -30,6 +40,10 @@ type ConnectionPool struct {
 	poolMutex sync.RWMutex
 	pool      map[string]*Connection
 	events    func(Action, string, *Connection)
+	Circuit   utils.CircuitConfig
+	Quic      *quic.Config   // of the upstream connections
+	KeyLog    io.Writer      // TLS secrets of the upstream QUIC connections
+	Tracer    logging.Tracer // qlog of the upstream QUIC connections
 }
 
 func poolKey(schema string, host string) string {
@@ -92,12 +106,14 @@ func (cp *ConnectionPool) tryQuic(schema string, host string, req *http.Request,
 				quicHost = myUrl.Hostname() + quicHost
 			}
 			// What If Alt-Srv is set but not working
-			qcon, err := utils.QuicConnect(nil)
+			qcon, err := utils.QuicConnect(cp.Quic)
 			if err != nil {
 				con.Creating.Unlock()
 				// fallback to h2
 				return
 			}
+			qcon.SetKeyLog(cp.KeyLog)
+			qcon.SetTracer(cp.Tracer)
 			// Setup the quic connection
 			con.Host = quicHost
 			con.Client = *qcon.Client
@@ -111,10 +127,22 @@ func (c *Connection) Do(req *http.Request) (*http.Response, error) {
 	if !(req.URL.Scheme == c.Schema && req.URL.Host == c.Host) {
 		return nil, fmt.Errorf("Connection not setup missmatch for %s://%s %s://%s", c.Schema, c.Host, req.URL.Scheme, req.URL.Host)
 	}
+	if c.Circuit != nil && !c.Circuit.Allow(time.Now()) {
+		return nil, fmt.Errorf("%w: %s://%s", utils.ErrCircuitOpen, c.Schema, c.Host)
+	}
+	atomic.AddInt64(&c.requests, 1)
 	res, err := c.Client.Do(req)
 	if err != nil {
+		c.record(false)
 		return nil, err
 	}
+	c.proto.Store(res.Proto)
+	switch res.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		c.record(false)
+	default:
+		c.record(true)
+	}
 	_, found := res.Header["alt-srv"]
 	if !c.IsQuic && found {
 		// is not implemented yet
@@ -122,6 +150,76 @@ func (c *Connection) Do(req *http.Request) (*http.Response, error) {
 	return res, err
 }
 
+func (c *Connection) record(success bool) {
+	if c.Circuit == nil {
+		return
+	}
+	if success {
+		c.Circuit.Success(time.Now())
+	} else {
+		c.Circuit.Failure(time.Now())
+	}
+}
+
+func (cp *ConnectionPool) Size() int {
+	cp.poolMutex.RLock()
+	defer cp.poolMutex.RUnlock()
+	return len(cp.pool)
+}
+
+// UpstreamStatus lists the upstream connections which are not closed circuits.
+func (cp *ConnectionPool) UpstreamStatus() []models.UpstreamStatus {
+	cp.poolMutex.RLock()
+	defer cp.poolMutex.RUnlock()
+	ret := []models.UpstreamStatus{}
+	for pKey, con := range cp.pool {
+		if con.Circuit == nil || con.Circuit.State() == utils.CircuitClosed {
+			continue
+		}
+		ret = append(ret, models.UpstreamStatus{Host: pKey, Circuit: con.Circuit.Status()})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Host < ret[j].Host })
+	return ret
+}
+
+// Connections lists the pooled connections by key.
+func (cp *ConnectionPool) Connections() []models.PooledConnection {
+	cp.poolMutex.RLock()
+	defer cp.poolMutex.RUnlock()
+	ret := make([]models.PooledConnection, 0, len(cp.pool))
+	for pKey, con := range cp.pool {
+		pc := models.PooledConnection{
+			Key:      pKey,
+			Schema:   con.Schema,
+			Host:     con.Host,
+			Requests: atomic.LoadInt64(&con.requests),
+		}
+		pc.Protocol, _ = con.proto.Load().(string)
+		if con.Circuit != nil {
+			status := con.Circuit.Status()
+			pc.Circuit = &status
+		}
+		ret = append(ret, pc)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Key < ret[j].Key })
+	return ret
+}
+
+// Remove closes the idle connections of pKey and forgets it, the next
+// request sets it up again.
+func (cp *ConnectionPool) Remove(pKey string) bool {
+	cp.poolMutex.Lock()
+	con, found := cp.pool[pKey]
+	delete(cp.pool, pKey)
+	cp.poolMutex.Unlock()
+	if !found {
+		return false
+	}
+	con.Client.CloseIdleConnections()
+	go cp.events(Delete, pKey, con)
+	return true
+}
+
 func (cp *ConnectionPool) Setup(schema string, host string) (*Connection, error) {
 	pKey := poolKey(schema, host)
 	cp.poolMutex.RLock()
@@ -150,8 +248,9 @@ func (cp *ConnectionPool) Setup(schema string, host string) (*Connection, error)
 			// 	}
 		}
 		con = cp.addConnection(pKey, &Connection{
-			Schema: schema,
-			Host:   host,
+			Schema:  schema,
+			Host:    host,
+			Circuit: utils.NewCircuitBreaker(cp.Circuit),
 		})
 	}
 	con.Creating.RLock()
@@ -1,8 +1,16 @@
 package backend
 
 import (
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/mabels/h123-reflector/utils"
 )
 
 func Test_NewConnectionPool(t *testing.T) {
@@ -88,6 +96,61 @@ func Test_GetConnectionPoolSeq(t *testing.T) {
 	}
 }
 
+func Test_ConnectionCircuitBreaker(t *testing.T) {
+	healthy := int32(0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	srvUrl, _ := url.Parse(srv.URL)
+	cp := NewConnectionPool()
+	cp.Circuit = utils.CircuitConfig{ConsecutiveErrors: 2, BaseEjection: 50 * time.Millisecond}
+	conn, err := cp.Setup("http", srvUrl.Host)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	get := func() error {
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		res, err := conn.Do(req)
+		if err == nil {
+			res.Body.Close()
+		}
+		return err
+	}
+	for i := 0; i < 2; i++ {
+		if err := get(); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := get(); !errors.Is(err, utils.ErrCircuitOpen) {
+		t.Error("Expected open circuit, got ", err)
+	}
+	status := cp.UpstreamStatus()
+	if len(status) != 1 || status[0].Host != "http://"+srvUrl.Host || status[0].Circuit.State != "open" {
+		t.Errorf("Expected ejected upstream, got %v", status)
+	}
+	time.Sleep(60 * time.Millisecond)
+	// half open probe fails and doubles the ejection
+	if err := get(); err != nil {
+		t.Error(err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if err := get(); !errors.Is(err, utils.ErrCircuitOpen) {
+		t.Error("Expected open circuit, got ", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	atomic.StoreInt32(&healthy, 1)
+	if err := get(); err != nil {
+		t.Error(err)
+	}
+	if len(cp.UpstreamStatus()) != 0 {
+		t.Error("Expected closed circuit")
+	}
+}
+
 // func Test_GetConnectionPoolConcurrent(t *testing.T) {
 // 	cp := NewConnectionPool()
 // 	if cp == nil {
@@ -0,0 +1,81 @@
+package backend
+
+import (
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+func (bd *Backend) ActiveStreams() int64 {
+	return atomic.LoadInt64(&bd.activeStreams)
+}
+
+// status returns the published status and the drain deadline if draining.
+func (bd *Backend) status() (string, *time.Time) {
+	bd.drainMutex.Lock()
+	defer bd.drainMutex.Unlock()
+	if bd.drainDeadline != nil {
+		deadline := *bd.drainDeadline
+		return "draining", &deadline
+	}
+	return "online", nil
+}
+
+func (bd *Backend) IsDraining() bool {
+	status, _ := bd.status()
+	return status == "draining"
+}
+
+// Drain announces the backend as draining, waits until all active streams
+// are finished or the timeout has passed and then closes the server.
+// The returned channel is closed once the backend is stopped.
+func (bd *Backend) Drain(timeout time.Duration) <-chan struct{} {
+	bd.drainMutex.Lock()
+	defer bd.drainMutex.Unlock()
+	if bd.drainDeadline != nil {
+		return bd.drained
+	}
+	if timeout == 0 {
+		timeout = bd.Config.DrainTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	bd.drainDeadline = &deadline
+	bd.drained = make(chan struct{})
+	go func(drained chan struct{}) {
+		// give the frontends time to see the draining status
+		grace := time.Now().Add(2 * bd.Config.RefreshFreq)
+		for time.Now().Before(deadline) {
+			if time.Now().After(grace) && bd.ActiveStreams() == 0 {
+				break
+			}
+			time.Sleep(bd.Config.RefreshFreq / 4)
+		}
+		if active := bd.ActiveStreams(); active > 0 {
+			bd.log.Warn().Int64("active", active).Msg("drain timed out")
+		}
+		if bd.Srv != nil {
+			bd.Srv.Close()
+		}
+		bd.Stop()
+		close(drained)
+	}(bd.drained)
+	return bd.drained
+}
+
+// DrainOnSignal drains the backend when one of the signals arrives,
+// SIGTERM if none is given.
+func (bd *Backend) DrainOnSignal(sigs ...os.Signal) {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{syscall.SIGTERM}
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	go func() {
+		sig := <-ch
+		signal.Stop(ch)
+		bd.log.Info().Str("signal", sig.String()).Msg("draining")
+		bd.Drain(bd.Config.DrainTimeout)
+	}()
+}
@@ -0,0 +1,97 @@
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func Test_DrainWaitsForActiveStreams(t *testing.T) {
+	bd, err := NewBackend(BackendConfig{
+		BrokerUrl:   "mqtt://127.0.0.1:1883/",
+		RefreshFreq: 10 * time.Millisecond,
+		Listen:      "127.0.0.1:4706",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	handler := connectionPoolHandler{backend: bd}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", bd.Config.HealthPath, nil))
+	if w.Code != http.StatusOK {
+		t.Error("Expected healthy backend, got ", w.Code)
+	}
+
+	atomic.AddInt64(&bd.activeStreams, 1)
+	drained := bd.Drain(time.Second)
+	status, deadline := bd.status()
+	if status != "draining" || deadline == nil {
+		t.Error("Expected draining status, got ", status)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", bd.Config.HealthPath, nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Error("Expected draining health check, got ", w.Code)
+	}
+	if bd.Drain(time.Second) != drained {
+		t.Error("Expected drain to be started once")
+	}
+	select {
+	case <-drained:
+		t.Error("Expected drain to wait for the active stream")
+	case <-time.After(100 * time.Millisecond):
+	}
+	atomic.AddInt64(&bd.activeStreams, -1)
+	select {
+	case <-drained:
+	case <-time.After(500 * time.Millisecond):
+		t.Error("Expected drain to finish")
+	}
+	if !bd.Mqtt.ToStop {
+		t.Error("Expected backend to be stopped")
+	}
+}
+
+func Test_HealthPathBelowMuxPath(t *testing.T) {
+	bd, err := NewBackend(BackendConfig{
+		BrokerUrl:      "mqtt://127.0.0.1:1883/",
+		Listen:         "127.0.0.1:4717",
+		MuxEndPointUrl: "https://127.0.0.1:4717/mux/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := connectionPoolHandler{backend: bd}
+	for _, path := range []string{"/h123/health", "/mux/h123/health"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected %s healthy, got %d", path, w.Code)
+		}
+	}
+	if size, _ := bd.lenAndRequests(); size != 0 {
+		t.Errorf("Expected health checks without uplink, got %d", size)
+	}
+}
+
+func Test_DrainOnSignal(t *testing.T) {
+	bd, err := NewBackend(BackendConfig{
+		BrokerUrl:   "mqtt://127.0.0.1:1883/",
+		RefreshFreq: 10 * time.Millisecond,
+		Listen:      "127.0.0.1:4718",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bd.DrainOnSignal(syscall.SIGUSR1)
+	syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+	time.Sleep(50 * time.Millisecond)
+	if !bd.IsDraining() {
+		t.Error("Expected draining after the signal")
+	}
+}
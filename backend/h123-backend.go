@@ -1,25 +1,43 @@
 package backend
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
 	"github.com/lucas-clemente/quic-go"
 	"github.com/lucas-clemente/quic-go/http3"
+	"github.com/mabels/h123-reflector/accesslog"
+	"github.com/mabels/h123-reflector/admin"
+	"github.com/mabels/h123-reflector/cache"
+	"github.com/mabels/h123-reflector/certs"
+	"github.com/mabels/h123-reflector/compression"
+	"github.com/mabels/h123-reflector/metrics"
 	"github.com/mabels/h123-reflector/models"
+	"github.com/mabels/h123-reflector/quicdebug"
+	"github.com/mabels/h123-reflector/tracing"
 	"github.com/mabels/h123-reflector/utils"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
+const upstreamKey = attribute.Key("h123.upstream")
+
 type BackendConfig struct {
 	BrokerUrl           string
 	StatusTopic         *string
@@ -29,16 +47,80 @@ type BackendConfig struct {
 	Listen              string
 	CertFile            string
 	KeyFile             string
+	CertDir             string             // more certificates chosen by SNI, all are reloaded on change
+	DevCA               *certs.DevCAConfig // creates CertFile and KeyFile if they are missing
 	CloseAfterInactive  time.Duration
 	MqttCfg             *mqtt.ClientOptions
+	Circuit             utils.CircuitConfig
+	HealthPath          string
+	DrainTimeout        time.Duration
+	DrainOnSignal       bool // drain on SIGTERM instead of stopping at once
+	Tunnel              bool // dial the announced frontends instead of listening
+	TunnelTopic         *string
+	TunnelTLSConfig     *tls.Config
+	TunnelToken         string // proves the MuxEndPointUrl to the frontends
+	AllowConnect        bool   // relay CONNECT and CONNECT-UDP from the frontends
+	// ConnectAllow are the CONNECT targets, any public address if empty.
+	// Loopback, link-local and private addresses need a CIDR target.
+	ConnectAllow        []ConnectTarget
+	ConnectTimeout      time.Duration
+	UDPIdleTimeout      time.Duration
+	MetricsListen       string
+	Log                 *utils.Logger
+	AccessLog           *accesslog.Config // no access log if nil
+	Tracing             *tracing.Config   // no spans if nil
+	Admin               *admin.Config     // no admin listener if nil
+	RateLimit           utils.RateLimitConfig
+	UpstreamConcurrency utils.ConcurrencyConfig // in flight per upstream host
+	Coalesce            CoalesceConfig
+	Cache               *cache.Config // no cache if nil
+	ListenQuic          utils.QuicConfig
+	UpstreamQuic        utils.QuicConfig  // to the upstreams which announce h3
+	TunnelQuic          utils.QuicConfig  // of the tunnels to the frontends
+	Decompress          bool              // decode upstream responses, the frontend encodes for its clients
+	QuicDebug           *quicdebug.Config // qlog and TLS key log, SSLKEYLOGFILE works without
+	// SessionTicketKeyFile lets frontends resume and send 0-RTT after a
+	// restart, without it the tickets are lost with the process
+	SessionTicketKeyFile string
+	Capacity             CapacityConfig
+	// announced for the locality of the frontends
+	Region string
+	Zone   string
+	Labels map[string]string
 }
 
+// WaitForClose is an uplink of a frontend, tracked by its QUIC connection
+// until it closes or is inactive for CloseAfterInactive.
 type WaitForClose struct {
-	Request     http.Request // First request that started the close.
+	ID          string
+	RemoteAddr  string // of the last request, it changes with migration
+	Frontend    string // declared by X-H123-Frontend
 	Backend     *Backend
 	LastRequest time.Time
-	// RemoteAddr string
-	Requests uint64
+	Requests    uint64
+	conn        quic.Connection // nil without QUIC
+	streams     int64           // requests in flight on the uplink
+	closing     int32           // 1 after X-H123-Uplink-Close, 2 once closed
+}
+
+// uplinkCloseDelay lets the response to X-H123-Uplink-Close reach the
+// frontend before its connection is closed.
+const uplinkCloseDelay = time.Second
+
+// close closes the QUIC connection of the uplink after delay.
+func (uc *WaitForClose) close(delay time.Duration, reason string) {
+	if uc.conn == nil {
+		return
+	}
+	time.AfterFunc(delay, func() { uc.conn.CloseWithError(0, reason) })
+}
+
+// done ends a request on the uplink, a closing uplink is closed after
+// its last request.
+func (uc *WaitForClose) done() {
+	if atomic.AddInt64(&uc.streams, -1) == 0 && atomic.CompareAndSwapInt32(&uc.closing, 1, 2) {
+		uc.close(uplinkCloseDelay, "uplink close")
+	}
 }
 
 type Backend struct {
@@ -46,8 +128,33 @@ type Backend struct {
 	Mqtt                  *utils.MqttConnection
 	Srv                   *http3.Server
 	UplinkConnectionMutex sync.Mutex
-	UplinkConnections     map[string]*WaitForClose
+	UplinkConnections     map[interface{}]*WaitForClose // by QUIC connection or RemoteAddr
 	ConnectionPool        *ConnectionPool
+	activeStreams         int64
+	drainMutex            sync.Mutex
+	drainDeadline         *time.Time
+	drained               chan struct{}
+	tunnelMutex           sync.Mutex
+	tunnels               map[string]*tunnel
+	Metrics               *metrics.Registry
+	metricsServer         *http.Server
+	accessLog             *accesslog.Logger
+	tracing               *tracing.Tracing
+	admin                 *admin.Server
+	rateLimit             *utils.RateLimiter
+	upstreamLimit         *utils.ConcurrencyLimiter
+	connectRules          []connectRule
+	limited               *metrics.Counter
+	coalescer             *coalescer
+	coalesced             *metrics.Counter
+	cache                 *cache.Cache
+	cached                *metrics.Counter
+	earlyData             *metrics.Counter
+	handshakes            *metrics.Counter
+	certs                 *certs.Manager
+	quic                  map[string]*quic.Config // by endpoint
+	debug                 *quicdebug.Debugger
+	log                   *utils.Logger
 }
 
 // func (bd *Backend) SetupFrontendStream() error {
@@ -84,28 +191,51 @@ func (bd *Backend) lenAndRequests() (size int, request uint64) {
 
 func (bd *Backend) Stop() {
 	bd.Mqtt.Stop()
+	if bd.metricsServer != nil {
+		bd.metricsServer.Close()
+	}
+	if bd.accessLog != nil {
+		bd.accessLog.Close()
+	}
+	if bd.admin != nil {
+		bd.admin.Close()
+	}
+	if bd.certs != nil {
+		bd.certs.Close()
+	}
+	bd.debug.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	bd.tracing.Shutdown(ctx)
 }
 
 func (bd *Backend) StartBackendConfigStream() error {
 	bd.Mqtt.Connect()
 	go func() {
 		bd.Mqtt.State.MuxEndPointUrl = bd.Config.MuxEndPointUrl
+		bd.Mqtt.State.Tunnel = bd.Config.Tunnel
+		bd.Mqtt.State.Region = bd.Config.Region
+		bd.Mqtt.State.Zone = bd.Config.Zone
+		bd.Mqtt.State.Labels = bd.Config.Labels
+		bd.Mqtt.State.Quic = bd.QuicStatus()
 		c := 0
 		for ; !bd.Mqtt.ToStop; c++ {
 			// fmt.Printf("mux-online: %s:%d\n", bd.Subscription.MqttPath, c)
 			len, request := bd.lenAndRequests()
 			bd.Mqtt.State.FrontendConnections = len
 			bd.Mqtt.State.Requests = request
+			bd.Mqtt.State.Upstreams = bd.ConnectionPool.UpstreamStatus()
 			bd.Mqtt.State.Now = time.Now()
-			bd.Mqtt.State.Status = "online"
+			bd.Mqtt.State.Status, bd.Mqtt.State.DrainDeadline = bd.status()
+			bd.setCapacity(&bd.Mqtt.State)
 			bd.Mqtt.State.Loop = c
 			out, err := json.Marshal(bd.Mqtt.State)
 			if err != nil {
-				log.Fatal(err)
+				bd.log.Fatal().Err(err).Msg("marshal status")
 			}
 			err = bd.Mqtt.Publish(*bd.Config.StatusTopic, 1, false, out)
 			if err != nil {
-				log.Println(err)
+				bd.log.Warn().Str("topic", *bd.Config.StatusTopic).Err(err).Msg("publish status")
 			}
 			time.Sleep(bd.Config.RefreshFreq)
 		}
@@ -119,13 +249,14 @@ func (bd *Backend) StartBackendConfigStream() error {
 		bd.Mqtt.State.Requests = request
 		bd.Mqtt.State.Now = time.Now()
 		bd.Mqtt.State.Status = "offline"
+		bd.Mqtt.State.DrainDeadline = nil
 		out, err := json.Marshal(bd.Mqtt.State)
 		if err != nil {
-			log.Fatal(err)
+			bd.log.Fatal().Err(err).Msg("marshal status")
 		}
 		err = bd.Mqtt.Publish(*bd.Config.StatusTopic, 1, false, out)
 		if err != nil {
-			log.Println(err)
+			bd.log.Warn().Str("topic", *bd.Config.StatusTopic).Err(err).Msg("publish status")
 		}
 		bd.Mqtt.Close()
 	}()
@@ -140,7 +271,7 @@ func (bd *Backend) mqttAddConnection() func(action Action, key string, value *Co
 		topic := path.Join(*bd.Config.BaseConnectionTopic, key)
 		out, err := json.Marshal(value)
 		if err != nil {
-			log.Printf("Error marshalling connection: %s\n", err)
+			bd.log.Error().Str("upstream", key).Err(err).Msg("marshal connection")
 			return
 		}
 		bd.Mqtt.Publish(topic, 1, false, out)
@@ -157,16 +288,129 @@ func NewBackend(config BackendConfig) (*Backend, error) {
 		my = strings.ReplaceAll(my, ":", "_")
 		config.StatusTopic = &my
 	}
+	if config.RefreshFreq == 0 {
+		config.RefreshFreq = time.Second
+	}
+	if config.DrainTimeout == 0 {
+		config.DrainTimeout = 30 * time.Second
+	}
+	if config.ConnectTimeout == 0 {
+		config.ConnectTimeout = 10 * time.Second
+	}
+	if config.UDPIdleTimeout == 0 {
+		config.UDPIdleTimeout = time.Minute
+	}
+	if config.HealthPath == "" {
+		config.HealthPath = "/h123/health"
+	}
+	if config.TunnelTopic == nil {
+		my := "h123/tunnel/#"
+		config.TunnelTopic = &my
+	}
+	if config.Log == nil {
+		config.Log = utils.NewLogger()
+	}
 	if config.BaseConnectionTopic == nil {
 		my := path.Join(path.Dir(*config.StatusTopic), "connections")
 		config.BaseConnectionTopic = &my
 	}
+	err = config.Capacity.validate()
+	if err != nil {
+		return nil, err
+	}
+	connectRules, err := parseConnectTargets(config.ConnectAllow)
+	if err != nil {
+		return nil, err
+	}
 	bd := Backend{
 		Config:            config,
-		UplinkConnections: map[string]*WaitForClose{},
+		UplinkConnections: map[interface{}]*WaitForClose{},
 		Mqtt:              mqtt,
+		tunnels:           map[string]*tunnel{},
+		Metrics:           metrics.NewRegistry("backend"),
+		rateLimit:         utils.NewRateLimiter(config.RateLimit),
+		upstreamLimit:     utils.NewConcurrencyLimiter(config.UpstreamConcurrency),
+		coalescer:         newCoalescer(config.Coalesce),
+		connectRules:      connectRules,
+		log:               config.Log.Component("backend").With("mux", config.MuxEndPointUrl),
+	}
+	bd.Mqtt.Log = config.Log.Component("mqtt")
+	if config.AccessLog != nil {
+		bd.accessLog, err = accesslog.New(config.AccessLog)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.Tracing != nil {
+		bd.tracing, err = tracing.New(config.Tracing, "backend")
+		if err != nil {
+			return nil, err
+		}
+	}
+	bd.debug, err = quicdebug.New(config.QuicDebug, "backend", config.Log)
+	if err != nil {
+		return nil, err
+	}
+	if config.Admin != nil {
+		bd.admin, err = admin.New(config.Admin, config.Log)
+		if err != nil {
+			return nil, err
+		}
+		bd.adminRoutes(bd.admin)
+		bd.debug.Routes(bd.admin)
+	}
+	if config.CertFile != "" || config.CertDir != "" || config.DevCA != nil {
+		bd.certs, err = certs.New(certs.Config{
+			CertFile:             config.CertFile,
+			KeyFile:              config.KeyFile,
+			Dir:                  config.CertDir,
+			DevCA:                config.DevCA.WithHosts(certs.ListenHosts(config.Listen)...),
+			SessionTicketKeyFile: config.SessionTicketKeyFile,
+		}, config.Log)
+		if err != nil {
+			return nil, err
+		}
+	}
+	bd.cache, err = cache.New(config.Cache)
+	if err != nil {
+		return nil, err
+	}
+	err = bd.setupQuic()
+	if err != nil {
+		return nil, err
 	}
-	bd.ConnectionPool = NewConnectionPool(bd.mqttAddConnection())
+	bd.Srv = bd.newServer()
+	poolChanges := bd.Metrics.Counter("h123_backend_pool_changes_total", "Changes of the upstream connection pool.", "action")
+	addConnection := bd.mqttAddConnection()
+	bd.ConnectionPool = NewConnectionPool(func(action Action, key string, value *Connection) {
+		poolChanges.Inc(string(action))
+		addConnection(action, key, value)
+	})
+	bd.ConnectionPool.Circuit = config.Circuit
+	bd.ConnectionPool.Quic = bd.quic["upstream"]
+	bd.ConnectionPool.KeyLog = bd.debug.KeyLogWriter()
+	bd.ConnectionPool.Tracer = bd.debug.Tracer()
+	bd.Metrics.GaugeFunc("h123_backend_pool_connections", "Upstream connections in the pool.", func() float64 {
+		return float64(bd.ConnectionPool.Size())
+	})
+	bd.Metrics.GaugeFunc("h123_backend_uplink_connections", "Active uplink connections from frontends.", func() float64 {
+		size, _ := bd.lenAndRequests()
+		return float64(size)
+	})
+	bd.limited = bd.Metrics.Counter("h123_backend_limited_total", "Requests queued or rejected by a limit.", "limit", "outcome")
+	bd.coalesced = bd.Metrics.Counter("h123_backend_coalesced_total", "Coalesced requests by role, private followers fetch their own.", "role")
+	bd.cached = bd.Metrics.Counter("h123_backend_cache_total", "Requests by cache outcome.", "outcome")
+	bd.earlyData = bd.Metrics.Counter("h123_backend_early_data_total", "Requests received in 0-RTT by outcome.", "outcome")
+	bd.handshakes = bd.Metrics.Counter("h123_backend_uplink_handshakes_total", "Uplink connections by handshake, full, resumed or 0rtt.", "kind")
+	bd.Metrics.GaugeFunc("h123_backend_cache_bytes", "Bytes in the response cache.", func() float64 {
+		return float64(bd.cache.Size())
+	})
+	bd.Metrics.GaugeFunc("h123_backend_upstream_in_flight", "Requests in flight to the upstreams.", func() float64 {
+		return float64(bd.upstreamLimit.InFlight())
+	})
+	bd.Metrics.GaugeFunc("h123_backend_active_streams", "Requests and relays in progress.", func() float64 {
+		return float64(bd.ActiveStreams())
+	})
 	return &bd, nil
 }
 
@@ -174,23 +418,53 @@ type connectionPoolHandler struct {
 	backend *Backend
 }
 
-func (cph connectionPoolHandler) handleWaitConnection(w *http.ResponseWriter, r *http.Request) {
-	cph.backend.UplinkConnectionMutex.Lock()
-	my, found := cph.backend.UplinkConnections[r.RemoteAddr]
+// handleWaitConnection tracks the uplink of r, done must be called on the
+// returned uplink when r is finished.
+func (cph connectionPoolHandler) handleWaitConnection(w *http.ResponseWriter, r *http.Request) *WaitForClose {
+	var conn quic.Connection
+	if w != nil {
+		conn = utils.QuicConnection(*w)
+	}
+	var key interface{} = r.RemoteAddr
+	if conn != nil {
+		key = conn
+	}
+	bd := cph.backend
+	bd.UplinkConnectionMutex.Lock()
+	my, found := bd.UplinkConnections[key]
 	if !found {
 		my = &WaitForClose{
-			Request: *r,
-			Backend: cph.backend,
+			ID:      uuid.New().String(),
+			Backend: bd,
+			conn:    conn,
+		}
+		bd.UplinkConnections[key] = my
+		if conn != nil {
+			go func() { bd.handshakes.Inc(utils.HandshakeKind(conn)) }()
+			go func() {
+				<-conn.Context().Done()
+				bd.UplinkConnectionMutex.Lock()
+				if bd.UplinkConnections[key] == my {
+					delete(bd.UplinkConnections, key)
+				}
+				bd.UplinkConnectionMutex.Unlock()
+			}()
 		}
-		cph.backend.UplinkConnections[r.RemoteAddr] = my
+	}
+	my.RemoteAddr = r.RemoteAddr
+	if frontend := r.Header.Get("X-H123-Frontend"); frontend != "" {
+		my.Frontend = frontend
 	}
 	my.LastRequest = time.Now()
-	cph.backend.UplinkConnectionMutex.Unlock()
+	bd.UplinkConnectionMutex.Unlock()
 	atomic.AddUint64(&my.Requests, 1)
+	atomic.AddInt64(&my.streams, 1)
 	_, found = r.Header["X-H123-Uplink-Close"]
 	if found {
-		my.Backend.DeleteUplinkConnectionWithLock(r.RemoteAddr)
+		bd.DeleteUplinkConnectionWithLock(my.ID)
+		atomic.CompareAndSwapInt32(&my.closing, 0, 1)
 	}
+	return my
 }
 
 func (cph connectionPoolHandler) reflectorResponse(w http.ResponseWriter, r *http.Request, status int, err error) {
@@ -198,8 +472,12 @@ func (cph connectionPoolHandler) reflectorResponse(w http.ResponseWriter, r *htt
 	if err != nil {
 		my := err.Error()
 		errStr = &my
+		// tells the frontend that no upstream byte was sent
+		w.Header().Set("X-H123-Error", strings.ReplaceAll(my, "\n", " "))
+		cph.backend.requestLog(r).Warn().Int("status", status).Err(err).Msg("request failed")
 	}
 
+	tlsState := utils.ConnState(w, r)
 	out, _ := json.MarshalIndent(models.ReflectorResponse{
 		RemoteAddr:     r.RemoteAddr,
 		Protocol:       r.Proto,
@@ -207,6 +485,8 @@ func (cph connectionPoolHandler) reflectorResponse(w http.ResponseWriter, r *htt
 		Header:         r.Header,
 		Error:          errStr,
 		MuxEndPointUrl: cph.backend.Config.MuxEndPointUrl,
+		Resumed:        tlsState.Resumed,
+		EarlyData:      tlsState.EarlyData,
 	}, "", "  ")
 	w.Header().Add("Content-Type", "application/json")
 	rstat := 200
@@ -228,12 +508,36 @@ func (cph connectionPoolHandler) proxy(bSchema string, bHost string, w http.Resp
 		Header: r.Header,
 		Body:   r.Body,
 	}
+	if cph.backend.Config.Decompress {
+		req.Header = r.Header.Clone()
+		req.Header.Set("Accept-Encoding", strings.Join(compression.Decodable, ", "))
+	}
+	tracer := cph.backend.tracing
+	_, setupSpan := tracer.Start(r.Context(), "backend.pool_setup", trace.WithAttributes(upstreamKey.String(bHost)))
 	conn, err := cph.backend.ConnectionPool.Setup(bSchema, bHost)
 	if err != nil {
+		setupSpan.RecordError(err)
+		setupSpan.SetStatus(codes.Error, err.Error())
+		setupSpan.End()
 		cph.reflectorResponse(w, r, http.StatusInternalServerError, err)
 		return
 	}
+	setupSpan.End()
+	release, queued, err := cph.backend.upstreamLimit.Acquire(r.Context(), bHost)
+	if !cph.limitResponse(w, r, "concurrency", http.StatusServiceUnavailable, queued, err) {
+		return
+	}
+	defer release()
+	ctx, doSpan := tracer.Start(r.Context(), "backend.upstream", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(upstreamKey.String(bHost), tracing.TxnKey.String(r.Header.Get("X-H123-Txn"))))
+	tracer.Inject(ctx, propagation.HeaderCarrier(req.Header))
+	start := time.Now()
 	resp, err := conn.Do(req)
+	tracing.EndClientSpan(doSpan, resp, err)
+	if errors.Is(err, utils.ErrCircuitOpen) {
+		cph.reflectorResponse(w, r, http.StatusServiceUnavailable, err)
+		return
+	}
 	if err != nil {
 		cph.reflectorResponse(w, r, http.StatusInternalServerError, err)
 		return
@@ -247,23 +551,107 @@ func (cph connectionPoolHandler) proxy(bSchema string, bHost string, w http.Resp
 	// 	Header:     make(http.Header),
 	// 	Body:       io.NopCloser(bytes.NewBufferString(string(resOut))),
 	// }
-	w.WriteHeader(resp.StatusCode)
+	defer resp.Body.Close()
+	body := io.Reader(resp.Body)
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && cph.backend.Config.Decompress {
+		decoded, err := compression.Decode(encoding, resp.Body)
+		if err == nil {
+			defer decoded.Close()
+			body = decoded
+			resp.Header.Del("Content-Encoding")
+			resp.Header.Del("Content-Length")
+			if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				resp.Header.Set("ETag", "W/"+etag)
+			}
+		}
+	}
+	ttfb := time.Since(start)
+	if entry := accesslog.FromContext(r.Context()); entry != nil {
+		entry.Upstream = bHost
+		entry.OutProto = resp.Proto
+		entry.AddTiming("upstream", ttfb)
+	}
 	for k, vs := range resp.Header {
 		for _, v := range vs {
 			w.Header().Add(k, v)
 		}
 	}
-	body, err := io.ReadAll(resp.Body)
+	// lets the frontend log the upstream time of this hop
+	w.Header().Add("Server-Timing", accesslog.ServerTiming("upstream", ttfb))
+	w.WriteHeader(resp.StatusCode)
+	// the status is sent, errors from here on can only abort the stream
+	_, err = io.Copy(w, body)
 	if err != nil {
-		cph.reflectorResponse(w, r, http.StatusInsufficientStorage, err)
+		cache.Abort(w)
+		cph.backend.requestLog(r).Warn().Int("status", resp.StatusCode).Err(err).Msg("response aborted")
 		return
 	}
-	w.Write(body)
+	cph.backend.requestLog(r).Debug().Int("status", resp.StatusCode).Msg("proxied")
+}
+
+// limitResponse counts the outcome of a limit, requests over the limit
+// are answered with status and Retry-After and false is returned.
+func (cph connectionPoolHandler) limitResponse(w http.ResponseWriter, r *http.Request, limit string, status int, queued bool, err error) bool {
+	if queued {
+		cph.backend.limited.Inc(limit, "queued")
+	}
+	if err == nil {
+		return true
+	}
+	var lerr *utils.LimitedError
+	if errors.As(err, &lerr) {
+		cph.backend.limited.Inc(limit, "rejected")
+		w.Header().Set("Retry-After", strconv.Itoa(lerr.RetryAfterSeconds()))
+	} else {
+		status = http.StatusServiceUnavailable
+	}
+	cph.reflectorResponse(w, r, status, err)
+	return false
+}
+
+// isHealthCheck tells if r is for HealthPath, the frontends also send it
+// below the path of the MuxEndPointUrl.
+func (bd *Backend) isHealthCheck(r *http.Request) bool {
+	if r.URL.Path == bd.Config.HealthPath {
+		return true
+	}
+	mux, err := url.Parse(bd.Config.MuxEndPointUrl)
+	return err == nil && r.URL.Path == path.Join(mux.Path, bd.Config.HealthPath)
+}
+
+// requestLog is the backend log with the txn and upstream of the request.
+func (bd *Backend) requestLog(r *http.Request) *utils.Logger {
+	return bd.log.With("txn", r.Header.Get("X-H123-Txn")).With("upstream", r.Header.Get("X-H123-Backend-Host"))
 }
 
 func (cph connectionPoolHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	cph.handleWaitConnection(&w, r)
+	atomic.AddInt64(&cph.backend.activeStreams, 1)
+	defer atomic.AddInt64(&cph.backend.activeStreams, -1)
+	if utils.ConnState(w, r).EarlyData {
+		// a replayed 0-RTT request must not change anything
+		if !utils.ReplaySafe(r.Method) {
+			cph.backend.earlyData.Inc("rejected")
+			cph.reflectorResponse(w, r, http.StatusTooEarly, fmt.Errorf("%s in early data", r.Method))
+			return
+		}
+		cph.backend.earlyData.Inc("accepted")
+	}
 	backCon, found := r.Header["X-H123-Backend-Host"]
+	if !found && cph.backend.isHealthCheck(r) {
+		// health checks should not keep uplink connections alive
+		if cph.backend.IsDraining() {
+			cph.reflectorResponse(w, r, http.StatusServiceUnavailable, fmt.Errorf("draining"))
+			return
+		}
+		// only the frontends at the other end of the tunnels can ask
+		if challenge := r.Header.Get("X-H123-Tunnel-Challenge"); challenge != "" && cph.backend.Config.Tunnel && cph.backend.Config.TunnelToken != "" {
+			w.Header().Set("X-H123-Tunnel-Proof", utils.TunnelProof(cph.backend.Config.TunnelToken, challenge, cph.backend.Config.MuxEndPointUrl))
+		}
+		cph.reflectorResponse(w, r, http.StatusOK, nil)
+		return
+	}
+	uc := cph.handleWaitConnection(&w, r)
+	defer uc.done()
 	if !found || len(backCon) == 0 {
 		cph.reflectorResponse(w, r, http.StatusBadRequest, fmt.Errorf("X-H123-Backend-Host header is missing"))
 		return
@@ -278,19 +666,93 @@ func (cph connectionPoolHandler) ServeHTTP(w http.ResponseWriter, r *http.Reques
 		cph.reflectorResponse(w, r, http.StatusBadGateway, err)
 		return
 	}
-	cph.proxy(backend.Scheme, backend.Host, w, r)
+	metrics.SetUpstream(r.Context(), backend.Host)
+	if cph.backend.rateLimit != nil {
+		rl := cph.backend.rateLimit
+		queued, err := rl.Wait(r.Context(), rl.RequestKey(r, backend.Host))
+		if !cph.limitResponse(w, r, "rate", http.StatusTooManyRequests, queued, err) {
+			return
+		}
+	}
+	cph.cached(backend.Scheme, backend.Host, w, r)
 	// cph.reflectorResponse(w, r, http.StatusOK, nil)
 }
 
-func (bd *Backend) DeleteUplinkConnectionWithLock(remoteAddr string) {
+func (bd *Backend) DeleteUplinkConnectionWithLock(id string) *WaitForClose {
 	bd.UplinkConnectionMutex.Lock()
-	bd.DeleteUplinkConnection(remoteAddr)
-	bd.UplinkConnectionMutex.Unlock()
+	defer bd.UplinkConnectionMutex.Unlock()
+	return bd.DeleteUplinkConnection(id)
+}
+
+// DeleteUplinkConnection removes the uplink with id, or with the
+// RemoteAddr id of its last request, the connection stays open.
+func (bd *Backend) DeleteUplinkConnection(id string) *WaitForClose {
+	for key, uc := range bd.UplinkConnections {
+		if uc.ID == id || uc.RemoteAddr == id {
+			delete(bd.UplinkConnections, key)
+			return uc
+		}
+	}
+	return nil
+}
+
+func (bd *Backend) newServer() *http3.Server {
+	var handler http.Handler = connectionPoolHandler{backend: bd}
+	handler = tracing.Handler(bd.tracing, "backend.request", handler)
+	handler = accesslog.Handler(bd.accessLog, "backend", handler)
+	srv := &http3.Server{
+		Addr:            bd.Config.Listen,
+		Handler:         bd.Metrics.Instrument(handler),
+		EnableDatagrams: true,
+		StreamHijacker: func(f http3.FrameType, c quic.Connection, s quic.Stream, err error) (hijacked bool, _ error) {
+			if err != nil || f != utils.RelayFrameType {
+				return false, nil
+			}
+			bd.serveRelay(c, s)
+			return true, nil
+		},
+	}
+	srv.QuicConfig = bd.quic["listen"]
+	return srv
+}
+
+// setupQuic validates the QUIC configs of all endpoints.
+func (bd *Backend) setupQuic() error {
+	tracer := func(base *quic.Config) *quic.Config {
+		if bd.Config.MetricsListen != "" {
+			base.Tracer = bd.Metrics.QuicTracer()
+		}
+		return bd.debug.AddTracer(base)
+	}
+	bd.quic = map[string]*quic.Config{}
+	for name, endpoint := range map[string]struct {
+		cfg  utils.QuicConfig
+		base *quic.Config
+	}{
+		"listen":   {bd.Config.ListenQuic, tracer(&quic.Config{})},
+		"upstream": {bd.Config.UpstreamQuic, &quic.Config{}}, // the pool adds the qlog tracer
+		// keep the NAT binding alive
+		"tunnel": {bd.Config.TunnelQuic, tracer(&quic.Config{KeepAlivePeriod: 10 * time.Second, EnableDatagrams: true})},
+	} {
+		cfg, err := endpoint.cfg.Apply(endpoint.base)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		bd.quic[name] = cfg
+	}
+	return nil
 }
 
-func (bd *Backend) DeleteUplinkConnection(remoteAddr string) {
-	delete(bd.UplinkConnections, remoteAddr)
-	// log.Printf("Remove MuxFrontendConnection: %s\n", remoteAddr)
+// QuicStatus are the effective QUIC parameters by endpoint.
+func (bd *Backend) QuicStatus() map[string]models.QuicStatus {
+	ret := map[string]models.QuicStatus{}
+	for name, cfg := range bd.quic {
+		if name == "tunnel" && !bd.Config.Tunnel || name == "listen" && bd.Config.Tunnel {
+			continue
+		}
+		ret[name] = utils.QuicStatus(cfg)
+	}
+	return ret
 }
 
 func (bd *Backend) Start() error {
@@ -298,42 +760,52 @@ func (bd *Backend) Start() error {
 	if err != nil {
 		return err
 	}
-	handler := connectionPoolHandler{backend: bd}
-
-	bd.Srv = &http3.Server{
-		Addr:    bd.Config.Listen,
-		Handler: handler,
-		StreamHijacker: func(_f http3.FrameType, c quic.Connection, _s quic.Stream, _err error) (hijacked bool, err error) {
-			log.Fatalln("StreamHijacker", c.Context())
-			return false, nil
-		},
-		UniStreamHijacker: func(_s http3.StreamType, c quic.Connection, _r quic.ReceiveStream, _err error) (hijacked bool) {
-			log.Fatalln("UniStreamHijacker", c.Context())
-			return false
-		},
+	if bd.Config.DrainOnSignal {
+		bd.DrainOnSignal()
+	}
+	if bd.Config.MetricsListen != "" {
+		bd.metricsServer = bd.Metrics.Serve(bd.Config.MetricsListen, bd.log)
+	}
+	if bd.admin != nil {
+		err = bd.admin.Start()
+		if err != nil {
+			return err
+		}
 	}
 	done := false
-	go func() {
-		if err := bd.Srv.ListenAndServeTLS(bd.Config.CertFile, bd.Config.KeyFile); err != quic.ErrServerClosed {
-			log.Fatalf("ListenAndServeTLS(): %v", err)
+	if bd.Config.Tunnel {
+		err = bd.StartTunnels()
+		if err != nil {
+			return err
 		}
-		done = true
-	}()
+	} else {
+		if bd.certs == nil {
+			return fmt.Errorf("listening needs a certificate")
+		}
+		bd.certs.Start()
+		bd.Srv.TLSConfig = bd.debug.TLSConfig(bd.certs.TLSConfig())
+		go func() {
+			if err := bd.Srv.ListenAndServe(); err != quic.ErrServerClosed {
+				bd.log.Fatal().Str("listen", bd.Config.Listen).Err(err).Msg("ListenAndServeTLS()")
+			}
+			done = true
+		}()
+	}
 	go func() {
 		if bd.Config.CloseAfterInactive == 0 {
 			bd.Config.CloseAfterInactive = 60 * time.Second
 		}
-		for !done {
+		for !done && !bd.Mqtt.ToStop {
 			time.Sleep(bd.Config.CloseAfterInactive)
 			bd.UplinkConnectionMutex.Lock()
 			now := time.Now()
-			for _, uc := range bd.UplinkConnections {
+			for key, uc := range bd.UplinkConnections {
 				if uc.LastRequest.Equal(time.Time{}) {
 					continue
 				}
 				// fmt.Printf("%s:%d:%d\n", uc.Backend.Config.Listen, now.Sub(uc.LastRequest), bd.Config.CloseAfterInactive)
 				if uc.LastRequest.Add(bd.Config.CloseAfterInactive).Before(now) {
-					bd.DeleteUplinkConnection(uc.Request.RemoteAddr)
+					delete(bd.UplinkConnections, key)
 				}
 			}
 			bd.UplinkConnectionMutex.Unlock()
@@ -1,16 +1,21 @@
 package backend
 
 import (
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/http3"
 	"github.com/mabels/h123-reflector/models"
 	"github.com/mabels/h123-reflector/reflector"
 	"github.com/mabels/h123-reflector/utils"
@@ -365,3 +370,134 @@ func Test_HandleProxyRequest(t *testing.T) {
 	closeReflector()
 
 }
+
+func Test_UpstreamConcurrencyLimit(t *testing.T) {
+	bd, err := NewBackend(BackendConfig{
+		BrokerUrl:           "mqtt://127.0.0.1:1883/",
+		Listen:              "127.0.0.1:4709",
+		UpstreamConcurrency: utils.ConcurrencyConfig{MaxInFlight: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer upstream.Close()
+	request := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-H123-Backend-Host", upstream.URL)
+		req.Header.Set("X-H123-Txn", "t1")
+		w := httptest.NewRecorder()
+		connectionPoolHandler{backend: bd}.ServeHTTP(w, req)
+		return w
+	}
+	done := make(chan int)
+	go func() { done <- request().Code }()
+	for bd.upstreamLimit.InFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	w := request()
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected 503 with Retry-After, got %d %v", w.Code, w.Header())
+	}
+	close(block)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("Expected 200 for the first request, got %d", code)
+	}
+}
+
+func Test_DecompressUpstream(t *testing.T) {
+	bd, err := NewBackend(BackendConfig{
+		BrokerUrl:  "mqtt://127.0.0.1:1883/",
+		Listen:     "127.0.0.1:4712",
+		Decompress: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "br, zstd, gzip" {
+			t.Errorf("Expected the decodable encodings, got %s", r.Header.Get("Accept-Encoding"))
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("ETag", `"v1"`)
+		gw := gzip.NewWriter(w)
+		gw.Write([]byte("plain"))
+		gw.Close()
+	}))
+	defer upstream.Close()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-H123-Backend-Host", upstream.URL)
+	req.Header.Set("X-H123-Txn", "t1")
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	connectionPoolHandler{backend: bd}.ServeHTTP(w, req)
+	if w.Body.String() != "plain" || w.Header().Get("Content-Encoding") != "" || w.Header().Get("ETag") != `W/"v1"` {
+		t.Errorf("Expected the decoded body, got %q %v", w.Body.String(), w.Header())
+	}
+	if req.Header.Get("Accept-Encoding") != "gzip" {
+		t.Error("Expected the request header of the client to stay")
+	}
+}
+
+// earlyConnection is a 0-RTT connection whose handshake is not complete.
+type earlyConnection struct {
+	quic.EarlyConnection
+	ctx context.Context
+}
+
+func (ec earlyConnection) HandshakeComplete() context.Context {
+	return context.Background()
+}
+
+func (ec earlyConnection) Context() context.Context {
+	return ec.ctx
+}
+
+func (ec earlyConnection) ConnectionState() quic.ConnectionState {
+	state := quic.ConnectionState{}
+	state.TLS.Used0RTT = true
+	return state
+}
+
+type earlyRecorder struct {
+	*httptest.ResponseRecorder
+	conn earlyConnection
+}
+
+func (er earlyRecorder) StreamCreator() http3.StreamCreator {
+	return er.conn
+}
+
+func Test_EarlyData(t *testing.T) {
+	bd, err := NewBackend(BackendConfig{
+		BrokerUrl: "mqtt://127.0.0.1:1883/",
+		Listen:    "127.0.0.1:4721",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	request := func(method string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/", nil)
+		req.Header.Set("X-H123-Backend-Host", upstream.URL)
+		req.Header.Set("X-H123-Txn", "t1")
+		w := earlyRecorder{httptest.NewRecorder(), earlyConnection{ctx: ctx}}
+		connectionPoolHandler{backend: bd}.ServeHTTP(w, req)
+		return w.ResponseRecorder
+	}
+	if w := request("POST"); w.Code != http.StatusTooEarly || w.Header().Get("X-H123-Error") == "" {
+		t.Errorf("Expected 425 with X-H123-Error for a POST in early data, got %d %v", w.Code, w.Header())
+	}
+	if w := request("GET"); w.Code != http.StatusOK {
+		t.Errorf("Expected a GET in early data served, got %d", w.Code)
+	}
+	if bd.earlyData.Value("rejected") != 1 || bd.earlyData.Value("accepted") != 1 {
+		t.Errorf("Expected one rejected and one accepted request, got %v %v", bd.earlyData.Value("rejected"), bd.earlyData.Value("accepted"))
+	}
+}
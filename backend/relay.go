@@ -0,0 +1,156 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/mabels/h123-reflector/utils"
+)
+
+var errConnectNotAllowed = errors.New("CONNECT is not allowed")
+
+// ConnectTarget allows CONNECT to Host on Ports.
+type ConnectTarget struct {
+	Host  string // CIDR, host name or *.domain
+	Ports []int  // all ports if empty
+}
+
+type connectRule struct {
+	network *net.IPNet // nil for a host name
+	host    string
+	ports   map[int]bool
+}
+
+func parseConnectTargets(targets []ConnectTarget) ([]connectRule, error) {
+	rules := make([]connectRule, 0, len(targets))
+	for _, target := range targets {
+		rule := connectRule{ports: map[int]bool{}}
+		for _, port := range target.Ports {
+			rule.ports[port] = true
+		}
+		if strings.Contains(target.Host, "/") {
+			_, network, err := net.ParseCIDR(target.Host)
+			if err != nil {
+				return nil, err
+			}
+			rule.network = network
+		} else if target.Host == "" {
+			return nil, fmt.Errorf("connect target without host %+v", target)
+		} else {
+			rule.host = strings.ToLower(strings.TrimSuffix(target.Host, "."))
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (rule connectRule) matches(host string, ip net.IP, port int) bool {
+	if len(rule.ports) > 0 && !rule.ports[port] {
+		return false
+	}
+	if rule.network != nil {
+		return rule.network.Contains(ip)
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if strings.HasPrefix(rule.host, "*.") {
+		return strings.HasSuffix(host, rule.host[1:])
+	}
+	return host == rule.host
+}
+
+// restricted addresses reach the backend itself or its networks.
+func restricted(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsPrivate() || ip.IsUnspecified()
+}
+
+// connectAllowed tells if host resolved to ip may be connected, names
+// never allow a restricted address.
+func (bd *Backend) connectAllowed(host string, ip net.IP, port int) bool {
+	if len(bd.connectRules) == 0 {
+		return !restricted(ip)
+	}
+	for _, rule := range bd.connectRules {
+		if rule.matches(host, ip, port) && (rule.network != nil || !restricted(ip)) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialRelay connects the first resolved address of the target which is
+// allowed, the name is not resolved again by the dial.
+func (bd *Backend) dialRelay(req *utils.RelayRequest) (net.Conn, error) {
+	if !bd.Config.AllowConnect {
+		return nil, errConnectNotAllowed
+	}
+	if req.Network != "tcp" && req.Network != "udp" {
+		return nil, fmt.Errorf("unsupported network: %s", req.Network)
+	}
+	host, port, err := net.SplitHostPort(req.Address)
+	if err != nil {
+		return nil, err
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %s", req.Address)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), bd.Config.ConnectTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if bd.connectAllowed(host, addr.IP, portNumber) {
+			dialer := net.Dialer{}
+			return dialer.DialContext(ctx, req.Network, net.JoinHostPort(addr.IP.String(), port))
+		}
+	}
+	return nil, fmt.Errorf("CONNECT to %s is not allowed", req.Address)
+}
+
+// serveRelay connects a stream opened by a frontend for a CONNECT or
+// CONNECT-UDP to the target.
+func (bd *Backend) serveRelay(conn quic.Connection, str quic.Stream) {
+	atomic.AddInt64(&bd.activeStreams, 1)
+	defer atomic.AddInt64(&bd.activeStreams, -1)
+	stream := utils.RelayStream{Stream: str}
+	req := utils.RelayRequest{}
+	err := utils.ReadRelayHeader(str, &req)
+	if err != nil {
+		bd.log.Warn().Str("remote", conn.RemoteAddr().String()).Err(err).Msg("reading relay request failed")
+		stream.Close()
+		return
+	}
+	target, err := bd.dialRelay(&req)
+	res := utils.RelayResponse{}
+	log := bd.log.With("txn", req.Txn).With("upstream", req.Address)
+	if err != nil {
+		log.Warn().Str("network", req.Network).Err(err).Msg("relay refused")
+		res.Error = err.Error()
+	}
+	werr := utils.WriteRelayHeader(str, 0, res)
+	if err != nil || werr != nil {
+		if target != nil {
+			target.Close()
+		}
+		stream.Close()
+		return
+	}
+	log.Debug().Str("network", req.Network).Msg("relay")
+	if req.Network == "udp" {
+		utils.RelayDatagrams(utils.NewDatagramStream(conn, stream, str.StreamID()), utils.UDPDatagramConn{
+			Conn:        target.(*net.UDPConn),
+			IdleTimeout: bd.Config.UDPIdleTimeout,
+		})
+		return
+	}
+	utils.Relay(stream, target)
+}
@@ -0,0 +1,74 @@
+package backend
+
+import (
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/mabels/h123-reflector/utils"
+)
+
+func Test_RelayAllowlist(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	_, tcpPort, _ := net.SplitHostPort(tcp.Addr().String())
+	port, _ := strconv.Atoi(tcpPort)
+	dial := func(bd *Backend, network string, address string) error {
+		conn, err := bd.dialRelay(&utils.RelayRequest{Network: network, Address: address})
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	open, err := NewBackend(BackendConfig{BrokerUrl: "mqtt://127.0.0.1:1883/", AllowConnect: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range [][2]string{
+		{"tcp", tcp.Addr().String()},
+		{"udp", udp.LocalAddr().String()},
+		{"tcp", "localhost:" + tcpPort},
+		{"tcp", "169.254.169.254:80"},
+		{"udp", "[::1]:53"},
+	} {
+		if err := dial(open, target[0], target[1]); err == nil {
+			t.Errorf("Expected %s %s refused without allowlist", target[0], target[1])
+		}
+	}
+
+	bd, err := NewBackend(BackendConfig{
+		BrokerUrl:    "mqtt://127.0.0.1:1883/",
+		AllowConnect: true,
+		ConnectAllow: []ConnectTarget{{Host: "127.0.0.0/8", Ports: []int{port}}, {Host: "localhost"}, {Host: "*.example.com"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dial(bd, "tcp", tcp.Addr().String()); err != nil {
+		t.Errorf("Expected the allowed tcp target connected, got %v", err)
+	}
+	if err := dial(bd, "udp", "127.0.0.1:"+tcpPort); err != nil {
+		t.Errorf("Expected the allowed udp target connected, got %v", err)
+	}
+	if err := dial(bd, "udp", udp.LocalAddr().String()); err == nil {
+		t.Error("Expected a port outside the allowlist refused")
+	}
+	if err := dial(bd, "tcp", "localhost:1"); err == nil {
+		t.Error("Expected a name which resolves to loopback refused")
+	}
+	if bd.connectAllowed("www.example.com", net.ParseIP("192.0.2.1"), 443) != true || bd.connectAllowed("example.org", net.ParseIP("192.0.2.1"), 443) {
+		t.Error("Expected only the allowed names")
+	}
+	if _, err := NewBackend(BackendConfig{BrokerUrl: "mqtt://127.0.0.1:1883/", ConnectAllow: []ConnectTarget{{Host: "10.0.0.0/33"}}}); err == nil {
+		t.Error("Expected an error for a broken CIDR")
+	}
+}
@@ -0,0 +1,146 @@
+package backend
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/url"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/mabels/h123-reflector/models"
+	"github.com/mabels/h123-reflector/utils"
+)
+
+var errTunnelClosed = errors.New("tunnel closed")
+
+// tunnelListener hands a connection dialed to a frontend to the
+// http3.Server, which then serves requests from that frontend on it.
+type tunnelListener struct {
+	conn   quic.EarlyConnection
+	accept chan quic.EarlyConnection
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newTunnelListener(conn quic.EarlyConnection) *tunnelListener {
+	tl := &tunnelListener{
+		conn:   conn,
+		accept: make(chan quic.EarlyConnection, 1),
+		closed: make(chan struct{}),
+	}
+	tl.accept <- conn
+	return tl
+}
+
+func (tl *tunnelListener) Accept(ctx context.Context) (quic.EarlyConnection, error) {
+	select {
+	case conn := <-tl.accept:
+		return conn, nil
+	case <-tl.conn.Context().Done():
+		return nil, errTunnelClosed
+	case <-tl.closed:
+		return nil, quic.ErrServerClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (tl *tunnelListener) Close() error {
+	tl.once.Do(func() { close(tl.closed) })
+	return tl.conn.CloseWithError(0, "closed")
+}
+
+func (tl *tunnelListener) Addr() net.Addr {
+	return tl.conn.LocalAddr()
+}
+
+type tunnel struct {
+	url      string
+	listener *tunnelListener
+	dialing  bool
+}
+
+func (bd *Backend) tunnelTLSConfig() *tls.Config {
+	tlsConf := &tls.Config{}
+	if bd.Config.TunnelTLSConfig != nil {
+		tlsConf = bd.Config.TunnelTLSConfig.Clone()
+	}
+	tlsConf.NextProtos = []string{utils.TunnelNextProto}
+	return bd.debug.TLSConfig(tlsConf)
+}
+
+func (bd *Backend) dialTunnel(t *tunnel) {
+	var conn quic.EarlyConnection
+	u, err := url.Parse(t.url)
+	if err == nil {
+		conn, err = quic.DialAddrEarly(u.Host, bd.tunnelTLSConfig(), bd.quic["tunnel"])
+	}
+	bd.tunnelMutex.Lock()
+	t.dialing = false
+	if err != nil {
+		bd.tunnelMutex.Unlock()
+		bd.log.Error().Str("tunnel", t.url).Err(err).Msg("connecting tunnel failed")
+		return
+	}
+	listener := newTunnelListener(conn)
+	t.listener = listener
+	bd.tunnelMutex.Unlock()
+	bd.log.Info().Str("tunnel", t.url).Msg("tunnel connected")
+	go func() {
+		bd.Srv.ServeListener(listener)
+		bd.tunnelMutex.Lock()
+		if t.listener == listener {
+			t.listener = nil
+		}
+		bd.tunnelMutex.Unlock()
+		bd.log.Info().Str("tunnel", t.url).Msg("tunnel closed")
+	}()
+}
+
+// UpdateTunnel dials announced frontends which have no tunnel yet and
+// closes tunnels of frontends going offline.
+func (bd *Backend) UpdateTunnel(state *models.TunnelStatus) {
+	bd.tunnelMutex.Lock()
+	defer bd.tunnelMutex.Unlock()
+	if bd.Mqtt.ToStop {
+		return
+	}
+	t, found := bd.tunnels[state.TunnelEndPointUrl]
+	if state.Status != "online" {
+		if found {
+			if t.listener != nil {
+				t.listener.Close()
+			}
+			delete(bd.tunnels, state.TunnelEndPointUrl)
+		}
+		return
+	}
+	if !found {
+		t = &tunnel{url: state.TunnelEndPointUrl}
+		bd.tunnels[state.TunnelEndPointUrl] = t
+	}
+	if t.listener == nil && !t.dialing {
+		t.dialing = true
+		go bd.dialTunnel(t)
+	}
+}
+
+func (bd *Backend) receiveTunnelTopic() func(client mqtt.Client, msg mqtt.Message) {
+	return func(client mqtt.Client, msg mqtt.Message) {
+		state := models.TunnelStatus{}
+		err := json.Unmarshal(msg.Payload(), &state)
+		if err != nil {
+			bd.log.Warn().Str("topic", msg.Topic()).Err(err).Msg("invalid tunnel status")
+			return
+		}
+		bd.UpdateTunnel(&state)
+	}
+}
+
+func (bd *Backend) StartTunnels() error {
+	return bd.Mqtt.Subscribe(*bd.Config.TunnelTopic, bd.receiveTunnelTopic())
+}
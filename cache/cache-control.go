@@ -0,0 +1,59 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// directives of a Cache-Control header, the names are lower case.
+type directives map[string]string
+
+func parseCacheControl(header http.Header) directives {
+	d := directives{}
+	for _, value := range header.Values("Cache-Control") {
+		for _, part := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if name == "" {
+				continue
+			}
+			d[strings.ToLower(name)] = strings.Trim(arg, `"`)
+		}
+	}
+	return d
+}
+
+// Private tells if a response belongs to the client which asked for it,
+// it sets a cookie or is private or no-store.
+func Private(header http.Header) bool {
+	cc := parseCacheControl(header)
+	return cc.has("private") || cc.has("no-store") || header.Get("Set-Cookie") != ""
+}
+
+func (d directives) has(name string) bool {
+	_, found := d[name]
+	return found
+}
+
+// seconds of a directive, found is false if it is missing or invalid.
+func (d directives) seconds(name string) (time.Duration, bool) {
+	arg, found := d[name]
+	if !found {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+func headerTime(header http.Header, name string) (time.Time, bool) {
+	value := header.Get(name)
+	if value == "" {
+		return time.Time{}, false
+	}
+	t, err := http.ParseTime(value)
+	return t, err == nil
+}
@@ -0,0 +1,524 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	Enabled bool
+	// Dir keeps the entries on disk, in memory if empty
+	Dir            string
+	MaxBytes       int64  // of the store, default 64MiB
+	MaxObjectBytes int64  // larger responses are not stored, default 1MiB
+	Name           string // in the Cache-Status header, default h123
+}
+
+func (cfg *Config) setDefaults() {
+	if cfg.MaxBytes == 0 {
+		cfg.MaxBytes = 64 * 1024 * 1024
+	}
+	if cfg.MaxObjectBytes == 0 {
+		cfg.MaxObjectBytes = 1024 * 1024
+	}
+	if cfg.Name == "" {
+		cfg.Name = "h123"
+	}
+}
+
+// FetchFunc forwards a request, for the cache it is the upstream.
+type FetchFunc func(w http.ResponseWriter, r *http.Request)
+
+// Cache is a shared HTTP cache after RFC 9111, a nil Cache forwards all.
+type Cache struct {
+	cfg          Config
+	store        Store
+	mutex        sync.Mutex
+	revalidating map[string]bool
+	now          func() time.Time
+}
+
+func New(config *Config) (*Cache, error) {
+	if config == nil || !config.Enabled {
+		return nil, nil
+	}
+	cfg := *config
+	cfg.setDefaults()
+	var store Store = NewMemoryStore(cfg.MaxBytes)
+	if cfg.Dir != "" {
+		var err error
+		store, err = NewDiskStore(cfg.Dir, cfg.MaxBytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Cache{cfg: cfg, store: store, revalidating: map[string]bool{}, now: time.Now}, nil
+}
+
+func (c *Cache) Size() int64 {
+	if c == nil {
+		return 0
+	}
+	return c.store.Size()
+}
+
+// defaultCacheable may be stored with a heuristic freshness.
+var defaultCacheable = map[int]bool{200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true}
+
+var understood = map[int]bool{302: true, 307: true}
+
+// not stored, they belong to the connection or this hop
+var hopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding",
+	"Upgrade", "Trailer", "Server-Timing", "Cache-Status", "Age"}
+
+func (c *Cache) storable(r *http.Request, status int, header http.Header) bool {
+	if r.Method != http.MethodGet || !(defaultCacheable[status] || understood[status]) {
+		return false
+	}
+	cc := parseCacheControl(header)
+	if cc.has("no-store") || cc.has("private") || parseCacheControl(r.Header).has("no-store") {
+		return false
+	}
+	if r.Header.Get("Authorization") != "" && !(cc.has("public") || cc.has("s-maxage") || cc.has("must-revalidate")) {
+		return false
+	}
+	if header.Get("Vary") == "*" || header.Get("Set-Cookie") != "" {
+		return false
+	}
+	_, expires := headerTime(header, "Expires")
+	explicit := cc.has("max-age") || cc.has("s-maxage") || cc.has("public") || expires
+	validator := header.Get("ETag") != "" || header.Get("Last-Modified") != ""
+	return explicit || (defaultCacheable[status] && validator)
+}
+
+func (c *Cache) freshness(e *Entry) time.Duration {
+	cc := parseCacheControl(e.Header)
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+	date, ok := headerTime(e.Header, "Date")
+	if !ok {
+		date = e.ResponseTime
+	}
+	if expires, ok := headerTime(e.Header, "Expires"); ok {
+		return expires.Sub(date)
+	}
+	if e.Header.Get("Expires") != "" {
+		// invalid means expired
+		return 0
+	}
+	if lastModified, ok := headerTime(e.Header, "Last-Modified"); ok && defaultCacheable[e.Status] {
+		heuristic := date.Sub(lastModified) / 10
+		if heuristic > 24*time.Hour {
+			heuristic = 24 * time.Hour
+		}
+		if heuristic > 0 {
+			return heuristic
+		}
+	}
+	return 0
+}
+
+func (c *Cache) age(e *Entry, now time.Time) time.Duration {
+	date, ok := headerTime(e.Header, "Date")
+	if !ok {
+		date = e.ResponseTime
+	}
+	apparent := e.ResponseTime.Sub(date)
+	if apparent < 0 {
+		apparent = 0
+	}
+	ageValue := time.Duration(0)
+	if n, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil && n > 0 {
+		ageValue = time.Duration(n) * time.Second
+	}
+	corrected := ageValue + e.ResponseTime.Sub(e.RequestTime)
+	if apparent > corrected {
+		corrected = apparent
+	}
+	return corrected + now.Sub(e.ResponseTime)
+}
+
+func varyValues(vary string, r *http.Request) map[string]string {
+	values := map[string]string{}
+	for _, name := range strings.Split(vary, ",") {
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if name != "" {
+			values[name] = strings.Join(r.Header.Values(name), ",")
+		}
+	}
+	return values
+}
+
+func (e *Entry) varyMatches(r *http.Request) bool {
+	for name, value := range e.Vary {
+		if strings.Join(r.Header.Values(name), ",") != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Cache) cacheStatus(params ...string) string {
+	return strings.Join(append([]string{c.cfg.Name}, params...), "; ")
+}
+
+// Serve answers r from the cache or with fetch, key names the resource.
+func (c *Cache) Serve(w http.ResponseWriter, r *http.Request, key string, fetch FetchFunc) {
+	if c == nil {
+		fetch(w, r)
+		return
+	}
+	reqCC := parseCacheControl(r.Header)
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodOptions, http.MethodTrace, http.MethodConnect:
+		c.forward(w, r, key, fetch, "fwd=method")
+		return
+	default:
+		// unsafe methods invalidate the stored response
+		rec := c.forward(w, r, key, fetch, "fwd=method")
+		if rec.status < 400 {
+			c.store.Delete(key)
+		}
+		return
+	}
+	if reqCC.has("no-store") {
+		c.forward(w, r, key, fetch, "fwd=request")
+		return
+	}
+	e, found := c.store.Get(key)
+	miss := "fwd=uri-miss"
+	if found && !e.varyMatches(r) {
+		found = false
+		miss = "fwd=vary-miss"
+	}
+	if !found {
+		if reqCC.has("only-if-cached") {
+			w.Header().Set("Cache-Status", c.cacheStatus(miss))
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		c.forward(w, r, key, fetch, miss)
+		return
+	}
+	now := c.now()
+	age := c.age(e, now)
+	ttl := c.freshness(e) - age
+	respCC := parseCacheControl(e.Header)
+	revalidate := reqCC.has("no-cache") || respCC.has("no-cache")
+	if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+		revalidate = true
+	}
+	if minFresh, ok := reqCC.seconds("min-fresh"); ok && ttl < minFresh {
+		revalidate = true
+	}
+	if !revalidate && ttl > 0 {
+		c.serveEntry(w, r, e, age, c.cacheStatus("hit", fmt.Sprintf("ttl=%d", int(ttl.Seconds()))))
+		return
+	}
+	mustRevalidate := respCC.has("must-revalidate") || respCC.has("proxy-revalidate") || respCC.has("s-maxage")
+	if !revalidate && !mustRevalidate {
+		if maxStale, found := reqCC["max-stale"]; found {
+			limit, ok := reqCC.seconds("max-stale")
+			if maxStale == "" || (ok && -ttl <= limit) {
+				c.serveEntry(w, r, e, age, c.cacheStatus("hit", fmt.Sprintf("ttl=%d", int(ttl.Seconds())), "detail=max-stale"))
+				return
+			}
+		}
+		if swr, ok := respCC.seconds("stale-while-revalidate"); ok && -ttl <= swr {
+			c.serveEntry(w, r, e, age, c.cacheStatus("hit", fmt.Sprintf("ttl=%d", int(ttl.Seconds())), "detail=stale-while-revalidate"))
+			c.revalidateInBackground(r, key, e, fetch)
+			return
+		}
+	}
+	if reqCC.has("only-if-cached") {
+		w.Header().Set("Cache-Status", c.cacheStatus("fwd=stale"))
+		w.WriteHeader(http.StatusGatewayTimeout)
+		return
+	}
+	if r.Method == http.MethodHead {
+		c.forward(w, r, key, fetch, "fwd=stale")
+		return
+	}
+	c.revalidate(w, r, key, e, fetch, !mustRevalidate, -ttl)
+}
+
+// forward fetches and stores the response if it may.
+func (c *Cache) forward(w http.ResponseWriter, r *http.Request, key string, fetch FetchFunc, status string) *recorder {
+	rec := c.newRecorder(w, r, status)
+	fetch(rec, r)
+	rec.finish()
+	c.storeResponse(key, r, rec)
+	return rec
+}
+
+func conditionalRequest(ctx context.Context, r *http.Request, e *Entry) *http.Request {
+	cond := r.Clone(ctx)
+	for _, h := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range"} {
+		cond.Header.Del(h)
+	}
+	if etag := e.Header.Get("ETag"); etag != "" {
+		cond.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := e.Header.Get("Last-Modified"); lastModified != "" {
+		cond.Header.Set("If-Modified-Since", lastModified)
+	}
+	return cond
+}
+
+func (c *Cache) revalidate(w http.ResponseWriter, r *http.Request, key string, e *Entry, fetch FetchFunc, staleAllowed bool, stale time.Duration) {
+	staleIfError := time.Duration(-1)
+	if staleAllowed {
+		for _, cc := range []directives{parseCacheControl(e.Header), parseCacheControl(r.Header)} {
+			if d, ok := cc.seconds("stale-if-error"); ok && d > staleIfError {
+				staleIfError = d
+			}
+		}
+	}
+	rec := c.newRecorder(w, r, "fwd=stale")
+	rec.hold = func(status int) bool {
+		return status == http.StatusNotModified || (status >= 500 && stale <= staleIfError)
+	}
+	fetch(rec, conditionalRequest(r.Context(), r, e))
+	rec.finish()
+	switch {
+	case rec.status == http.StatusNotModified:
+		updated := c.updateEntry(key, e, rec)
+		c.serveEntry(w, r, updated, c.age(updated, c.now()), c.cacheStatus("fwd=stale", "fwd-status=304"))
+	case rec.held:
+		c.serveEntry(w, r, e, c.age(e, c.now()), c.cacheStatus("fwd=stale", fmt.Sprintf("fwd-status=%d", rec.status), "detail=stale-if-error"))
+	default:
+		c.storeResponse(key, r, rec)
+	}
+}
+
+func (c *Cache) revalidateInBackground(r *http.Request, key string, e *Entry, fetch FetchFunc) {
+	c.mutex.Lock()
+	if c.revalidating[key] {
+		c.mutex.Unlock()
+		return
+	}
+	c.revalidating[key] = true
+	c.mutex.Unlock()
+	cond := conditionalRequest(context.Background(), r, e)
+	go func() {
+		defer func() {
+			c.mutex.Lock()
+			delete(c.revalidating, key)
+			c.mutex.Unlock()
+		}()
+		rec := c.newRecorder(nil, cond, "")
+		fetch(rec, cond)
+		rec.finish()
+		if rec.status == http.StatusNotModified {
+			c.updateEntry(key, e, rec)
+			return
+		}
+		c.storeResponse(key, cond, rec)
+	}()
+}
+
+// updateEntry takes the headers of a 304 into the stored response.
+func (c *Cache) updateEntry(key string, e *Entry, rec *recorder) *Entry {
+	updated := *e
+	updated.Header = e.Header.Clone()
+	for k, vs := range rec.header {
+		switch k {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding":
+			continue
+		}
+		updated.Header[k] = vs
+	}
+	for _, h := range hopHeaders {
+		updated.Header.Del(h)
+	}
+	updated.RequestTime = rec.requestTime
+	updated.ResponseTime = rec.responseTime
+	c.store.Set(key, &updated)
+	return &updated
+}
+
+func (c *Cache) storeResponse(key string, r *http.Request, rec *recorder) {
+	if !rec.storable || rec.overflow || rec.aborted {
+		return
+	}
+	header := rec.header.Clone()
+	for _, h := range hopHeaders {
+		header.Del(h)
+	}
+	c.store.Set(key, &Entry{
+		Key:          key,
+		Status:       rec.status,
+		Header:       header,
+		Body:         rec.body.Bytes(),
+		RequestTime:  rec.requestTime,
+		ResponseTime: rec.responseTime,
+		Vary:         varyValues(header.Get("Vary"), r),
+	})
+}
+
+func etagMatches(list string, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	weak := strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == weak {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified evaluates the conditional headers of the client.
+func notModified(r *http.Request, e *Entry) bool {
+	if e.Status != http.StatusOK {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagMatches(inm, e.Header.Get("ETag"))
+	}
+	since, ok := headerTime(r.Header, "If-Modified-Since")
+	lastModified, lok := headerTime(e.Header, "Last-Modified")
+	return ok && lok && !lastModified.After(since)
+}
+
+func (c *Cache) serveEntry(w http.ResponseWriter, r *http.Request, e *Entry, age time.Duration, status string) {
+	for k, vs := range e.Header {
+		w.Header()[k] = vs
+	}
+	w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+	w.Header().Set("Cache-Status", status)
+	if notModified(r, e) {
+		w.Header().Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(e.Body)))
+	w.WriteHeader(e.Status)
+	if r.Method != http.MethodHead {
+		w.Write(e.Body)
+	}
+}
+
+// recorder passes the fetched response to the client and keeps it for the
+// store, hold keeps a response from the client.
+type recorder struct {
+	c            *Cache
+	w            http.ResponseWriter // nil without client
+	r            *http.Request
+	cacheStatus  string
+	hold         func(status int) bool
+	header       http.Header
+	status       int
+	held         bool
+	storable     bool
+	body         bytes.Buffer
+	overflow     bool
+	aborted      bool
+	requestTime  time.Time
+	responseTime time.Time
+}
+
+func (c *Cache) newRecorder(w http.ResponseWriter, r *http.Request, cacheStatus string) *recorder {
+	return &recorder{c: c, w: w, r: r, cacheStatus: cacheStatus, header: http.Header{}, requestTime: c.now()}
+}
+
+func (rec *recorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	if rec.status != 0 {
+		return
+	}
+	rec.status = status
+	rec.responseTime = rec.c.now()
+	rec.storable = rec.c.storable(rec.r, status, rec.header)
+	if cl, err := strconv.ParseInt(rec.header.Get("Content-Length"), 10, 64); err == nil && cl > rec.c.cfg.MaxObjectBytes {
+		rec.storable = false
+	}
+	rec.held = rec.hold != nil && rec.hold(status)
+	if rec.held || rec.w == nil {
+		return
+	}
+	for k, vs := range rec.header {
+		rec.w.Header()[k] = vs
+	}
+	if rec.cacheStatus != "" {
+		params := []string{rec.cacheStatus}
+		if rec.status != http.StatusNotModified && rec.cacheStatus == "fwd=stale" {
+			params = append(params, fmt.Sprintf("fwd-status=%d", status))
+		}
+		if rec.storable {
+			params = append(params, "stored")
+		}
+		rec.w.Header().Set("Cache-Status", rec.c.cacheStatus(params...))
+	}
+	rec.w.WriteHeader(status)
+}
+
+func (rec *recorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if rec.storable && !rec.overflow {
+		if int64(rec.body.Len()+len(p)) > rec.c.cfg.MaxObjectBytes {
+			rec.overflow = true
+			rec.body = bytes.Buffer{}
+		} else {
+			rec.body.Write(p)
+		}
+	}
+	if rec.held || rec.w == nil {
+		return len(p), nil
+	}
+	n, err := rec.w.Write(p)
+	if err != nil {
+		rec.aborted = true
+	}
+	return n, err
+}
+
+func (rec *recorder) Flush() {
+	if rec.held || rec.w == nil {
+		return
+	}
+	if f, ok := rec.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Abort marks the response as incomplete, it is not stored.
+func (rec *recorder) Abort() {
+	rec.aborted = true
+}
+
+func (rec *recorder) finish() {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if cl, err := strconv.ParseInt(rec.header.Get("Content-Length"), 10, 64); err == nil && !rec.overflow && int64(rec.body.Len()) != cl {
+		rec.aborted = true
+	}
+}
+
+// Abort tells the cache the response written to w broke off, fetches
+// call it when the upstream fails after the status is sent.
+func Abort(w http.ResponseWriter) {
+	if a, ok := w.(interface{ Abort() }); ok {
+		a.Abort()
+	}
+}
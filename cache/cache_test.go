@@ -0,0 +1,227 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type upstream struct {
+	calls   int32
+	status  int
+	header  http.Header
+	body    string
+	lastReq *http.Request
+}
+
+func (u *upstream) fetch(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&u.calls, 1)
+	u.lastReq = r
+	for k, vs := range u.header {
+		w.Header()[k] = vs
+	}
+	if r.Header.Get("If-None-Match") != "" && r.Header.Get("If-None-Match") == u.header.Get("ETag") {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(u.status)
+	w.Write([]byte(u.body))
+}
+
+func testCache(t *testing.T, cfg *Config) (*Cache, *time.Time) {
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+	return c, &now
+}
+
+func get(c *Cache, u *upstream, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/res", nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	c.Serve(w, req, "https://up/res", u.fetch)
+	return w
+}
+
+func Test_CacheFreshness(t *testing.T) {
+	c, now := testCache(t, &Config{Enabled: true})
+	u := &upstream{status: 200, body: "hello", header: http.Header{"Cache-Control": {"max-age=60"}}}
+	w := get(c, u)
+	if w.Body.String() != "hello" || w.Header().Get("Cache-Status") != "h123; fwd=uri-miss; stored" {
+		t.Errorf("Expected a stored miss, got %q %q", w.Body.String(), w.Header().Get("Cache-Status"))
+	}
+	*now = now.Add(20 * time.Second)
+	w = get(c, u)
+	if w.Body.String() != "hello" || w.Header().Get("Cache-Status") != "h123; hit; ttl=40" || w.Header().Get("Age") != "20" {
+		t.Errorf("Expected a hit, got %q %q age %s", w.Body.String(), w.Header().Get("Cache-Status"), w.Header().Get("Age"))
+	}
+	if u.calls != 1 {
+		t.Errorf("Expected one upstream call, got %d", u.calls)
+	}
+	w = get(c, u, "Cache-Control", "no-store")
+	if u.calls != 2 || w.Header().Get("Cache-Status") != "h123; fwd=request" {
+		t.Errorf("Expected no-store to bypass, got %q", w.Header().Get("Cache-Status"))
+	}
+
+	c, _ = testCache(t, &Config{Enabled: true})
+	priv := &upstream{status: 200, body: "mine", header: http.Header{"Cache-Control": {"private, max-age=60"}}}
+	get(c, priv)
+	get(c, priv)
+	if priv.calls != 2 {
+		t.Errorf("Expected private responses not to be stored, got %d calls", priv.calls)
+	}
+}
+
+func Test_CacheRevalidation(t *testing.T) {
+	c, now := testCache(t, &Config{Enabled: true})
+	u := &upstream{status: 200, body: "v1", header: http.Header{"Cache-Control": {"max-age=10"}, "Etag": {`"v1"`}}}
+	get(c, u)
+	*now = now.Add(30 * time.Second)
+	w := get(c, u)
+	if u.lastReq.Header.Get("If-None-Match") != `"v1"` {
+		t.Errorf("Expected a conditional request, got %v", u.lastReq.Header)
+	}
+	if w.Code != 200 || w.Body.String() != "v1" || w.Header().Get("Cache-Status") != "h123; fwd=stale; fwd-status=304" {
+		t.Errorf("Expected the revalidated entry, got %d %q %q", w.Code, w.Body.String(), w.Header().Get("Cache-Status"))
+	}
+	w = get(c, u)
+	if u.calls != 2 || !strings.HasPrefix(w.Header().Get("Cache-Status"), "h123; hit") {
+		t.Errorf("Expected fresh after the 304, got %d calls %q", u.calls, w.Header().Get("Cache-Status"))
+	}
+	w = get(c, u, "If-None-Match", `"v1"`)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("Expected the cache to answer the client condition, got %d", w.Code)
+	}
+}
+
+func Test_CacheVary(t *testing.T) {
+	c, _ := testCache(t, &Config{Enabled: true})
+	u := &upstream{status: 200, body: "gz", header: http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Encoding"}}}
+	get(c, u, "Accept-Encoding", "gzip")
+	w := get(c, u, "Accept-Encoding", "br")
+	if w.Header().Get("Cache-Status") != "h123; fwd=vary-miss; stored" {
+		t.Errorf("Expected a vary miss, got %q", w.Header().Get("Cache-Status"))
+	}
+	w = get(c, u, "Accept-Encoding", "br")
+	if !strings.HasPrefix(w.Header().Get("Cache-Status"), "h123; hit") || u.calls != 2 {
+		t.Errorf("Expected a hit for the same variant, got %q", w.Header().Get("Cache-Status"))
+	}
+
+	star := &upstream{status: 200, body: "x", header: http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}}}
+	req := httptest.NewRequest("GET", "/star", nil)
+	c.Serve(httptest.NewRecorder(), req, "https://up/star", star.fetch)
+	c.Serve(httptest.NewRecorder(), req, "https://up/star", star.fetch)
+	if star.calls != 2 {
+		t.Error("Expected Vary: * not to be stored")
+	}
+}
+
+func Test_CacheStale(t *testing.T) {
+	c, now := testCache(t, &Config{Enabled: true})
+	u := &upstream{status: 200, body: "old", header: http.Header{"Cache-Control": {"max-age=10, stale-if-error=60"}}}
+	get(c, u)
+	*now = now.Add(20 * time.Second)
+	u.status = 503
+	u.body = "down"
+	w := get(c, u)
+	if w.Code != 200 || w.Body.String() != "old" || w.Header().Get("Cache-Status") != "h123; fwd=stale; fwd-status=503; detail=stale-if-error" {
+		t.Errorf("Expected the stale entry on error, got %d %q %q", w.Code, w.Body.String(), w.Header().Get("Cache-Status"))
+	}
+	*now = now.Add(time.Minute)
+	w = get(c, u)
+	if w.Code != 503 {
+		t.Errorf("Expected the error after stale-if-error, got %d", w.Code)
+	}
+
+	c, now = testCache(t, &Config{Enabled: true})
+	u = &upstream{status: 200, body: "old", header: http.Header{"Cache-Control": {"max-age=10, stale-while-revalidate=30"}}}
+	get(c, u)
+	*now = now.Add(20 * time.Second)
+	u.body = "new"
+	w = get(c, u)
+	if w.Body.String() != "old" || w.Header().Get("Cache-Status") != "h123; hit; ttl=-10; detail=stale-while-revalidate" {
+		t.Errorf("Expected the stale entry, got %q %q", w.Body.String(), w.Header().Get("Cache-Status"))
+	}
+	for i := 0; i < 100 && get(c, u).Body.String() != "new"; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if w := get(c, u); w.Body.String() != "new" {
+		t.Errorf("Expected the background revalidation to store the new response, got %q", w.Body.String())
+	}
+}
+
+func Test_CacheInvalidation(t *testing.T) {
+	c, _ := testCache(t, &Config{Enabled: true})
+	u := &upstream{status: 200, body: "v1", header: http.Header{"Cache-Control": {"max-age=60"}}}
+	get(c, u)
+	req := httptest.NewRequest("POST", "/res", strings.NewReader("v2"))
+	w := httptest.NewRecorder()
+	c.Serve(w, req, "https://up/res", u.fetch)
+	if w.Header().Get("Cache-Status") != "h123; fwd=method" {
+		t.Errorf("Expected the method to forward, got %q", w.Header().Get("Cache-Status"))
+	}
+	get(c, u)
+	if u.calls != 3 {
+		t.Errorf("Expected the POST to invalidate, got %d calls", u.calls)
+	}
+}
+
+func Test_DiskStore(t *testing.T) {
+	dir := t.TempDir()
+	ds, err := NewDiskStore(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &Entry{Key: "https://up/a", Status: 200, Header: http.Header{"Etag": {`"a"`}}, Body: []byte("body a"), Vary: map[string]string{}}
+	if err := ds.Set(e.Key, e); err != nil {
+		t.Fatal(err)
+	}
+	ds.Set("https://up/big", &Entry{Key: "https://up/big", Body: make([]byte, 1000)})
+	if _, found := ds.Get("https://up/a"); found {
+		t.Error("Expected the oldest entry to be dropped over the limit")
+	}
+	ds.Set(e.Key, e)
+
+	reopened, err := NewDiskStore(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, found := reopened.Get(e.Key)
+	if !found || string(got.Body) != "body a" || got.Header.Get("Etag") != `"a"` {
+		t.Errorf("Expected the entry after reopen, got %v", got)
+	}
+	if reopened.Size() != ds.Size() {
+		t.Errorf("Expected the size %d after reopen, got %d", ds.Size(), reopened.Size())
+	}
+}
+
+func Test_CacheIncompleteBody(t *testing.T) {
+	c, _ := testCache(t, &Config{Enabled: true})
+	short := &upstream{status: 200, body: "hel", header: http.Header{"Cache-Control": {"max-age=60"}, "Content-Length": {"5"}}}
+	get(c, short)
+	get(c, short)
+	if short.calls != 2 {
+		t.Errorf("Expected a body shorter than Content-Length not to be stored, got %d calls", short.calls)
+	}
+	calls := 0
+	aborted := func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("hel"))
+		Abort(w)
+	}
+	for i := 0; i < 2; i++ {
+		c.Serve(httptest.NewRecorder(), httptest.NewRequest("GET", "/chunked", nil), "https://up/chunked", aborted)
+	}
+	if calls != 2 {
+		t.Errorf("Expected an aborted response not to be stored, got %d calls", calls)
+	}
+}
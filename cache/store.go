@@ -0,0 +1,239 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Entry is a stored response.
+type Entry struct {
+	Key          string
+	Status       int
+	Header       http.Header
+	Body         []byte
+	RequestTime  time.Time
+	ResponseTime time.Time
+	// Vary are the request header values selected by the Vary header
+	Vary map[string]string
+}
+
+func (e *Entry) size() int64 {
+	size := int64(len(e.Key) + len(e.Body))
+	for k, vs := range e.Header {
+		for _, v := range vs {
+			size += int64(len(k) + len(v))
+		}
+	}
+	return size
+}
+
+type Store interface {
+	Get(key string) (*Entry, bool)
+	Set(key string, e *Entry) error
+	Delete(key string)
+	Size() int64
+}
+
+type lruItem struct {
+	key   string
+	size  int64
+	entry *Entry // nil on disk
+}
+
+// lru keeps the keys in use order and drops the oldest over maxBytes.
+type lru struct {
+	maxBytes int64
+	size     int64
+	order    *list.List
+	items    map[string]*list.Element
+	dropped  func(key string)
+}
+
+func newLRU(maxBytes int64, dropped func(string)) *lru {
+	return &lru{maxBytes: maxBytes, order: list.New(), items: map[string]*list.Element{}, dropped: dropped}
+}
+
+func (l *lru) get(key string) (*lruItem, bool) {
+	el, found := l.items[key]
+	if !found {
+		return nil, false
+	}
+	l.order.MoveToFront(el)
+	return el.Value.(*lruItem), true
+}
+
+func (l *lru) set(item *lruItem) {
+	l.remove(item.key)
+	l.items[item.key] = l.order.PushFront(item)
+	l.size += item.size
+	for l.size > l.maxBytes && l.order.Len() > 1 {
+		oldest := l.order.Back().Value.(*lruItem)
+		l.remove(oldest.key)
+		l.dropped(oldest.key)
+	}
+}
+
+func (l *lru) remove(key string) bool {
+	el, found := l.items[key]
+	if !found {
+		return false
+	}
+	l.order.Remove(el)
+	delete(l.items, key)
+	l.size -= el.Value.(*lruItem).size
+	return true
+}
+
+type MemoryStore struct {
+	mutex sync.Mutex
+	lru   *lru
+}
+
+func NewMemoryStore(maxBytes int64) *MemoryStore {
+	return &MemoryStore{lru: newLRU(maxBytes, func(string) {})}
+}
+
+func (ms *MemoryStore) Get(key string) (*Entry, bool) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	item, found := ms.lru.get(key)
+	if !found {
+		return nil, false
+	}
+	return item.entry, true
+}
+
+func (ms *MemoryStore) Set(key string, e *Entry) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.lru.set(&lruItem{key: key, size: e.size(), entry: e})
+	return nil
+}
+
+func (ms *MemoryStore) Delete(key string) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.lru.remove(key)
+}
+
+func (ms *MemoryStore) Size() int64 {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	return ms.lru.size
+}
+
+// DiskStore keeps every entry in a file of dir, the index is rebuilt
+// from the files on start.
+type DiskStore struct {
+	dir   string
+	mutex sync.Mutex
+	lru   *lru
+}
+
+func NewDiskStore(dir string, maxBytes int64) (*DiskStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	ds := &DiskStore{dir: dir}
+	ds.lru = newLRU(maxBytes, func(key string) { os.Remove(ds.file(key)) })
+	files, err := filepath.Glob(filepath.Join(dir, "*.entry"))
+	if err != nil {
+		return nil, err
+	}
+	type found struct {
+		key     string
+		size    int64
+		modTime time.Time
+	}
+	entries := []found{}
+	for _, file := range files {
+		e, err := readEntry(file)
+		info, serr := os.Stat(file)
+		if err != nil || serr != nil {
+			os.Remove(file)
+			continue
+		}
+		entries = append(entries, found{key: e.Key, size: e.size(), modTime: info.ModTime()})
+	}
+	// the most recent ones are kept
+	sort.Slice(entries, func(i, j int) bool { return entries[i].modTime.Before(entries[j].modTime) })
+	for _, e := range entries {
+		ds.lru.set(&lruItem{key: e.key, size: e.size})
+	}
+	return ds, nil
+}
+
+func (ds *DiskStore) file(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(ds.dir, hex.EncodeToString(sum[:])+".entry")
+}
+
+func readEntry(file string) (*Entry, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	e := &Entry{}
+	err = gob.NewDecoder(f).Decode(e)
+	return e, err
+}
+
+func (ds *DiskStore) Get(key string) (*Entry, bool) {
+	ds.mutex.Lock()
+	_, found := ds.lru.get(key)
+	ds.mutex.Unlock()
+	if !found {
+		return nil, false
+	}
+	e, err := readEntry(ds.file(key))
+	if err != nil || e.Key != key {
+		ds.Delete(key)
+		return nil, false
+	}
+	return e, true
+}
+
+func (ds *DiskStore) Set(key string, e *Entry) error {
+	file := ds.file(key)
+	tmp, err := os.CreateTemp(ds.dir, "tmp-*")
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(tmp).Encode(e)
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	ds.lru.set(&lruItem{key: key, size: e.size()})
+	return nil
+}
+
+func (ds *DiskStore) Delete(key string) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	if ds.lru.remove(key) {
+		os.Remove(ds.file(key))
+	}
+}
+
+func (ds *DiskStore) Size() int64 {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	return ds.lru.size
+}
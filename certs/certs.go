@@ -0,0 +1,283 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mabels/h123-reflector/utils"
+)
+
+type Config struct {
+	CertFile string
+	KeyFile  string
+	// Dir holds more pairs as <name>.crt, <name>.cert or <name>.pem with
+	// <name>.key, they are chosen by SNI
+	Dir            string
+	ReloadInterval time.Duration // default 10s
+	DevCA          *DevCAConfig  // creates CertFile and KeyFile if they are missing
+	// SessionTicketKeyFile keeps session tickets valid across restarts, so
+	// clients resume and send 0-RTT, it is created if missing. The keys are
+	// derived from it and rotate every SessionTicketPeriod, default 24h
+	SessionTicketKeyFile string
+	SessionTicketPeriod  time.Duration
+}
+
+// Info describes a loaded certificate.
+type Info struct {
+	File     string    `json:"file"`
+	Names    []string  `json:"names"`
+	NotAfter time.Time `json:"notAfter"`
+}
+
+type certSet struct {
+	byName   map[string]*tls.Certificate
+	fallback *tls.Certificate
+	infos    []Info
+}
+
+// Manager serves the certificates of the configured files and reloads
+// them when they change, open connections keep their certificate.
+type Manager struct {
+	cfg      Config
+	log      *utils.Logger
+	set      atomic.Value // *certSet
+	mutex    sync.Mutex
+	stamp    string        // of the loaded files
+	secret   *[32]byte     // of SessionTicketKeyFile
+	period   int64         // of tickets
+	tickets  [][32]byte    // current and previous period
+	configs  []*tls.Config // which get the rotated tickets
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func New(cfg Config, log *utils.Logger) (*Manager, error) {
+	if cfg.ReloadInterval == 0 {
+		cfg.ReloadInterval = 10 * time.Second
+	}
+	if cfg.SessionTicketPeriod == 0 {
+		cfg.SessionTicketPeriod = 24 * time.Hour
+	}
+	if log == nil {
+		log = utils.NewLogger()
+	}
+	log = log.Component("certs")
+	if _, err := os.Stat(cfg.CertFile); cfg.DevCA != nil && (cfg.CertFile == "" || err != nil) {
+		cfg.CertFile, cfg.KeyFile, err = EnsureDevCA(*cfg.DevCA, log)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.CertFile == "" && cfg.Dir == "" {
+		return nil, fmt.Errorf("no certificate configured")
+	}
+	m := &Manager{cfg: cfg, log: log, stop: make(chan struct{})}
+	if cfg.SessionTicketKeyFile != "" {
+		secret, err := loadOrCreateTicketKey(cfg.SessionTicketKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		m.secret = &secret
+		m.rotateTickets(time.Now())
+	}
+	_, err := m.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// pairs are the cert and key files to load, the configured pair first.
+func (m *Manager) pairs() ([][2]string, error) {
+	pairs := [][2]string{}
+	if m.cfg.CertFile != "" {
+		pairs = append(pairs, [2]string{m.cfg.CertFile, m.cfg.KeyFile})
+	}
+	if m.cfg.Dir == "" {
+		return pairs, nil
+	}
+	entries, err := os.ReadDir(m.cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".crt" && ext != ".cert" && ext != ".pem") {
+			continue
+		}
+		certFile := filepath.Join(m.cfg.Dir, entry.Name())
+		keyFile := strings.TrimSuffix(certFile, ext) + ".key"
+		if _, err := os.Stat(keyFile); err != nil {
+			// a CA or chain without key
+			continue
+		}
+		pairs = append(pairs, [2]string{certFile, keyFile})
+	}
+	return pairs, nil
+}
+
+func stamp(pairs [][2]string) string {
+	parts := []string{}
+	for _, pair := range pairs {
+		for _, file := range pair {
+			info, err := os.Stat(file)
+			if err != nil {
+				parts = append(parts, file+":missing")
+				continue
+			}
+			parts = append(parts, fmt.Sprintf("%s:%d:%d", file, info.Size(), info.ModTime().UnixNano()))
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+func load(pairs [][2]string) (*certSet, error) {
+	set := &certSet{byName: map[string]*tls.Certificate{}}
+	for _, pair := range pairs {
+		cert, err := tls.LoadX509KeyPair(pair[0], pair[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", pair[0], err)
+		}
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", pair[0], err)
+		}
+		names := cert.Leaf.DNSNames
+		if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+			names = []string{cert.Leaf.Subject.CommonName}
+		}
+		for _, ip := range cert.Leaf.IPAddresses {
+			names = append(names, ip.String())
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if _, found := set.byName[name]; !found {
+				set.byName[name] = &cert
+			}
+		}
+		if set.fallback == nil {
+			set.fallback = &cert
+		}
+		set.infos = append(set.infos, Info{File: pair[0], Names: names, NotAfter: cert.Leaf.NotAfter})
+	}
+	if set.fallback == nil {
+		return nil, fmt.Errorf("no certificate found")
+	}
+	return set, nil
+}
+
+// Reload loads the files again if they changed, the certificates in use
+// stay on errors.
+func (m *Manager) Reload() (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	pairs, err := m.pairs()
+	if err != nil {
+		return false, err
+	}
+	now := stamp(pairs)
+	if now == m.stamp {
+		return false, nil
+	}
+	set, err := load(pairs)
+	if err != nil {
+		return false, err
+	}
+	m.set.Store(set)
+	m.stamp = now
+	for _, info := range set.infos {
+		m.log.Info().Str("file", info.File).Strs("names", info.Names).Time("notAfter", info.NotAfter).Msg("certificate loaded")
+	}
+	return true, nil
+}
+
+// Start checks the files every ReloadInterval.
+func (m *Manager) Start() {
+	go func() {
+		ticker := time.NewTicker(m.cfg.ReloadInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+				if _, err := m.Reload(); err != nil {
+					m.log.Warn().Err(err).Msg("certificate reload")
+				}
+				m.rotateTickets(time.Now())
+			}
+		}
+	}()
+}
+
+func (m *Manager) Close() {
+	m.stopOnce.Do(func() { close(m.stop) })
+}
+
+func (m *Manager) Certificates() []Info {
+	infos := append([]Info{}, m.set.Load().(*certSet).infos...)
+	sort.Slice(infos, func(i, j int) bool { return infos[i].File < infos[j].File })
+	return infos
+}
+
+// GetCertificate chooses the certificate by SNI, exact names before
+// wildcards, the first certificate without match. Clients which connect
+// to an IP send no SNI, the local IP of the connection is used then.
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	set := m.set.Load().(*certSet)
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	if name == "" && hello.Conn != nil {
+		if host, _, err := net.SplitHostPort(hello.Conn.LocalAddr().String()); err == nil {
+			name = host
+		}
+	}
+	if cert, found := set.byName[name]; found {
+		return cert, nil
+	}
+	if _, domain, found := strings.Cut(name, "."); found {
+		if cert, found := set.byName["*."+domain]; found {
+			return cert, nil
+		}
+	}
+	return set.fallback, nil
+}
+
+// rotateTickets sets the session ticket keys of the period of now on the
+// configs, if the period changed.
+func (m *Manager) rotateTickets(now time.Time) {
+	if m.secret == nil {
+		return
+	}
+	period := now.Unix() / int64(m.cfg.SessionTicketPeriod/time.Second)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if period == m.period {
+		return
+	}
+	m.period = period
+	m.tickets = ticketKeys(*m.secret, period)
+	for _, cfg := range m.configs {
+		cfg.SetSessionTicketKeys(m.tickets)
+	}
+}
+
+// TLSConfig is a new config with GetCertificate, servers may change it.
+func (m *Manager) TLSConfig() *tls.Config {
+	cfg := &tls.Config{GetCertificate: m.GetCertificate}
+	if m.secret != nil {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		cfg.SetSessionTicketKeys(m.tickets)
+		m.configs = append(m.configs, cfg)
+	}
+	return cfg
+}
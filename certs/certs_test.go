@@ -0,0 +1,209 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert creates dir/<name>.crt and .key for names with a dev CA and
+// returns the serial number.
+func writeCert(t *testing.T, dir string, name string, names ...string) int64 {
+	certFile, keyFile, err := EnsureDevCA(DevCAConfig{Dir: t.TempDir(), Hosts: names}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Rename(certFile, filepath.Join(dir, name+".crt"))
+	os.Rename(keyFile, filepath.Join(dir, name+".key"))
+	return leaf.SerialNumber.Int64()
+}
+
+// localConn is a connection to the local address addr.
+type localConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (lc localConn) LocalAddr() net.Addr {
+	return lc.addr
+}
+
+func serial(t *testing.T, m *Manager, sni string) int64 {
+	return serialOf(t, m, &tls.ClientHelloInfo{ServerName: sni})
+}
+
+func serialOf(t *testing.T, m *Manager, hello *tls.ClientHelloInfo) int64 {
+	cert, err := m.GetCertificate(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Leaf.SerialNumber.Int64()
+}
+func Test_Manager(t *testing.T) {
+	if _, err := New(Config{}, nil); err == nil {
+		t.Error("Expected an error without certificates")
+	}
+	main := t.TempDir()
+	mainSerial := writeCert(t, main, "main", "main.example.com")
+	dir := t.TempDir()
+	apiSerial := writeCert(t, dir, "api", "api.example.com", "192.0.2.7")
+	wildcardSerial := writeCert(t, dir, "wildcard", "*.example.com")
+	os.WriteFile(filepath.Join(dir, "ca.pem"), []byte("no key"), 0600)
+	m, err := New(Config{CertFile: filepath.Join(main, "main.crt"), KeyFile: filepath.Join(main, "main.key"), Dir: dir}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for sni, expected := range map[string]int64{"main.example.com": mainSerial, "API.example.com.": apiSerial, "www.example.com": wildcardSerial, "other.org": mainSerial, "": mainSerial} {
+		if got := serial(t, m, sni); got != expected {
+			t.Errorf("Expected certificate %d for %q, got %d", expected, sni, got)
+		}
+	}
+	if got := serialOf(t, m, &tls.ClientHelloInfo{Conn: localConn{addr: &net.UDPAddr{IP: net.ParseIP("192.0.2.7"), Port: 443}}}); got != apiSerial {
+		t.Errorf("Expected the certificate of the local IP without SNI, got %d", got)
+	}
+	if len(m.Certificates()) != 3 {
+		t.Errorf("Expected 3 certificates, got %v", m.Certificates())
+	}
+
+	if reloaded, err := m.Reload(); reloaded || err != nil {
+		t.Errorf("Expected no reload without change, got %v %v", reloaded, err)
+	}
+	apiSerial = writeCert(t, dir, "api", "api.example.com")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(filepath.Join(dir, "api.crt"), later, later)
+	if reloaded, err := m.Reload(); !reloaded || err != nil {
+		t.Errorf("Expected a reload, got %v %v", reloaded, err)
+	}
+	if got := serial(t, m, "api.example.com"); got != apiSerial {
+		t.Errorf("Expected the new certificate, got %d", got)
+	}
+
+	os.WriteFile(filepath.Join(dir, "api.crt"), []byte("broken"), 0600)
+	if _, err := m.Reload(); err == nil {
+		t.Error("Expected an error for a broken certificate")
+	}
+	if got := serial(t, m, "api.example.com"); got != apiSerial {
+		t.Errorf("Expected the certificate in use to stay, got %d", got)
+	}
+}
+
+func Test_DevCA(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "ca")
+	cfg := DevCAConfig{Dir: dir, Hosts: []string{"h123.test"}}
+	certFile, keyFile, err := EnsureDevCA(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPEM, err := os.ReadFile(filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+	leaf := func(certFile string, keyFile string) *x509.Certificate {
+		pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, _ := x509.ParseCertificate(pair.Certificate[0])
+		return cert
+	}
+	first := leaf(certFile, keyFile)
+	for _, host := range []string{"h123.test", "localhost", "127.0.0.1"} {
+		if _, err := first.Verify(x509.VerifyOptions{DNSName: host, Roots: roots}); err != nil {
+			t.Errorf("Expected the certificate to verify for %s, got %v", host, err)
+		}
+	}
+	certFile, keyFile, _ = EnsureDevCA(cfg, nil)
+	if leaf(certFile, keyFile).SerialNumber.Cmp(first.SerialNumber) != 0 {
+		t.Error("Expected the certificate to be reused")
+	}
+	m, err := New(Config{CertFile: filepath.Join(dir, "missing.crt"), DevCA: cfg.WithHosts("other.test")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.test"})
+	if _, err := cert.Leaf.Verify(x509.VerifyOptions{DNSName: "other.test", Roots: roots}); err != nil {
+		t.Errorf("Expected a new certificate of the same CA for the new host, got %v", err)
+	}
+}
+
+func Test_SessionTicketKey(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "keys", "tickets.key")
+	first, err := loadOrCreateTicketKey(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := loadOrCreateTicketKey(file); again != first || first == [32]byte{} {
+		t.Error("Expected the key to be kept")
+	}
+	os.WriteFile(file, []byte("short"), 0600)
+	if _, err := loadOrCreateTicketKey(file); err == nil {
+		t.Error("Expected an error for a broken key")
+	}
+}
+
+func Test_SessionTicketRotation(t *testing.T) {
+	dir := t.TempDir()
+	m, err := New(Config{
+		DevCA:                &DevCAConfig{Dir: dir, Hosts: []string{"127.0.0.1"}},
+		SessionTicketKeyFile: filepath.Join(dir, "tickets.key"),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", m.TLSConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// the ticket is sent after the handshake
+			conn.Write([]byte("x"))
+			conn.Close()
+		}
+	}()
+	caPEM, _ := os.ReadFile(filepath.Join(dir, "ca.crt"))
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+	// resumed dials with cache and tells if the session was resumed
+	resumed := func(cache tls.ClientSessionCache) bool {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{RootCAs: roots, ClientSessionCache: cache})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Read(make([]byte, 1))
+		return conn.ConnectionState().DidResume
+	}
+	previous := tls.NewLRUClientSessionCache(1)
+	older := tls.NewLRUClientSessionCache(1)
+	resumed(previous)
+	resumed(older)
+	now := time.Now()
+	m.rotateTickets(now.Add(m.cfg.SessionTicketPeriod))
+	if !resumed(previous) {
+		t.Error("Expected a ticket of the previous period to resume")
+	}
+	m.rotateTickets(now.Add(2 * m.cfg.SessionTicketPeriod))
+	if resumed(older) {
+		t.Error("Expected a ticket of an older period not to resume")
+	}
+}
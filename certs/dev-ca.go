@@ -0,0 +1,225 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mabels/h123-reflector/utils"
+)
+
+// DevCAConfig creates a local CA and a certificate signed by it when the
+// configured files are missing, trust Dir/ca.crt to use it.
+type DevCAConfig struct {
+	Dir      string        // default .h123-dev-ca
+	Hosts    []string      // names and IPs of the certificate, localhost and the loopback IPs are added
+	Validity time.Duration // of the certificate, default 90 days, the CA lasts 10 years
+}
+
+func (cfg *DevCAConfig) setDefaults() {
+	if cfg.Dir == "" {
+		cfg.Dir = ".h123-dev-ca"
+	}
+	if cfg.Validity == 0 {
+		cfg.Validity = 90 * 24 * time.Hour
+	}
+}
+
+// WithHosts is a copy of cfg which covers hosts too, nil stays nil.
+func (cfg *DevCAConfig) WithHosts(hosts ...string) *DevCAConfig {
+	if cfg == nil {
+		return nil
+	}
+	my := *cfg
+	my.Hosts = append(append([]string{}, cfg.Hosts...), hosts...)
+	return &my
+}
+
+// ListenHosts are the host names of listen addresses, unspecified ones
+// are replaced by the host name of the machine.
+func ListenHosts(listens ...string) []string {
+	hosts := []string{}
+	for _, listen := range listens {
+		host, _, err := net.SplitHostPort(listen)
+		if err != nil {
+			host = listen
+		}
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			if name, err := os.Hostname(); err == nil {
+				hosts = append(hosts, name)
+			}
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+func fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = strings.ToUpper(hex.EncodeToString([]byte{b}))
+	}
+	return strings.Join(parts, ":")
+}
+
+func writePair(certFile string, keyFile string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func loadOrCreateCA(dir string, log *utils.Logger) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certFile := filepath.Join(dir, "ca.crt")
+	keyFile := filepath.Join(dir, "ca.key")
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err == nil {
+		ca, err := x509.ParseCertificate(pair.Certificate[0])
+		key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+		if err == nil && ok && time.Now().Before(ca.NotAfter) {
+			return ca, key, nil
+		}
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	host, _ := os.Hostname()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "h123 dev CA " + host, Organization: []string{"h123-reflector"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = writePair(certFile, keyFile, der, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Warn().Str("ca", certFile).Str("sha256", fingerprint(der)).
+		Msgf("created a dev CA, trust it with curl --cacert %s", certFile)
+	return ca, key, nil
+}
+
+// covers tells if cert is valid for a while and for all hosts.
+func covers(certFile string, keyFile string, ca *x509.Certificate, hosts []string) bool {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return false
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil || time.Now().Add(24*time.Hour).After(cert.NotAfter) || cert.CheckSignatureFrom(ca) != nil {
+		return false
+	}
+	for _, host := range hosts {
+		if cert.VerifyHostname(host) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// EnsureDevCA returns the cert and key files of a certificate for hosts
+// signed by the dev CA, both are created if missing.
+func EnsureDevCA(cfg DevCAConfig, log *utils.Logger) (string, string, error) {
+	cfg.setDefaults()
+	if log == nil {
+		log = utils.NewLogger()
+	}
+	err := os.MkdirAll(cfg.Dir, 0700)
+	if err != nil {
+		return "", "", err
+	}
+	ca, caKey, err := loadOrCreateCA(cfg.Dir, log)
+	if err != nil {
+		return "", "", err
+	}
+	hosts := append([]string{"localhost", "127.0.0.1", "::1"}, cfg.Hosts...)
+	certFile := filepath.Join(cfg.Dir, "dev.crt")
+	keyFile := filepath.Join(cfg.Dir, "dev.key")
+	if covers(certFile, keyFile, ca, hosts) {
+		log.Info().Str("cert", certFile).Str("ca", filepath.Join(cfg.Dir, "ca.crt")).Str("sha256", fingerprint(ca.Raw)).Msg("using dev CA")
+		return certFile, keyFile, nil
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return "", "", err
+	}
+	commonName := "localhost"
+	if len(cfg.Hosts) > 0 {
+		commonName = cfg.Hosts[0]
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"h123-reflector"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(cfg.Validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	seen := map[string]bool{}
+	for _, host := range hosts {
+		if seen[host] {
+			continue
+		}
+		seen[host] = true
+		if ip := net.ParseIP(host); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return "", "", err
+	}
+	err = writePair(certFile, keyFile, der, key)
+	if err != nil {
+		return "", "", err
+	}
+	log.Info().Str("cert", certFile).Strs("hosts", hosts).Str("ca", filepath.Join(cfg.Dir, "ca.crt")).
+		Str("sha256", fingerprint(ca.Raw)).Msg("created a dev certificate")
+	return certFile, keyFile, nil
+}
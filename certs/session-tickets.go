@@ -0,0 +1,56 @@
+package certs
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// loadOrCreateTicketKey reads the hex encoded session ticket secret of
+// file, a new one is written if file is missing.
+func loadOrCreateTicketKey(file string) ([32]byte, error) {
+	key := [32]byte{}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		_, err = rand.Read(key[:])
+		if err != nil {
+			return key, err
+		}
+		err = os.MkdirAll(filepath.Dir(file), 0700)
+		if err != nil {
+			return key, err
+		}
+		return key, os.WriteFile(file, []byte(hex.EncodeToString(key[:])+"\n"), 0600)
+	}
+	if err != nil {
+		return key, err
+	}
+	raw, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(raw) != len(key) {
+		return key, fmt.Errorf("%s: no hex encoded 32 byte key", file)
+	}
+	copy(key[:], raw)
+	return key, nil
+}
+
+// ticketKey is the session ticket key of period, derived from secret so
+// that all processes sharing the file agree on it.
+func ticketKey(secret [32]byte, period int64) [32]byte {
+	key := [32]byte{}
+	kdf := hkdf.New(sha256.New, secret[:], nil, []byte(fmt.Sprintf("h123 session ticket %d", period)))
+	io.ReadFull(kdf, key[:])
+	return key
+}
+
+// ticketKeys are the keys of period and the one before, new tickets are
+// issued with the first, tickets of the previous period still resume.
+func ticketKeys(secret [32]byte, period int64) [][32]byte {
+	return [][32]byte{ticketKey(secret, period), ticketKey(secret, period-1)}
+}
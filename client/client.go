@@ -0,0 +1,349 @@
+package client
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/http3"
+	"github.com/mabels/h123-reflector/models"
+	"github.com/mabels/h123-reflector/utils"
+)
+
+var errNoBackend = fmt.Errorf("no backend available")
+
+// Config of a Transport, the backends are announced on the broker, listed
+// in Backends or both.
+type Config struct {
+	Name         string // sent to the backends as X-H123-Frontend, default the host name
+	BrokerUrl    string
+	BackendTopic string        // default h123/backend/#
+	Backends     []string      // MuxEndPointUrls which are always used
+	StaleAfter   time.Duration // announced backends without status are dropped, default 5s
+	MaxAttempts  int           // on different backends, including the first, default 3
+	EjectFor     time.Duration // a failed backend is skipped, default 5s
+	MaxBodyBytes int64         // bodies above this size are not buffered and not retried, default 64KiB
+	Quic         utils.QuicConfig
+	TLSConfig    *tls.Config // to the backends, it gets a session cache for 0-RTT
+	Log          *utils.Logger
+}
+
+func (cfg *Config) setDefaults() {
+	if cfg.Name == "" {
+		cfg.Name, _ = os.Hostname()
+	}
+	if cfg.BackendTopic == "" {
+		cfg.BackendTopic = "h123/backend/#"
+	}
+	if cfg.StaleAfter == 0 {
+		cfg.StaleAfter = 5 * time.Second
+	}
+	if cfg.MaxAttempts == 0 {
+		cfg.MaxAttempts = 3
+	}
+	if cfg.EjectFor == 0 {
+		cfg.EjectFor = 5 * time.Second
+	}
+	if cfg.MaxBodyBytes == 0 {
+		cfg.MaxBodyBytes = 64 * 1024
+	}
+	if cfg.Log == nil {
+		cfg.Log = utils.NewLogger()
+	}
+}
+
+type endpoint struct {
+	status       *models.ServerStatus // nil for configured backends
+	ejected      time.Time
+	roundTripper *http3.RoundTripper
+}
+
+// Transport is a http.RoundTripper which sends the requests through the
+// backends of a h123 mesh, the request URL is the upstream.
+type Transport struct {
+	cfg        Config
+	mqtt       *utils.MqttConnection
+	tlsConfig  *tls.Config
+	quicConfig *quic.Config
+	mutex      sync.Mutex
+	backends   map[string]*endpoint
+	next       int
+	log        *utils.Logger
+}
+
+func New(config Config) (*Transport, error) {
+	cfg := config
+	cfg.setDefaults()
+	quicCfg, err := cfg.Quic.Apply(nil)
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg := &tls.Config{}
+	if cfg.TLSConfig != nil {
+		tlsCfg = cfg.TLSConfig.Clone()
+	}
+	if tlsCfg.ClientSessionCache == nil {
+		tlsCfg.ClientSessionCache = tls.NewLRUClientSessionCache(64)
+	}
+	t := &Transport{
+		cfg:        cfg,
+		tlsConfig:  tlsCfg,
+		quicConfig: quicCfg,
+		backends:   map[string]*endpoint{},
+		log:        cfg.Log.Component("client"),
+	}
+	for _, muxEndPointUrl := range cfg.Backends {
+		t.backends[muxEndPointUrl] = &endpoint{roundTripper: t.newRoundTripper()}
+	}
+	if cfg.BrokerUrl != "" {
+		t.mqtt, err = utils.NewMqttConnection(cfg.BrokerUrl)
+		if err != nil {
+			return nil, err
+		}
+		t.mqtt.Log = cfg.Log.Component("mqtt")
+		err = t.mqtt.Connect()
+		if err != nil {
+			return nil, err
+		}
+		err = t.mqtt.Subscribe(cfg.BackendTopic, t.receiveBackendTopic)
+		if err != nil {
+			t.mqtt.Close()
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// newRoundTripper dials a backend again after it closed the connection.
+func (t *Transport) newRoundTripper() *http3.RoundTripper {
+	rt := &http3.RoundTripper{TLSClientConfig: t.tlsConfig, QuicConfig: t.quicConfig}
+	utils.RedialOnClose(rt, nil)
+	return rt
+}
+
+func (t *Transport) receiveBackendTopic(client mqtt.Client, msg mqtt.Message) {
+	state := models.ServerStatus{}
+	err := json.Unmarshal(msg.Payload(), &state)
+	if err != nil {
+		t.log.Warn().Str("topic", msg.Topic()).Err(err).Msg("invalid backend status")
+		return
+	}
+	if state.MuxEndPointUrl == "" {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.dropStale(time.Now())
+	b, found := t.backends[state.MuxEndPointUrl]
+	// tunnel backends are only reachable through their frontend
+	if state.Tunnel {
+		if found && b.status != nil {
+			t.drop(state.MuxEndPointUrl)
+		}
+		return
+	}
+	if !found {
+		t.backends[state.MuxEndPointUrl] = &endpoint{status: &state, roundTripper: t.newRoundTripper()}
+		return
+	}
+	// configured backends are used without status
+	if b.status != nil {
+		b.status = &state
+	}
+}
+
+// dropStale drops the announced backends without a recent status, t.mutex
+// is held.
+func (t *Transport) dropStale(now time.Time) {
+	for muxEndPointUrl, b := range t.backends {
+		if b.status != nil && !b.status.Now.Add(t.cfg.StaleAfter).After(now) {
+			t.drop(muxEndPointUrl)
+		}
+	}
+}
+
+func (t *Transport) drop(muxEndPointUrl string) {
+	t.backends[muxEndPointUrl].roundTripper.Close()
+	delete(t.backends, muxEndPointUrl)
+}
+
+// usable tells if b takes new requests, announced backends need a
+// recent online status, must not be saturated nor announce weight 0.
+func (t *Transport) usable(b *endpoint, now time.Time) bool {
+	if b.status == nil {
+		return true
+	}
+	if b.status.Weight != nil && *b.status.Weight == 0 {
+		return false
+	}
+	return b.status.Status == "online" && !b.status.Saturated && b.status.Now.Add(t.cfg.StaleAfter).After(now)
+}
+
+// Backends are the MuxEndPointUrls which take requests.
+func (t *Transport) Backends() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := time.Now()
+	ret := []string{}
+	for muxEndPointUrl, b := range t.backends {
+		if t.usable(b, now) {
+			ret = append(ret, muxEndPointUrl)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// pick returns the next backend in round robin order which is not in
+// tried, ejected ones only if there is no other.
+func (t *Transport) pick(tried map[string]bool) string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := time.Now()
+	t.dropStale(now)
+	candidates := []string{}
+	ejected := []string{}
+	for muxEndPointUrl, b := range t.backends {
+		if tried[muxEndPointUrl] || !t.usable(b, now) {
+			continue
+		}
+		if b.ejected.After(now) {
+			ejected = append(ejected, muxEndPointUrl)
+			continue
+		}
+		candidates = append(candidates, muxEndPointUrl)
+	}
+	if len(candidates) == 0 {
+		candidates = ejected
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	sort.Strings(candidates)
+	t.next++
+	return candidates[t.next%len(candidates)]
+}
+
+func (t *Transport) eject(muxEndPointUrl string) {
+	t.mutex.Lock()
+	if b, found := t.backends[muxEndPointUrl]; found {
+		b.ejected = time.Now().Add(t.cfg.EjectFor)
+	}
+	t.mutex.Unlock()
+}
+
+func (t *Transport) send(req *http.Request, muxEndPointUrl string, header http.Header, body io.ReadCloser) (*http.Response, error) {
+	out, err := utils.NewMuxRequest(req.Context(), muxEndPointUrl, req, header, body, true)
+	if err != nil {
+		return nil, err
+	}
+	out.ContentLength = req.ContentLength
+	t.mutex.Lock()
+	b, found := t.backends[muxEndPointUrl]
+	t.mutex.Unlock()
+	if !found {
+		return nil, fmt.Errorf("backend %s dropped", muxEndPointUrl)
+	}
+	resp, err := b.roundTripper.RoundTrip(out)
+	if err != nil {
+		return nil, err
+	}
+	resp, err = utils.MuxResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+	resp.Request = req
+	return resp, nil
+}
+
+// RoundTrip sends req to a backend which forwards it to the host of the
+// request URL, idempotent requests fail over to other backends.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	header := req.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	if header.Get("X-H123-Backend-Host") == "" {
+		header.Set("X-H123-Backend-Host", req.URL.Scheme+"://"+req.URL.Host)
+	}
+	if header.Get("X-H123-Txn") == "" {
+		header.Set("X-H123-Txn", uuid.New().String())
+	}
+	header.Set("X-H123-Frontend", t.cfg.Name)
+	retryable := utils.Retryable(req.Method, header)
+	var buffered []byte
+	var stream io.ReadCloser
+	if req.Body != nil && req.Body != http.NoBody {
+		stream = req.Body
+		if retryable {
+			var err error
+			buffered, err = io.ReadAll(io.LimitReader(req.Body, t.cfg.MaxBodyBytes+1))
+			if err != nil {
+				req.Body.Close()
+				return nil, err
+			}
+			if int64(len(buffered)) > t.cfg.MaxBodyBytes {
+				// too large to keep, it is sent once
+				retryable = false
+				stream = struct {
+					io.Reader
+					io.Closer
+				}{io.MultiReader(bytes.NewReader(buffered), req.Body), req.Body}
+			} else {
+				req.Body.Close()
+				stream = nil
+			}
+		}
+	}
+	tried := map[string]bool{}
+	lastErr := errNoBackend
+	for attempt := 0; attempt < t.cfg.MaxAttempts; attempt++ {
+		if attempt > 0 && !retryable {
+			break
+		}
+		muxEndPointUrl := t.pick(tried)
+		if muxEndPointUrl == "" {
+			break
+		}
+		tried[muxEndPointUrl] = true
+		body := stream
+		if body == nil && buffered != nil {
+			body = io.NopCloser(bytes.NewReader(buffered))
+		}
+		resp, err := t.send(req, muxEndPointUrl, header, body)
+		if err == nil {
+			return resp, nil
+		}
+		if req.Context().Err() != nil {
+			return nil, req.Context().Err()
+		}
+		t.log.Warn().Str("mux", muxEndPointUrl).Int("attempt", attempt+1).Err(err).Msg("backend failed")
+		t.eject(muxEndPointUrl)
+		lastErr = err
+	}
+	if stream != nil && len(tried) == 0 {
+		stream.Close()
+	}
+	return nil, lastErr
+}
+
+func (t *Transport) Close() {
+	if t.mqtt != nil {
+		t.mqtt.Close()
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, b := range t.backends {
+		b.roundTripper.Close()
+	}
+}
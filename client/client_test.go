@@ -0,0 +1,138 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mabels/h123-reflector/backend"
+	"github.com/mabels/h123-reflector/certs"
+	"github.com/mabels/h123-reflector/models"
+	"github.com/mabels/h123-reflector/utils"
+)
+
+func Test_Transport(t *testing.T) {
+	dir := t.TempDir()
+	bd, err := backend.NewBackend(backend.BackendConfig{
+		BrokerUrl:      "mqtt://127.0.0.1:1883/",
+		Listen:         "127.0.0.1:4714",
+		MuxEndPointUrl: "https://127.0.0.1:4714",
+		DevCA:          &certs.DevCAConfig{Dir: dir},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write([]byte(r.Method + " " + r.URL.RequestURI() + " " + string(body)))
+	}))
+	defer upstream.Close()
+
+	caPEM, _ := os.ReadFile(filepath.Join(dir, "ca.crt"))
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+	tr, err := New(Config{
+		Name: "test-client",
+		// nothing listens on the first one
+		Backends:  []string{"https://127.0.0.1:4715", "https://127.0.0.1:4714"},
+		Quic:      utils.QuicConfig{HandshakeIdleTimeout: 200 * time.Millisecond},
+		TLSConfig: &tls.Config{RootCAs: roots},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	client := &http.Client{Transport: tr}
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(upstream.URL + "/hello?x=1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "GET /hello?x=1 " {
+			t.Errorf("Expected the upstream response, got %d %q", resp.StatusCode, body)
+		}
+	}
+	uplinks := bd.Uplinks()
+	if len(uplinks) != 1 || uplinks[0].Frontend != "test-client" || uplinks[0].Requests != 3 {
+		t.Fatalf("Expected one uplink of the client, got %v", uplinks)
+	}
+	req, _ := http.NewRequest("GET", upstream.URL+"/bye", nil)
+	req.Header.Set("X-H123-Uplink-Close", "true")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if uplinks := bd.Uplinks(); len(uplinks) != 0 {
+		t.Errorf("Expected the uplink removed, got %v", uplinks)
+	}
+	// the closed connection is dialed again
+	time.Sleep(1500 * time.Millisecond)
+	resp, err = client.Get(upstream.URL + "/again")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if again := bd.Uplinks(); len(again) != 1 || again[0].ID == uplinks[0].ID {
+		t.Errorf("Expected a new uplink, got %v", again)
+	}
+	resp, err = client.Post(upstream.URL+"/submit", "text/plain", strings.NewReader("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "POST /submit data" {
+		t.Errorf("Expected the POST on the backend which is not ejected, got %q", body)
+	}
+
+	empty, _ := New(Config{})
+	if _, err := empty.RoundTrip(httptest.NewRequest("GET", upstream.URL, nil)); err != errNoBackend {
+		t.Errorf("Expected no backend, got %v", err)
+	}
+}
+
+func Test_TransportDropsStale(t *testing.T) {
+	tr, err := New(Config{Backends: []string{"https://127.0.0.1:4716"}, StaleAfter: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	now := time.Now()
+	tr.backends["https://127.0.0.1:4717"] = &endpoint{
+		status:       &models.ServerStatus{Status: "online", Now: now.Add(-2 * time.Second)},
+		roundTripper: tr.newRoundTripper(),
+	}
+	tr.backends["https://127.0.0.1:4718"] = &endpoint{
+		status:       &models.ServerStatus{Status: "online", Now: now},
+		roundTripper: tr.newRoundTripper(),
+	}
+	weight := 0
+	tr.backends["https://127.0.0.1:4719"] = &endpoint{
+		status:       &models.ServerStatus{Status: "online", Now: now, Weight: &weight},
+		roundTripper: tr.newRoundTripper(),
+	}
+	if backends := tr.Backends(); len(backends) != 2 {
+		t.Errorf("Expected no requests to the weight 0 backend, got %v", backends)
+	}
+	tr.pick(map[string]bool{})
+	if _, found := tr.backends["https://127.0.0.1:4717"]; found {
+		t.Error("Expected the stale backend dropped")
+	}
+	if len(tr.backends) != 3 {
+		t.Errorf("Expected the configured and the recent backends kept, got %v", tr.backends)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"time"
+
+	"github.com/mabels/h123-reflector/topology"
+	"github.com/mabels/h123-reflector/utils"
+)
+
+// topology listens to the status of the frontends and backends for a
+// while and prints which frontend uses which backend.
+func main() {
+	log := utils.NewLogger()
+	broker := flag.String("broker", "mqtt://127.0.0.1:1883", "MQTT broker")
+	frontendTopic := flag.String("frontend-topic", "h123/frontend/#", "topic of the frontend status")
+	backendTopic := flag.String("backend-topic", "h123/backend/#", "topic of the backend status")
+	wait := flag.Duration("wait", 3*time.Second, "time to collect status messages")
+	staleAfter := flag.Duration("stale", 5*time.Second, "leave out nodes without newer status, 0 keeps all")
+	format := flag.String("format", "text", "text, json or dot")
+	flag.Parse()
+
+	mq, err := utils.NewMqttConnection(*broker)
+	if err != nil {
+		log.Fatal().Err(err).Msg("broker url")
+	}
+	mq.Log = log.Component("mqtt")
+	err = mq.Connect()
+	if err != nil {
+		log.Fatal().Str("broker", *broker).Err(err).Msg("connect")
+	}
+	defer mq.Close()
+	collector := topology.NewCollector()
+	err = mq.Subscribe(*frontendTopic, collector.ReceiveFrontend)
+	if err == nil {
+		err = mq.Subscribe(*backendTopic, collector.ReceiveBackend)
+	}
+	if err != nil {
+		log.Fatal().Err(err).Msg("subscribe")
+	}
+	time.Sleep(*wait)
+
+	graph := collector.Graph(time.Now(), *staleAfter)
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(graph)
+	case "dot":
+		graph.WriteDot(os.Stdout)
+	default:
+		graph.WriteText(os.Stdout)
+	}
+}
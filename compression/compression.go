@@ -0,0 +1,183 @@
+package compression
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+type Config struct {
+	// Encodings in the order of preference, default br, zstd and gzip
+	Encodings []string
+	Level     int // 1 fast to 9 small, default 5
+	MinSize   int // smaller bodies are sent as they are, default 1024
+	// SkipTypes are prefixes of content types which are compressed already
+	SkipTypes []string
+}
+
+func (cfg *Config) setDefaults() {
+	if cfg.Encodings == nil {
+		cfg.Encodings = []string{"br", "zstd", "gzip"}
+	}
+	if cfg.Level == 0 {
+		cfg.Level = 5
+	}
+	if cfg.MinSize == 0 {
+		cfg.MinSize = 1024
+	}
+	if cfg.SkipTypes == nil {
+		cfg.SkipTypes = []string{"image/", "video/", "audio/", "font/woff", "application/zip",
+			"application/gzip", "application/x-gzip", "application/zstd", "application/x-brotli",
+			"application/x-7z-compressed", "application/x-rar-compressed", "application/octet-stream"}
+	}
+}
+
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// Compressor negotiates the encoding of responses, a nil Compressor
+// sends them as they are.
+type Compressor struct {
+	cfg   Config
+	pools map[string]*sync.Pool
+}
+
+func New(config *Config) (*Compressor, error) {
+	if config == nil {
+		return nil, nil
+	}
+	cfg := *config
+	cfg.setDefaults()
+	c := &Compressor{cfg: cfg, pools: map[string]*sync.Pool{}}
+	for _, encoding := range cfg.Encodings {
+		newEncoder, err := encoderFactory(encoding, cfg.Level)
+		if err != nil {
+			return nil, err
+		}
+		c.pools[encoding] = &sync.Pool{New: func() interface{} { return newEncoder() }}
+	}
+	return c, nil
+}
+
+func encoderFactory(encoding string, level int) (func() encoder, error) {
+	switch encoding {
+	case "gzip":
+		if level > gzip.BestCompression {
+			level = gzip.BestCompression
+		}
+		return func() encoder {
+			w, _ := gzip.NewWriterLevel(io.Discard, level)
+			return w
+		}, nil
+	case "br":
+		return func() encoder { return brotli.NewWriterLevel(io.Discard, level) }, nil
+	case "zstd":
+		return func() encoder {
+			w, _ := zstd.NewWriter(io.Discard, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)), zstd.WithEncoderConcurrency(1))
+			return w
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported encoding %s", encoding)
+}
+
+func (c *Compressor) encoder(encoding string, w io.Writer) encoder {
+	enc := c.pools[encoding].Get().(encoder)
+	enc.Reset(w)
+	return enc
+}
+
+func (c *Compressor) release(encoding string, enc encoder) {
+	enc.Reset(io.Discard)
+	c.pools[encoding].Put(enc)
+}
+
+// Negotiate picks the encoding for an Accept-Encoding header, it is empty
+// if nothing offered is acceptable.
+func (c *Compressor) Negotiate(acceptEncoding string) string {
+	if c == nil {
+		return ""
+	}
+	accepted := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if name == "x-gzip" {
+			name = "gzip"
+		}
+		q := 1.0
+		if key, v, _ := strings.Cut(strings.TrimSpace(params), "="); strings.ToLower(key) == "q" {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err == nil {
+				q = parsed
+			}
+		}
+		accepted[name] = q
+	}
+	best, bestQ := "", 0.0
+	for _, encoding := range c.cfg.Encodings {
+		q, found := accepted[encoding]
+		if !found {
+			q = accepted["*"]
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+func (c *Compressor) skipType(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	for _, prefix := range c.cfg.SkipTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+type decoder struct {
+	io.Reader
+	close func()
+}
+
+func (d decoder) Close() error {
+	d.close()
+	return nil
+}
+
+// Decode reads the body r in encoding, a closed decoder leaves r open.
+func Decode(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch strings.ToLower(encoding) {
+	case "gzip", "x-gzip":
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return gr, nil
+	case "br":
+		return io.NopCloser(brotli.NewReader(r)), nil
+	case "zstd":
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return decoder{Reader: zr, close: zr.Close}, nil
+	}
+	return nil, fmt.Errorf("unsupported encoding %s", encoding)
+}
+
+// Decodable are the encodings Decode reads.
+var Decodable = []string{"br", "zstd", "gzip"}
@@ -0,0 +1,99 @@
+package compression
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_Negotiate(t *testing.T) {
+	c, err := New(&Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for accept, expected := range map[string]string{
+		"":                           "",
+		"identity":                   "",
+		"gzip":                       "gzip",
+		"x-gzip":                     "gzip",
+		"gzip, br":                   "br",
+		"gzip;q=1.0, br;q=0.5":       "gzip",
+		"zstd, gzip":                 "zstd",
+		"*":                          "br",
+		"*;q=0.1, br;q=0":            "zstd",
+		"br;q=0, zstd;q=0, gzip;q=0": "",
+	} {
+		if got := c.Negotiate(accept); got != expected {
+			t.Errorf("Expected %q for %q, got %q", expected, accept, got)
+		}
+	}
+	if _, err := New(&Config{Encodings: []string{"lzma"}}); err == nil {
+		t.Error("Expected an error for an unsupported encoding")
+	}
+}
+
+func Test_Handler(t *testing.T) {
+	c, _ := New(&Config{MinSize: 64})
+	large := strings.Repeat("compress me ", 100)
+	h := Handler(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			w.Write([]byte("tiny"))
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte(large))
+		case "/encoded":
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write([]byte(large))
+		case "/stream":
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte("data: 1\n\n"))
+			w.(http.Flusher).Flush()
+			w.Write([]byte(large))
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte(large))
+		}
+	}))
+	request := func(path string, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Accept-Encoding", accept)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	for _, encoding := range []string{"br", "zstd", "gzip"} {
+		w := request("/text", encoding)
+		if w.Header().Get("Content-Encoding") != encoding || w.Header().Get("Vary") != "Accept-Encoding" || w.Header().Get("ETag") != `W/"v1"` {
+			t.Errorf("Expected %s, got %v", encoding, w.Header())
+		}
+		r, err := Decode(encoding, w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || string(body) != large {
+			t.Errorf("Expected the body after decoding %s, got %d bytes %v", encoding, len(body), err)
+		}
+	}
+	w := request("/text", "identity")
+	if w.Header().Get("Content-Encoding") != "" || w.Header().Get("Vary") != "Accept-Encoding" || w.Body.String() != large {
+		t.Errorf("Expected identity with Vary, got %v", w.Header())
+	}
+	for _, path := range []string{"/small", "/image", "/encoded"} {
+		w := request(path, "gzip")
+		if w.Header().Get("Content-Encoding") == "br" || (path != "/encoded" && w.Header().Get("Content-Encoding") != "") {
+			t.Errorf("Expected %s as it is, got %v", path, w.Header())
+		}
+	}
+	w = request("/stream", "gzip")
+	r, _ := Decode("gzip", w.Body)
+	body, _ := io.ReadAll(r)
+	if w.Header().Get("Content-Encoding") != "gzip" || string(body) != "data: 1\n\n"+large || !w.Flushed {
+		t.Errorf("Expected a flushed gzip stream, got %v", w.Header())
+	}
+}
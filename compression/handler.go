@@ -0,0 +1,185 @@
+package compression
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lucas-clemente/quic-go/http3"
+)
+
+type handler struct {
+	compressor *Compressor
+	handler    http.Handler
+}
+
+// Handler compresses the responses of h in the encoding the client
+// accepts, without Compressor the handler is returned as it is.
+func Handler(c *Compressor, h http.Handler) http.Handler {
+	if c == nil {
+		return h
+	}
+	return handler{compressor: c, handler: h}
+}
+
+func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect || r.Method == http.MethodHead {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+	cw := &compressWriter{
+		ResponseWriter: w,
+		compressor:     h.compressor,
+		encoding:       h.compressor.Negotiate(r.Header.Get("Accept-Encoding")),
+	}
+	defer cw.close()
+	h.handler.ServeHTTP(cw, r)
+}
+
+// compressWriter holds back the first MinSize bytes to decide if the
+// body is worth to be compressed.
+type compressWriter struct {
+	http.ResponseWriter
+	compressor *Compressor
+	encoding   string
+	status     int
+	pending    bool // the header waits for the decision
+	buf        []byte
+	enc        encoder
+}
+
+func hasToken(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compressible tells if the response could be sent encoded at all.
+func (cw *compressWriter) compressible(status int) bool {
+	header := cw.ResponseWriter.Header()
+	if status < 200 || status == http.StatusNoContent || status == http.StatusNotModified ||
+		status == http.StatusPartialContent {
+		return false
+	}
+	if header.Get("Content-Encoding") != "" || hasToken(header, "Cache-Control", "no-transform") {
+		return false
+	}
+	return !cw.compressor.skipType(header.Get("Content-Type"))
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if status < 200 {
+		// informational responses like 103 Early Hints pass
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if cw.status != 0 {
+		return
+	}
+	cw.status = status
+	if !cw.compressible(status) {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	header := cw.ResponseWriter.Header()
+	if !hasToken(header, "Vary", "Accept-Encoding") {
+		header.Add("Vary", "Accept-Encoding")
+	}
+	if cw.encoding == "" {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if length, err := strconv.Atoi(header.Get("Content-Length")); err == nil && length < cw.compressor.cfg.MinSize {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	cw.pending = true
+}
+
+// start sends the header and the held back bytes encoded.
+func (cw *compressWriter) start() error {
+	cw.pending = false
+	header := cw.ResponseWriter.Header()
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	header.Set("Content-Encoding", cw.encoding)
+	header.Del("Content-Length")
+	header.Del("Accept-Ranges")
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		// the encoded body is no longer byte equal
+		header.Set("ETag", "W/"+etag)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	cw.enc = cw.compressor.encoder(cw.encoding, cw.ResponseWriter)
+	_, err := cw.enc.Write(cw.buf)
+	cw.buf = nil
+	return err
+}
+
+// plain sends the header and the held back bytes as they are.
+func (cw *compressWriter) plain() error {
+	cw.pending = false
+	cw.ResponseWriter.WriteHeader(cw.status)
+	_, err := cw.ResponseWriter.Write(cw.buf)
+	cw.buf = nil
+	return err
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.enc != nil {
+		return cw.enc.Write(p)
+	}
+	if !cw.pending {
+		return cw.ResponseWriter.Write(p)
+	}
+	cw.buf = append(cw.buf, p...)
+	if len(cw.buf) >= cw.compressor.cfg.MinSize {
+		if err := cw.start(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush starts to encode what is held back, streams keep their chunks.
+func (cw *compressWriter) Flush() {
+	if cw.pending {
+		if cw.start() != nil {
+			return
+		}
+	}
+	if cw.enc != nil && cw.enc.Flush() != nil {
+		return
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// StreamCreator keeps the QUIC connection reachable.
+func (cw *compressWriter) StreamCreator() http3.StreamCreator {
+	if h, ok := cw.ResponseWriter.(http3.Hijacker); ok {
+		return h.StreamCreator()
+	}
+	return nil
+}
+
+func (cw *compressWriter) close() {
+	if cw.pending {
+		cw.plain()
+	}
+	if cw.enc != nil {
+		cw.enc.Close()
+		cw.compressor.release(cw.encoding, cw.enc)
+		cw.enc = nil
+	}
+}
@@ -0,0 +1,93 @@
+package frontend
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/mabels/h123-reflector/admin"
+	"github.com/mabels/h123-reflector/models"
+)
+
+func (mds *MuxDownStream) Backends() []models.BackendInfo {
+	mds.activeMutex.RLock()
+	defer mds.activeMutex.RUnlock()
+	ret := make([]models.BackendInfo, 0, len(mds.active))
+	for _, mxc := range mds.active {
+		ret = append(ret, models.BackendInfo{
+			MuxEndPointUrl: mxc.muxEndPointUrl,
+			State:          mxc.state,
+			Connected:      mxc.connection != nil,
+			Tunnel:         mxc.tunnel,
+			Drained:        mxc.drained,
+			Circuit:        mxc.Circuit(),
+			Health:         mxc.Health(),
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].MuxEndPointUrl < ret[j].MuxEndPointUrl })
+	return ret
+}
+
+// closeBackend closes the connection to a backend, it is dialed again,
+// tunnels are dialed again by the backend.
+func (mds *MuxDownStream) closeBackend(muxEndPointUrl string) bool {
+	mds.activeMutex.Lock()
+	mxc, found := mds.active[muxEndPointUrl]
+	if !found {
+		mds.activeMutex.Unlock()
+		return false
+	}
+	connection := mxc.connection
+	mxc.connection = nil
+	if mds.tunnels[muxEndPointUrl] == connection {
+		delete(mds.tunnels, muxEndPointUrl)
+	}
+	mds.activeMutex.Unlock()
+	mds.log.Info().Str("mux", muxEndPointUrl).Msg("closing backend connection")
+	connection.Close()
+	if !mxc.tunnel {
+		go func() { mds.connectToBackend <- mxc }()
+	}
+	return true
+}
+
+// drainBackend stops or resumes sending new requests to a backend.
+func (mds *MuxDownStream) drainBackend(muxEndPointUrl string, drained bool) bool {
+	mds.activeMutex.Lock()
+	defer mds.activeMutex.Unlock()
+	mxc, found := mds.active[muxEndPointUrl]
+	if found {
+		mxc.drained = drained
+	}
+	return found
+}
+
+func (fe *Frontend) adminRoutes(s *admin.Server) {
+	mds := fe.muxDownStream
+	s.Handle(http.MethodGet, "/status", func(r *http.Request) (interface{}, error) {
+		return fe.Status(), nil
+	})
+	s.Handle(http.MethodGet, "/backends", func(r *http.Request) (interface{}, error) {
+		return mds.Backends(), nil
+	})
+	s.Handle(http.MethodDelete, "/backends/connection", func(r *http.Request) (interface{}, error) {
+		mux := r.URL.Query().Get("mux")
+		if !mds.closeBackend(mux) {
+			return nil, admin.NotFound("no backend %q", mux)
+		}
+		return mds.Backends(), nil
+	})
+	drain := func(drained bool) admin.HandlerFunc {
+		return func(r *http.Request) (interface{}, error) {
+			mux := r.URL.Query().Get("mux")
+			if !mds.drainBackend(mux, drained) {
+				return nil, admin.NotFound("no backend %q", mux)
+			}
+			return mds.Backends(), nil
+		}
+	}
+	s.Handle(http.MethodGet, "/quic", func(r *http.Request) (interface{}, error) {
+		return fe.QuicStatus(), nil
+	})
+	s.Handle(http.MethodPost, "/backends/drain", drain(true))
+	s.Handle(http.MethodDelete, "/backends/drain", drain(false))
+}
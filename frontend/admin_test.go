@@ -0,0 +1,31 @@
+package frontend
+
+import (
+	"net/http"
+	"testing"
+)
+
+func Test_AdminDrainBackend(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	fe, closer := testFrontend(ok, ok)
+	defer closer()
+	mds := fe.muxDownStream
+	backends := mds.Backends()
+	if len(backends) != 2 || !backends[0].Connected {
+		t.Fatalf("Unexpected backends %v", backends)
+	}
+	drained := backends[0].MuxEndPointUrl
+	if !mds.drainBackend(drained, true) || mds.drainBackend("unknown", true) {
+		t.Fatal("Expected to drain only known backends")
+	}
+	for i := 0; i < 4; i++ {
+		mxc := mds.pick(map[*MuxConnection]bool{})
+		if mxc == nil || mxc.muxEndPointUrl == drained {
+			t.Errorf("Expected the other backend, got %v", mxc)
+		}
+	}
+	mds.drainBackend(drained, false)
+	if mds.pick(map[*MuxConnection]bool{mds.active[backends[1].MuxEndPointUrl]: true}) == nil {
+		t.Error("Expected the undrained backend")
+	}
+}
@@ -0,0 +1,260 @@
+package frontend
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/http3"
+	"github.com/mabels/h123-reflector/accesslog"
+	"github.com/mabels/h123-reflector/metrics"
+	"github.com/mabels/h123-reflector/reflector"
+	"github.com/mabels/h123-reflector/utils"
+)
+
+// HTTP/3 settings for extended CONNECT (RFC 9220) and datagrams (RFC 9297)
+const (
+	settingEnableConnectProtocol = 0x08
+	settingH3Datagram            = 0x33
+)
+
+const masqueUDPPrefix = "/.well-known/masque/udp/"
+
+var (
+	errConnectNotAllowed = errors.New("CONNECT is not allowed")
+	errConnectRefused    = errors.New("backend refused CONNECT")
+)
+
+func connectServerOptions(opts *reflector.ServerOptions) {
+	opts.EnableDatagrams = true
+	opts.AdditionalSettings = map[uint64]uint64{
+		settingEnableConnectProtocol: 1,
+		settingH3Datagram:            1,
+	}
+}
+
+// connectTarget returns the network and address a CONNECT asks for,
+// CONNECT-UDP uses the default template /.well-known/masque/udp/{host}/{port}/.
+func connectTarget(r *http.Request) (string, string, error) {
+	if r.Proto == "connect-udp" {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, masqueUDPPrefix), "/")
+		if !strings.HasPrefix(r.URL.Path, masqueUDPPrefix) || len(parts) < 2 ||
+			parts[0] == "" || parts[1] == "" || (len(parts) == 3 && parts[2] != "") || len(parts) > 3 {
+			return "", "", fmt.Errorf("invalid CONNECT-UDP path: %s", r.URL.Path)
+		}
+		host, err := url.PathUnescape(parts[0])
+		if err != nil {
+			return "", "", err
+		}
+		return "udp", net.JoinHostPort(host, parts[1]), nil
+	}
+	if r.ProtoMajor == 3 && r.Proto != "" {
+		return "", "", fmt.Errorf("unsupported CONNECT protocol: %s", r.Proto)
+	}
+	_, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		return "", "", err
+	}
+	return "tcp", r.Host, nil
+}
+
+// openRelay opens a stream to the backend which relays to the target.
+func (mxc *MuxConnection) openRelay(ctx context.Context, req utils.RelayRequest) (quic.Connection, quic.Stream, error) {
+	mxc.MuxDownStream.activeMutex.RLock()
+	connection := mxc.connection
+	mxc.MuxDownStream.activeMutex.RUnlock()
+	var conn quic.Connection
+	if connection != nil {
+		conn = connection.quicConnection()
+	}
+	if conn == nil {
+		mxc.circuit.Release()
+		return nil, nil, fmt.Errorf("backend %s not connected", mxc.muxEndPointUrl)
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		mxc.circuit.Failure(time.Now())
+		return nil, nil, err
+	}
+	res := utils.RelayResponse{}
+	err = utils.WriteRelayHeader(stream, utils.RelayFrameType, req)
+	if err == nil {
+		err = utils.ReadRelayHeader(stream, &res)
+	}
+	if err != nil {
+		utils.RelayStream{Stream: stream}.Close()
+		mxc.circuit.Failure(time.Now())
+		return nil, nil, err
+	}
+	mxc.circuit.Success(time.Now())
+	if res.Error != "" {
+		utils.RelayStream{Stream: stream}.Close()
+		return nil, nil, fmt.Errorf("%w: %s", errConnectRefused, res.Error)
+	}
+	return conn, stream, nil
+}
+
+func (mfh muxFrontendHandler) serveConnect(w http.ResponseWriter, r *http.Request) {
+	if !mfh.frontend.Config.AllowConnect {
+		mfh.reflectorResponse(w, r, http.StatusMethodNotAllowed, errConnectNotAllowed)
+		return
+	}
+	network, address, err := connectTarget(r)
+	if err != nil {
+		mfh.reflectorResponse(w, r, http.StatusBadRequest, err)
+		return
+	}
+	txn := r.Header.Get("X-H123-Txn")
+	if txn == "" {
+		txn = uuid.New().String()
+	}
+	mds := mfh.frontend.muxDownStream
+	cfg := &mfh.frontend.Config.Retry
+	log := mds.log.With("txn", txn).With("upstream", network+"://"+address)
+	entry := accesslog.FromContext(r.Context())
+	if entry != nil {
+		entry.Txn = txn
+		entry.Upstream = network + "://" + address
+	}
+	metrics.SetUpstream(r.Context(), address)
+	mds.retryBudget.request(time.Now())
+	tried := map[*MuxConnection]bool{}
+	var lastErr error
+	// nothing reached the target before the relay is open, so retrying is safe
+	for attempts := 0; attempts < cfg.MaxAttempts; attempts++ {
+		if attempts > 0 {
+			if !mds.retryBudget.withdraw(time.Now()) {
+				break
+			}
+			time.Sleep(cfg.backoff(attempts))
+		}
+		mxc := mds.pick(tried)
+		if mxc == nil {
+			break
+		}
+		tried[mxc] = true
+		conn, stream, err := mxc.openRelay(r.Context(), utils.RelayRequest{
+			Network: network,
+			Address: address,
+			Txn:     txn,
+		})
+		if errors.Is(err, errConnectRefused) {
+			log.Warn().Str("mux", mxc.muxEndPointUrl).Err(err).Msg("connect refused")
+			mfh.reflectorResponse(w, r, http.StatusBadGateway, err)
+			return
+		}
+		if err != nil {
+			log.Warn().Str("mux", mxc.muxEndPointUrl).Int("attempt", attempts+1).Err(err).Msg("open relay failed")
+			lastErr = err
+			continue
+		}
+		if entry != nil {
+			entry.Backend = mxc.muxEndPointUrl
+			entry.Attempts = attempts + 1
+		}
+		log.Debug().Str("mux", mxc.muxEndPointUrl).Msg("relay")
+		mfh.relay(w, r, network, conn, stream)
+		return
+	}
+	log.Error().AnErr("last", lastErr).Msg("no backend relayed")
+	if lastErr == nil {
+		mfh.reflectorResponse(w, r, http.StatusServiceUnavailable, errNoBackend)
+		return
+	}
+	mfh.reflectorResponse(w, r, http.StatusBadGateway, lastErr)
+}
+
+// hijackedConn reads what the http server has buffered before the conn.
+type hijackedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (hc hijackedConn) Read(p []byte) (int, error) {
+	return hc.reader.Read(p)
+}
+
+func (hc hijackedConn) CloseWrite() error {
+	if cw, ok := hc.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return hc.Conn.Close()
+}
+
+// responseStream is the downstream of a HTTP/2 or HTTP/3 CONNECT, it ends
+// with the handler.
+type responseStream struct {
+	r *http.Request
+	w http.ResponseWriter
+}
+
+func (rs responseStream) Read(p []byte) (int, error) {
+	return rs.r.Body.Read(p)
+}
+
+func (rs responseStream) Write(p []byte) (int, error) {
+	n, err := rs.w.Write(p)
+	rs.w.(http.Flusher).Flush()
+	return n, err
+}
+
+func (rs responseStream) Close() error {
+	return rs.r.Body.Close()
+}
+
+func (mfh muxFrontendHandler) relay(w http.ResponseWriter, r *http.Request, network string, conn quic.Connection, stream quic.Stream) {
+	upstream := utils.RelayStream{Stream: stream}
+	if r.ProtoMajor == 3 && network == "udp" {
+		// the capsules travel in DATA frames, the datagrams on the connection
+		var conn3 quic.Connection
+		hijacker, ok := w.(http3.Hijacker)
+		if ok {
+			conn3, ok = hijacker.StreamCreator().(quic.Connection)
+		}
+		streamID, sok := r.Body.(interface{ StreamID() quic.StreamID })
+		if !ok || !sok {
+			upstream.Close()
+			mfh.reflectorResponse(w, r, http.StatusInternalServerError, fmt.Errorf("no QUIC connection to relay datagrams"))
+			return
+		}
+		w.Header().Set("Capsule-Protocol", "?1")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		utils.RelayDatagrams(
+			utils.NewDatagramStream(conn3, responseStream{r: r, w: w}, streamID.StreamID()),
+			utils.NewDatagramStream(conn, upstream, stream.StreamID()))
+		return
+	}
+	if r.ProtoMajor == 1 {
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			upstream.Close()
+			mfh.reflectorResponse(w, r, http.StatusInternalServerError, fmt.Errorf("can not hijack the connection"))
+			return
+		}
+		c, brw, err := hijacker.Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		_, err = c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		if err != nil {
+			c.Close()
+			upstream.Close()
+			return
+		}
+		utils.Relay(hijackedConn{Conn: c, reader: brw.Reader}, upstream)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	utils.Relay(responseStream{r: r, w: w}, upstream)
+}
@@ -0,0 +1,287 @@
+package frontend
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/http3"
+	"github.com/lucas-clemente/quic-go/quicvarint"
+	"github.com/mabels/h123-reflector/backend"
+	"github.com/mabels/h123-reflector/reflector"
+	"github.com/mabels/h123-reflector/utils"
+)
+
+func Test_ConnectTarget(t *testing.T) {
+	tests := []struct {
+		req     *http.Request
+		network string
+		address string
+	}{
+		{&http.Request{Proto: "HTTP/1.1", ProtoMajor: 1, Host: "example.com:443"}, "tcp", "example.com:443"},
+		{&http.Request{Proto: "connect-udp", ProtoMajor: 3, URL: &url.URL{Path: "/.well-known/masque/udp/192.0.2.6/443/"}}, "udp", "192.0.2.6:443"},
+		{&http.Request{Proto: "connect-udp", ProtoMajor: 3, URL: &url.URL{Path: "/.well-known/masque/udp/2001:db8::42/53/"}}, "udp", "[2001:db8::42]:53"},
+		{&http.Request{Proto: "connect-udp", ProtoMajor: 3, URL: &url.URL{Path: "/.well-known/masque/udp/host/"}}, "", ""},
+		{&http.Request{Proto: "HTTP/1.1", ProtoMajor: 1, Host: "example.com"}, "", ""},
+		{&http.Request{Proto: "websocket", ProtoMajor: 3, Host: "example.com:443"}, "", ""},
+	}
+	for _, test := range tests {
+		network, address, err := connectTarget(test.req)
+		if test.network == "" {
+			if err == nil {
+				t.Errorf("Expected error for %s %v", test.req.Proto, test.req.URL)
+			}
+			continue
+		}
+		if err != nil || network != test.network || address != test.address {
+			t.Errorf("Expected %s:%s, got %s:%s %v", test.network, test.address, network, address, err)
+		}
+	}
+}
+
+func Test_ConnectTCP(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	fe, _ := startTunnelPair(t, FrontendConfig{
+		TunnelListen: "127.0.0.1:4606",
+		AllowConnect: true,
+	}, backend.BackendConfig{
+		MuxEndPointUrl: "https://backend.behind.nat:4705",
+		Listen:         "127.0.0.1:4705",
+		AllowConnect:   true,
+		ConnectAllow:   []backend.ConnectTarget{{Host: "127.0.0.0/8"}},
+	})
+	srv := httptest.NewServer(muxFrontendHandler{frontend: fe})
+	defer srv.Close()
+
+	c, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", echo.Addr(), echo.Addr())
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %s", resp.Status)
+	}
+	c.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(br, buf)
+	if err != nil || string(buf) != "ping" {
+		t.Errorf("Expected ping, got %s %v", string(buf), err)
+	}
+}
+
+func Test_ConnectNotAllowedByBackend(t *testing.T) {
+	fe, _ := startTunnelPair(t, FrontendConfig{
+		TunnelListen: "127.0.0.1:4607",
+		AllowConnect: true,
+	}, backend.BackendConfig{
+		MuxEndPointUrl: "https://backend.behind.nat:4706",
+		Listen:         "127.0.0.1:4706",
+	})
+	req := httptest.NewRequest("CONNECT", "127.0.0.1:9", nil)
+	w := httptest.NewRecorder()
+	muxFrontendHandler{frontend: fe}.ServeHTTP(w, req)
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("Expected 502, got %d:%s", w.Code, w.Body.String())
+	}
+}
+
+func Test_RelayUDP(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	fe, _ := startTunnelPair(t, FrontendConfig{
+		TunnelListen: "127.0.0.1:4608",
+		AllowConnect: true,
+	}, backend.BackendConfig{
+		MuxEndPointUrl: "https://backend.behind.nat:4707",
+		Listen:         "127.0.0.1:4707",
+		AllowConnect:   true,
+		ConnectAllow:   []backend.ConnectTarget{{Host: "127.0.0.0/8"}},
+	})
+	mxc := fe.muxDownStream.pick(map[*MuxConnection]bool{})
+	if mxc == nil {
+		t.Fatal("Expected a backend")
+	}
+	conn, stream, err := mxc.openRelay(context.Background(), utils.RelayRequest{
+		Network: "udp",
+		Address: echo.LocalAddr().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := utils.NewDatagramStream(conn, utils.RelayStream{Stream: stream}, stream.StreamID())
+	defer ds.Close()
+	err = ds.WriteDatagram([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := ds.ReadDatagram()
+	if err != nil || string(p) != "ping" {
+		t.Errorf("Expected ping, got %s %v", string(p), err)
+	}
+}
+
+func Test_ConnectHTTP3(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	echoUDP, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoUDP.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echoUDP.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echoUDP.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	fe, _ := startTunnelPair(t, FrontendConfig{
+		TunnelListen: "127.0.0.1:4610",
+		AllowConnect: true,
+	}, backend.BackendConfig{
+		MuxEndPointUrl: "https://backend.behind.nat:4710",
+		Listen:         "127.0.0.1:4710",
+		AllowConnect:   true,
+		ConnectAllow:   []backend.ConnectTarget{{Host: "127.0.0.0/8"}},
+	})
+	opts := &reflector.ServerOptions{}
+	connectServerOptions(opts)
+	srv := &http3.Server{
+		Addr:               "127.0.0.1:4611",
+		Handler:            muxFrontendHandler{frontend: fe},
+		EnableDatagrams:    opts.EnableDatagrams,
+		AdditionalSettings: opts.AdditionalSettings,
+	}
+	go srv.ListenAndServeTLS(fe.Config.CertFile, fe.Config.KeyFile)
+	defer srv.Close()
+	time.Sleep(50 * time.Millisecond)
+	roundTripper := &http3.RoundTripper{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	defer roundTripper.Close()
+
+	// the response and request bodies carry the bytes of the tunnel
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Scheme: "https", Host: srv.Addr},
+		Host:   echo.Addr().String(),
+		Header: http.Header{},
+		Body:   pr,
+	}
+	resp, err := roundTripper.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %s", resp.Status)
+	}
+	pw.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(resp.Body, buf)
+	if err != nil || string(buf) != "ping" {
+		t.Errorf("Expected ping, got %s %v", string(buf), err)
+	}
+
+	// without datagrams on the connection CONNECT-UDP falls back to capsules
+	upr, upw := io.Pipe()
+	defer upw.Close()
+	host, port, _ := net.SplitHostPort(echoUDP.LocalAddr().String())
+	req = &http.Request{
+		Method: http.MethodConnect,
+		Proto:  "connect-udp",
+		URL:    &url.URL{Scheme: "https", Host: srv.Addr, Path: masqueUDPPrefix + host + "/" + port + "/"},
+		Host:   srv.Addr,
+		Header: http.Header{"Capsule-Protocol": {"?1"}},
+		Body:   upr,
+	}
+	resp, err = roundTripper.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Capsule-Protocol") != "?1" {
+		t.Fatalf("Expected 200 with capsules, got %s %v", resp.Status, resp.Header)
+	}
+	capsule := &bytes.Buffer{}
+	quicvarint.Write(capsule, 0) // DATAGRAM
+	quicvarint.Write(capsule, 5)
+	capsule.Write([]byte("\x00ping"))
+	upw.Write(capsule.Bytes())
+	r := quicvarint.NewReader(resp.Body)
+	capsuleType, err := quicvarint.Read(r)
+	if err != nil || capsuleType != 0 {
+		t.Fatalf("Expected a DATAGRAM capsule, got %d %v", capsuleType, err)
+	}
+	l, _ := quicvarint.Read(r)
+	payload := make([]byte, l)
+	_, err = io.ReadFull(resp.Body, payload)
+	if err != nil || string(payload) != "\x00ping" {
+		t.Errorf("Expected ping, got %q %v", string(payload), err)
+	}
+}
@@ -1,67 +1,191 @@
 package frontend
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
+	"os"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/lucas-clemente/quic-go"
 	"github.com/lucas-clemente/quic-go/http3"
+	"github.com/mabels/h123-reflector/accesslog"
+	"github.com/mabels/h123-reflector/admin"
+	"github.com/mabels/h123-reflector/certs"
+	"github.com/mabels/h123-reflector/compression"
+	"github.com/mabels/h123-reflector/metrics"
 	"github.com/mabels/h123-reflector/models"
+	"github.com/mabels/h123-reflector/quicdebug"
+	"github.com/mabels/h123-reflector/reflector"
+	"github.com/mabels/h123-reflector/tracing"
 	"github.com/mabels/h123-reflector/utils"
 )
 
 type FrontendConfig struct {
+	Name           string // sent to the backends as X-H123-Frontend, default host name and Listen
 	BrokerUrl      string
 	BackendTopic   *string
+	StatusTopic    *string       // of the FrontendStatus, default h123/frontend/<Listen>/status
+	RefreshFreq    time.Duration // of the FrontendStatus, default 1s
 	ReclaimFreq    time.Duration
 	Listen         string
+	CertFile       string
+	KeyFile        string
+	CertDir        string             // more certificates chosen by SNI, all are reloaded on change
+	DevCA          *certs.DevCAConfig // creates CertFile and KeyFile if they are missing
 	MaxBackends    int
 	BackendQuicCfg quic.Config
+	BackendQuic    utils.QuicConfig // applied to BackendQuicCfg
+	ListenQuic     utils.QuicConfig
 	MqttCfg        mqtt.ClientOptions
+	Retry          RetryConfig
+	Circuit        utils.CircuitConfig
+	HealthCheck    HealthCheckConfig
+	Locality       LocalityConfig
+	// reverse tunnels, backends dial TunnelEndPointUrl which is served on TunnelListen
+	TunnelListen      string
+	TunnelEndPointUrl string
+	TunnelTopic       *string
+	// tunnels prove their MuxEndPointUrl with the shared TunnelToken and/or
+	// a client certificate of TunnelClientCAs naming its host, one is needed
+	TunnelToken     string
+	TunnelClientCAs *x509.CertPool
+	// accept CONNECT and CONNECT-UDP and relay them through the backends
+	AllowConnect  bool
+	MetricsListen string
+	Log           *utils.Logger
+	AccessLog     *accesslog.Config // no access log if nil
+	Tracing       *tracing.Config   // no spans if nil
+	Admin         *admin.Config     // no admin listener if nil
+	RateLimit     utils.RateLimitConfig
+	Compression   *compression.Config // responses as they are if nil
+	QuicDebug     *quicdebug.Config   // qlog and TLS key log, SSLKEYLOGFILE works without
+	debug         *quicdebug.Debugger // of QuicDebug, set by NewFrontend
+	// SessionCache are the TLS sessions of the backends kept to resume and
+	// send GETs in 0-RTT, default 64, negative disables
+	SessionCache int
+	sessionCache tls.ClientSessionCache
 }
 
 type BackendConnection struct {
-	http *http.Client
+	http         *http.Client
+	roundTripper *http3.RoundTripper
+	connMutex    sync.Mutex
+	conn         quic.Connection // the last one dialed, relays are opened on it
 }
 
-func (bc *BackendConnection) Close() {
+func (bc *BackendConnection) setConnection(conn quic.Connection) {
+	bc.connMutex.Lock()
+	bc.conn = conn
+	bc.connMutex.Unlock()
+}
 
+func (bc *BackendConnection) quicConnection() quic.Connection {
+	bc.connMutex.Lock()
+	defer bc.connMutex.Unlock()
+	return bc.conn
+}
+
+func (bc *BackendConnection) Close() {
+	if bc == nil || bc.roundTripper == nil {
+		return
+	}
+	bc.roundTripper.Close()
 }
 
 type MuxConnection struct {
-	state         models.ServerStatus
-	connection    *BackendConnection
-	MuxDownStream *MuxDownStream
+	muxEndPointUrl string
+	state          models.ServerStatus
+	connection     *BackendConnection
+	tunnel         bool // the backend dials us
+	drained        bool // by the admin
+	circuit        *utils.CircuitBreaker
+	health         healthState
+	requests       uint64 // forwarded
+	current        int    // of the weighted round robin, guarded by pickMutex
+	MuxDownStream  *MuxDownStream
+}
+
+func (mxc *MuxConnection) Circuit() models.CircuitStatus {
+	return mxc.circuit.Status()
+}
+
+func (mxc *MuxConnection) Health() models.HealthStatus {
+	return mxc.health.status()
 }
 
 type MuxDownStream struct {
 	Config           *FrontendConfig
-	toStop           bool
+	toStop           int32
 	updateMutex      sync.Mutex
 	updated          map[string]models.ServerStatus
+	activeMutex      sync.RWMutex
 	active           map[string]*MuxConnection
+	tunnels          map[string]*BackendConnection
+	pickMutex        sync.Mutex
+	requests         uint64 // received
 	connectToBackend chan *MuxConnection
+	retryBudget      *retryBudget
+	metrics          *metrics.Registry
+	connectFailures  *metrics.Counter
+	handshakes       *metrics.Counter
+	rateLimit        *utils.RateLimiter
+	limited          *metrics.Counter
+	log              *utils.Logger
 }
 
-func NewMuxDownStream(cfg *FrontendConfig) *MuxDownStream {
+func NewMuxDownStream(cfg *FrontendConfig, regs ...*metrics.Registry) *MuxDownStream {
 	if cfg.ReclaimFreq == 0 {
 		cfg.ReclaimFreq = time.Second
 	}
 	if cfg.MaxBackends == 0 {
 		cfg.MaxBackends = 64
 	}
-	return &MuxDownStream{
+	if cfg.SessionCache == 0 {
+		cfg.SessionCache = 64
+	}
+	if cfg.SessionCache > 0 && cfg.sessionCache == nil {
+		cfg.sessionCache = tls.NewLRUClientSessionCache(cfg.SessionCache)
+	}
+	cfg.Retry.setDefaults()
+	cfg.HealthCheck.setDefaults()
+	cfg.Locality.setDefaults()
+	if cfg.Log == nil {
+		cfg.Log = utils.NewLogger()
+	}
+	reg := metrics.NewRegistry("frontend")
+	if len(regs) > 0 && regs[0] != nil {
+		reg = regs[0]
+	}
+	mds := &MuxDownStream{
 		Config:           cfg,
 		updated:          map[string]models.ServerStatus{},
 		active:           map[string]*MuxConnection{},
+		tunnels:          map[string]*BackendConnection{},
 		connectToBackend: make(chan *MuxConnection, cfg.MaxBackends),
+		retryBudget:      newRetryBudget(&cfg.Retry),
+		metrics:          reg,
+		connectFailures:  reg.Counter("h123_frontend_backend_connect_failures_total", "Failed connects to backends."),
+		handshakes:       reg.Counter("h123_frontend_backend_handshakes_total", "Connects to backends by handshake, full, resumed or 0rtt.", "kind"),
+		rateLimit:        utils.NewRateLimiter(cfg.RateLimit),
+		limited:          reg.Counter("h123_frontend_limited_total", "Requests queued or rejected by a limit.", "limit", "outcome"),
+		log:              cfg.Log.Component("mux"),
 	}
+	reg.GaugeFunc("h123_frontend_backends", "Known backends.", func() float64 {
+		mds.activeMutex.RLock()
+		defer mds.activeMutex.RUnlock()
+		return float64(len(mds.active))
+	})
+	return mds
 }
 
 func (mds *MuxDownStream) updateState(state *models.ServerStatus) {
@@ -72,102 +196,263 @@ func (mds *MuxDownStream) updateState(state *models.ServerStatus) {
 
 func (mds *MuxDownStream) stop() {
 	mds.connectToBackend <- nil
-	mds.toStop = true
+	atomic.StoreInt32(&mds.toStop, 1)
+}
+
+func (mds *MuxDownStream) stopped() bool {
+	return atomic.LoadInt32(&mds.toStop) != 0
 }
 
-func NewBackendConnection(cfg *FrontendConfig, mxc *MuxConnection) (*http.Client, error) {
-	roundTripper := &http3.RoundTripper{
-		QuicConfig: &cfg.BackendQuicCfg,
+func NewBackendConnection(cfg *FrontendConfig, muxEndPointUrl string) (*BackendConnection, error) {
+	client := &BackendConnection{}
+	client.roundTripper = &http3.RoundTripper{
+		QuicConfig:      &cfg.BackendQuicCfg,
+		TLSClientConfig: cfg.debug.TLSConfig(&tls.Config{ClientSessionCache: cfg.sessionCache}),
+		EnableDatagrams: true,
 	}
-	defer roundTripper.Close()
-	client := &http.Client{
-		Transport: roundTripper,
+	utils.RedialOnClose(client.roundTripper, func(conn quic.EarlyConnection) {
+		client.setConnection(conn)
+	})
+	client.http = &http.Client{Transport: client.roundTripper}
+	err := client.verify(muxEndPointUrl)
+	if err != nil {
+		client.Close()
+		return nil, err
 	}
-	resp, err := client.Get(mxc.state.MuxEndPointUrl)
+	return client, nil
+}
+
+func (bc *BackendConnection) verify(muxEndPointUrl string) error {
+	// a resumed connection sends it before the handshake completes
+	req, err := http.NewRequest(http3.MethodGet0RTT, muxEndPointUrl, nil)
 	if err != nil {
-		return client, err
+		return err
 	}
-	if resp.StatusCode != 200 {
-		return client, fmt.Errorf("Returned %s: %s", mxc.state.MuxEndPointUrl, resp.Status)
+	resp, err := bc.http.Do(req)
+	if err != nil {
+		return err
 	}
 	defer resp.Body.Close()
+	// the mux endpoint answers a bare request with a reflector response
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("Returned %s: %s", muxEndPointUrl, resp.Status)
+	}
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return client, err
+		return err
 	}
 	res := models.ReflectorResponse{}
 	json.Unmarshal(body, &res)
 	if res.Protocol != "HTTP/3.0" {
-		return client, fmt.Errorf("Expected HTTP/3.0: %s", string(body))
+		return fmt.Errorf("Expected HTTP/3.0: %s", string(body))
 	}
-	if res.MuxEndPointUrl != mxc.state.MuxEndPointUrl {
-		return client, fmt.Errorf("Expected %s == %s", res.MuxEndPointUrl, mxc.state.MuxEndPointUrl)
+	if res.MuxEndPointUrl != muxEndPointUrl {
+		return fmt.Errorf("Expected %s == %s", res.MuxEndPointUrl, muxEndPointUrl)
 	}
-	return client, nil
+	return nil
 }
 
 func (mds *MuxDownStream) start() {
 	go func() {
-		for !(mds.toStop) {
-			updateState := make([]models.ServerStatus, 0, len(mds.updated))
+		for !mds.stopped() {
 			mds.updateMutex.Lock()
+			updateState := make([]models.ServerStatus, 0, len(mds.updated))
 			for _, state := range mds.updated {
 				updateState = append(updateState, state)
 			}
 			mds.updated = map[string]models.ServerStatus{}
 			mds.updateMutex.Unlock()
 
+			connect := []*MuxConnection{}
+			mds.activeMutex.Lock()
 			for _, state := range updateState {
 				mxc, found := mds.active[state.MuxEndPointUrl]
 				if !found {
 					// fmt.Printf("New backend %s\n", state.MuxEndPointUrl)
-					mxc = &MuxConnection{state: state, MuxDownStream: mds}
+					mxc = &MuxConnection{
+						muxEndPointUrl: state.MuxEndPointUrl,
+						state:          state,
+						tunnel:         state.Tunnel,
+						circuit:        utils.NewCircuitBreaker(mds.Config.Circuit),
+						MuxDownStream:  mds,
+					}
 					mds.active[state.MuxEndPointUrl] = mxc
-					mds.connectToBackend <- mxc
+					connect = append(connect, mxc)
 				}
 				mxc.state = state
 			}
 			now := time.Now()
 			for _, mxc := range mds.active {
-				if mxc.state.Status != "online" ||
+				// draining backends keep their connection for the in-flight requests
+				if (mxc.state.Status != "online" && mxc.state.Status != "draining") ||
 					mxc.state.Now.Add(mds.Config.ReclaimFreq*2).Before(now) {
-					fmt.Printf("Removing %s\n", mxc.state.MuxEndPointUrl)
+					mds.log.Info().Str("mux", mxc.muxEndPointUrl).Str("status", mxc.state.Status).Msg("removing backend")
 					mxc.connection.Close()
 					delete(mds.active, mxc.state.MuxEndPointUrl)
+					if mds.tunnels[mxc.muxEndPointUrl] == mxc.connection {
+						delete(mds.tunnels, mxc.muxEndPointUrl)
+					}
 				}
 			}
+			mds.activeMutex.Unlock()
+			for _, mxc := range connect {
+				mds.connectToBackend <- mxc
+			}
 			time.Sleep(mds.Config.ReclaimFreq)
 		}
+		mds.activeMutex.Lock()
 		for _, mxc := range mds.active {
 			mxc.connection.Close()
 		}
+		mds.activeMutex.Unlock()
 	}()
 	go func() {
-		for !(mds.toStop) {
+		for !mds.stopped() {
+			time.Sleep(mds.Config.HealthCheck.Interval)
+			mds.checkHealth()
+		}
+	}()
+	go func() {
+		for !mds.stopped() {
 			mxc := <-mds.connectToBackend
 			if mxc == nil {
 				break
 			}
-			fmt.Printf("Connecting to %s:%s\n", mxc.MuxDownStream.Config.Listen, mxc.state.MuxEndPointUrl)
-			connection, err := NewBackendConnection(mds.Config, mxc)
+			if mxc.tunnel {
+				mds.useTunnel(mxc)
+				continue
+			}
+			muxEndPointUrl := mxc.muxEndPointUrl
+			mds.log.Info().Str("mux", muxEndPointUrl).Msg("connecting to backend")
+			connection, err := NewBackendConnection(mds.Config, muxEndPointUrl)
 			if err != nil {
-				log.Printf("Error connecting to backend: %s", err)
+				mds.connectFailures.Inc()
+				mds.log.Error().Str("mux", muxEndPointUrl).Err(err).Msg("connecting to backend failed")
 				continue
 			}
-			mxc.connection = &BackendConnection{http: connection}
+			if conn := connection.quicConnection(); conn != nil {
+				go func() { mds.handshakes.Inc(utils.HandshakeKind(conn)) }()
+			}
+			mds.activeMutex.Lock()
+			if mds.active[muxEndPointUrl] == mxc {
+				mxc.connection = connection
+			} else {
+				// removed while we were connecting
+				connection.Close()
+			}
+			mds.activeMutex.Unlock()
 		}
 	}()
 }
 
+// defaultWeight is the share of backends which announce none.
+const defaultWeight = 100
+
+func (mxc *MuxConnection) weight() int {
+	if mxc.state.Weight != nil {
+		return *mxc.state.Weight
+	}
+	return defaultWeight
+}
+
+// pick returns the next connected backend in smooth weighted round robin
+// order which is not in tried, not saturated and not ejected, or nil if
+// there is none left. The Locality decides which backends are used first.
+func (mds *MuxDownStream) pick(tried map[*MuxConnection]bool) *MuxConnection {
+	mds.activeMutex.RLock()
+	defer mds.activeMutex.RUnlock()
+	locality := &mds.Config.Locality
+	candidates := make([]*MuxConnection, 0, len(mds.active))
+	for _, mxc := range mds.active {
+		if mxc.connection == nil || tried[mxc] || mxc.drained || mxc.state.Saturated || mxc.weight() == 0 ||
+			mxc.state.Status != "online" || !mxc.health.isHealthy() || !locality.matches(mxc) {
+			continue
+		}
+		candidates = append(candidates, mxc)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].muxEndPointUrl < candidates[j].muxEndPointUrl
+	})
+	groups := locality.groups(candidates)
+	mds.pickMutex.Lock()
+	defer mds.pickMutex.Unlock()
+	now := time.Now()
+	for len(groups) > 0 {
+		n := 1
+		for n < len(groups) && groupLoad(groups[0]) >= locality.OverflowLoad {
+			// overflow while the groups in use are loaded
+			groups[0] = append(groups[0], groups[n]...)
+			n++
+		}
+		if mxc := weighted(groups[0], now); mxc != nil {
+			return mxc
+		}
+		groups = groups[n:]
+	}
+	return nil
+}
+
+// weighted picks by smooth weighted round robin from candidates, an
+// ejected one is skipped and sits out the round.
+func weighted(candidates []*MuxConnection, now time.Time) *MuxConnection {
+	total := 0
+	for _, mxc := range candidates {
+		mxc.current += mxc.weight()
+		total += mxc.weight()
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].current > candidates[j].current
+	})
+	for _, mxc := range candidates {
+		if mxc.circuit.Allow(now) {
+			mxc.current -= total
+			return mxc
+		}
+		mxc.current -= mxc.weight()
+		total -= mxc.weight()
+	}
+	return nil
+}
+
 type Frontend struct {
-	Config        FrontendConfig
-	Mqtt          utils.MqttConnection
-	muxDownStream *MuxDownStream
+	Config         FrontendConfig
+	Mqtt           utils.MqttConnection
+	muxDownStream  *MuxDownStream
+	servers        sync.WaitGroup
+	stopServers    func()
+	tunnelListener quic.EarlyListener
+	Metrics        *metrics.Registry
+	metricsServer  *http.Server
+	accessLog      *accesslog.Logger
+	tracing        *tracing.Tracing
+	certs          *certs.Manager
+	compression    *compression.Compressor
+	admin          *admin.Server
+	log            *utils.Logger
 }
 
 func (fe *Frontend) Stop() {
 	fe.Mqtt.Stop()
 	fe.muxDownStream.stop()
+	if fe.stopServers != nil {
+		fe.stopServers()
+	}
+	if fe.metricsServer != nil {
+		fe.metricsServer.Close()
+	}
+	if fe.accessLog != nil {
+		fe.accessLog.Close()
+	}
+	if fe.admin != nil {
+		fe.admin.Close()
+	}
+	if fe.certs != nil {
+		fe.certs.Close()
+	}
+	fe.Config.debug.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	fe.tracing.Shutdown(ctx)
 }
 
 func (fe *Frontend) Setup() error {
@@ -179,7 +464,7 @@ func (fe *Frontend) receiveBackendTopic() func(client mqtt.Client, msg mqtt.Mess
 		state := models.ServerStatus{}
 		err := json.Unmarshal(msg.Payload(), &state)
 		if err != nil {
-			log.Println(err)
+			fe.log.Warn().Str("topic", msg.Topic()).Err(err).Msg("invalid backend status")
 			return
 		}
 		fe.muxDownStream.updateState(&state)
@@ -192,37 +477,122 @@ func NewFrontend(config FrontendConfig) (*Frontend, error) {
 		return nil, err
 	}
 	fe := Frontend{
-		Config: config,
-		Mqtt:   *mqtt,
+		Config:  config,
+		Mqtt:    *mqtt,
+		Metrics: metrics.NewRegistry("frontend"),
+	}
+	if fe.Config.Name == "" {
+		host, _ := os.Hostname()
+		fe.Config.Name = host + "/" + fe.Config.Listen
+	}
+	if fe.Config.StatusTopic == nil {
+		my := fmt.Sprintf("h123/frontend/%s/status", fe.Config.Listen)
+		my = strings.ReplaceAll(my, ":", "_")
+		fe.Config.StatusTopic = &my
+	}
+	if fe.Config.RefreshFreq == 0 {
+		fe.Config.RefreshFreq = time.Second
+	}
+	err = fe.Config.Locality.validate()
+	if err != nil {
+		return nil, err
+	}
+	backendQuic, err := fe.Config.BackendQuic.Apply(&fe.Config.BackendQuicCfg)
+	if err != nil {
+		return nil, fmt.Errorf("backend: %w", err)
+	}
+	fe.Config.BackendQuicCfg = *backendQuic
+	if _, err := fe.Config.ListenQuic.Apply(nil); err != nil {
+		return nil, fmt.Errorf("listen: %w", err)
+	}
+	if fe.Config.MetricsListen != "" {
+		fe.Config.BackendQuicCfg.Tracer = metrics.AddTracer(fe.Config.BackendQuicCfg.Tracer, fe.Metrics.QuicTracer())
+	}
+	fe.Config.debug, err = quicdebug.New(fe.Config.QuicDebug, "frontend", fe.Config.Log)
+	if err != nil {
+		return nil, err
+	}
+	fe.Config.debug.AddTracer(&fe.Config.BackendQuicCfg)
+	fe.muxDownStream = NewMuxDownStream(&fe.Config, fe.Metrics)
+	fe.log = fe.Config.Log.Component("frontend")
+	fe.Mqtt.Log = fe.Config.Log.Component("mqtt")
+	if fe.Config.AccessLog != nil {
+		fe.accessLog, err = accesslog.New(fe.Config.AccessLog)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if fe.Config.Tracing != nil {
+		fe.tracing, err = tracing.New(fe.Config.Tracing, "frontend")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if fe.Config.CertFile != "" || fe.Config.CertDir != "" || fe.Config.DevCA != nil {
+		fe.certs, err = certs.New(certs.Config{
+			CertFile: fe.Config.CertFile,
+			KeyFile:  fe.Config.KeyFile,
+			Dir:      fe.Config.CertDir,
+			DevCA:    fe.Config.DevCA.WithHosts(certs.ListenHosts(fe.Config.Listen, fe.Config.TunnelListen)...),
+		}, fe.Config.Log)
+		if err != nil {
+			return nil, err
+		}
+	}
+	fe.compression, err = compression.New(fe.Config.Compression)
+	if err != nil {
+		return nil, err
+	}
+	if fe.Config.Admin != nil {
+		fe.admin, err = admin.New(fe.Config.Admin, fe.Config.Log)
+		if err != nil {
+			return nil, err
+		}
+		fe.adminRoutes(fe.admin)
+		fe.Config.debug.Routes(fe.admin)
 	}
-	fe.muxDownStream = NewMuxDownStream(&fe.Config)
 	return &fe, nil
 }
 
 func (fe *Frontend) Start() error {
+	err := fe.Mqtt.Connect()
+	if err != nil {
+		return err
+	}
 	fe.muxDownStream.start()
+	if fe.Config.MetricsListen != "" {
+		fe.metricsServer = fe.Metrics.Serve(fe.Config.MetricsListen, fe.log)
+	}
+	if fe.admin != nil {
+		err = fe.admin.Start()
+		if err != nil {
+			return err
+		}
+	}
+	if fe.certs != nil {
+		fe.certs.Start()
+		opts := &reflector.ServerOptions{Metrics: fe.Metrics, Log: fe.log, Certs: fe.certs, Quic: fe.Config.ListenQuic, Debug: fe.Config.debug}
+		if fe.Config.AllowConnect {
+			connectServerOptions(opts)
+		}
+		fe.stopServers = reflector.Start(&fe.servers, fe.Config.Listen,
+			fe.Config.CertFile, fe.Config.KeyFile,
+			accesslog.Handler(fe.accessLog, "frontend",
+				compression.Handler(fe.compression,
+					tracing.Handler(fe.tracing, "frontend.request", muxFrontendHandler{frontend: fe}))), opts)
+	}
 
 	if fe.Config.BackendTopic == nil {
 		my := "h123/backend/#"
 		fe.Config.BackendTopic = &my
 	}
-	err := fe.Mqtt.Subscribe(*fe.Config.BackendTopic, fe.receiveBackendTopic())
+	err = fe.Mqtt.Subscribe(*fe.Config.BackendTopic, fe.receiveBackendTopic())
 	if err != nil {
 		return err
 	}
+	fe.publishStatus()
+	if fe.Config.TunnelListen != "" {
+		return fe.startTunnels()
+	}
 	return nil
 }
-
-// type muxFrontendHandler struct {
-// }
-
-// func (_ muxFrontendHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-// 	out, _ := json.MarshalIndent(Response{
-// 		Protocol: r.Proto,
-// 		Url:      r.URL.String(),
-// 		Header:   r.Header,
-// 	}, "", "  ")
-// 	w.Header().Add("Content-Type", "application/json")
-// 	w.WriteHeader(200)
-// 	w.Write(out)
-// }
@@ -52,3 +52,35 @@ func Test_FrontendBackendConnect(t *testing.T) {
 	}
 	time.Sleep(2 * time.Second)
 }
+
+func Test_PickWeighted(t *testing.T) {
+	fe, closer := testFrontend(failingBackend, failingBackend, failingBackend, failingBackend)
+	defer closer()
+	weights := []int{300, 100, 100, 0}
+	backends := fe.muxDownStream.Backends()
+	for i, info := range backends {
+		mxc := fe.muxDownStream.active[info.MuxEndPointUrl]
+		mxc.state.Weight = &weights[i]
+	}
+	fe.muxDownStream.active[backends[1].MuxEndPointUrl].state.Saturated = true
+	picked := map[string]int{}
+	for i := 0; i < 400; i++ {
+		picked[fe.muxDownStream.pick(nil).muxEndPointUrl]++
+	}
+	if picked[backends[0].MuxEndPointUrl] != 300 || picked[backends[2].MuxEndPointUrl] != 100 || len(picked) != 2 {
+		t.Errorf("Expected the requests by weight and none to the saturated and the weight 0 backend, got %v", picked)
+	}
+	// an ejected backend sits out without shifting the shares of the others
+	ejected := fe.muxDownStream.active[backends[0].MuxEndPointUrl]
+	for i := 0; i < 5; i++ {
+		ejected.circuit.Failure(time.Now())
+	}
+	fe.muxDownStream.active[backends[1].MuxEndPointUrl].state.Saturated = false
+	picked = map[string]int{}
+	for i := 0; i < 400; i++ {
+		picked[fe.muxDownStream.pick(nil).muxEndPointUrl]++
+	}
+	if picked[backends[1].MuxEndPointUrl] != 200 || picked[backends[2].MuxEndPointUrl] != 200 || ejected.current > *ejected.state.Weight {
+		t.Errorf("Expected the requests shared by the others, got %v and %d for the ejected", picked, ejected.current)
+	}
+}
@@ -0,0 +1,171 @@
+package frontend
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/mabels/h123-reflector/models"
+)
+
+type HealthCheckConfig struct {
+	Path               string
+	Header             http.Header // e.g. X-H123-Backend-Host to check through to an upstream
+	ExpectedStatus     int
+	Timeout            time.Duration
+	Interval           time.Duration
+	HealthyThreshold   int // successes in a row to become healthy
+	UnhealthyThreshold int // failures in a row to become unhealthy
+}
+
+func (hc *HealthCheckConfig) setDefaults() {
+	if hc.Path == "" {
+		hc.Path = "/h123/health"
+	}
+	if hc.ExpectedStatus == 0 {
+		hc.ExpectedStatus = http.StatusOK
+	}
+	if hc.Timeout == 0 {
+		hc.Timeout = 2 * time.Second
+	}
+	if hc.Interval == 0 {
+		hc.Interval = 5 * time.Second
+	}
+	if hc.HealthyThreshold == 0 {
+		hc.HealthyThreshold = 2
+	}
+	if hc.UnhealthyThreshold == 0 {
+		hc.UnhealthyThreshold = 3
+	}
+}
+
+type healthState struct {
+	mutex     sync.Mutex
+	unhealthy bool // a connected backend starts healthy
+	successes int
+	failures  int
+	lastCheck time.Time
+	lastError string
+	rtt       time.Duration // smoothed like TCP, 0 before the first success
+}
+
+func (hs *healthState) isHealthy() bool {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+	return !hs.unhealthy
+}
+
+// record returns true if the health changed.
+func (hs *healthState) record(cfg *HealthCheckConfig, now time.Time, err error) bool {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+	hs.lastCheck = now
+	if err != nil {
+		hs.lastError = err.Error()
+		hs.successes = 0
+		hs.failures++
+		if !hs.unhealthy && hs.failures >= cfg.UnhealthyThreshold {
+			hs.unhealthy = true
+			return true
+		}
+		return false
+	}
+	hs.lastError = ""
+	hs.failures = 0
+	hs.successes++
+	if hs.unhealthy && hs.successes >= cfg.HealthyThreshold {
+		hs.unhealthy = false
+		return true
+	}
+	return false
+}
+
+// observe adds the round trip of a successful health check.
+func (hs *healthState) observe(rtt time.Duration) {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+	if hs.rtt == 0 {
+		hs.rtt = rtt
+		return
+	}
+	hs.rtt = (7*hs.rtt + rtt) / 8
+}
+
+func (hs *healthState) smoothedRTT() time.Duration {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+	return hs.rtt
+}
+
+func (hs *healthState) status() models.HealthStatus {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+	ret := models.HealthStatus{
+		Healthy:   !hs.unhealthy,
+		LastCheck: hs.lastCheck,
+		LastError: hs.lastError,
+	}
+	if hs.rtt > 0 {
+		ret.RTT = hs.rtt.String()
+	}
+	return ret
+}
+
+func checkHealth(client *http.Client, muxEndPointUrl string, cfg *HealthCheckConfig) error {
+	u, err := url.Parse(muxEndPointUrl)
+	if err != nil {
+		return err
+	}
+	u.Path = path.Join(u.Path, cfg.Path)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	for k, vs := range cfg.Header {
+		req.Header[k] = vs
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != cfg.ExpectedStatus {
+		return fmt.Errorf("health check %s: %s", u.String(), resp.Status)
+	}
+	return nil
+}
+
+func (mds *MuxDownStream) checkHealth() {
+	mds.activeMutex.RLock()
+	checks := make(map[*MuxConnection]*BackendConnection, len(mds.active))
+	for _, mxc := range mds.active {
+		if mxc.connection != nil {
+			checks[mxc] = mxc.connection
+		}
+	}
+	mds.activeMutex.RUnlock()
+	wg := sync.WaitGroup{}
+	for mxc, connection := range checks {
+		wg.Add(1)
+		go func(mxc *MuxConnection, connection *BackendConnection) {
+			defer wg.Done()
+			start := time.Now()
+			err := checkHealth(connection.http, mxc.muxEndPointUrl, &mds.Config.HealthCheck)
+			if err == nil {
+				mxc.health.observe(time.Since(start))
+			}
+			if mxc.health.record(&mds.Config.HealthCheck, time.Now(), err) {
+				mds.log.Info().Str("mux", mxc.muxEndPointUrl).Bool("healthy", err == nil).AnErr("check", err).Msg("health changed")
+			}
+		}(mxc, connection)
+	}
+	wg.Wait()
+}
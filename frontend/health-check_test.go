@@ -0,0 +1,68 @@
+package frontend
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_HealthStateThresholds(t *testing.T) {
+	cfg := HealthCheckConfig{HealthyThreshold: 2, UnhealthyThreshold: 2}
+	cfg.setDefaults()
+	hs := healthState{}
+	now := time.Now()
+	fail := fmt.Errorf("failed")
+	if hs.record(&cfg, now, fail) || !hs.isHealthy() {
+		t.Error("Expected healthy after one failure")
+	}
+	if !hs.record(&cfg, now, fail) || hs.isHealthy() {
+		t.Error("Expected unhealthy after two failures")
+	}
+	if hs.status().LastError != "failed" {
+		t.Error("Expected last error, got ", hs.status().LastError)
+	}
+	if hs.record(&cfg, now, nil) || hs.isHealthy() {
+		t.Error("Expected unhealthy after one success")
+	}
+	if !hs.record(&cfg, now, nil) || !hs.isHealthy() {
+		t.Error("Expected healthy after two successes")
+	}
+	if hs.status().RTT != "" {
+		t.Error("Expected no RTT before a check, got ", hs.status().RTT)
+	}
+	hs.observe(8 * time.Millisecond)
+	hs.observe(16 * time.Millisecond)
+	if hs.status().RTT != "9ms" {
+		t.Error("Expected the smoothed RTT, got ", hs.status().RTT)
+	}
+}
+
+func Test_HealthCheckRemovesBackend(t *testing.T) {
+	failing := int32(0)
+	check := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/h123/health" && atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}
+	fe, closer := testFrontend(check)
+	defer closer()
+	fe.Config.HealthCheck.UnhealthyThreshold = 1
+	fe.Config.HealthCheck.HealthyThreshold = 1
+	mds := fe.muxDownStream
+	mds.checkHealth()
+	if mds.pick(map[*MuxConnection]bool{}) == nil {
+		t.Error("Expected healthy backend")
+	}
+	atomic.StoreInt32(&failing, 1)
+	mds.checkHealth()
+	if mds.pick(map[*MuxConnection]bool{}) != nil {
+		t.Error("Expected no healthy backend")
+	}
+	atomic.StoreInt32(&failing, 0)
+	mds.checkHealth()
+	if mds.pick(map[*MuxConnection]bool{}) == nil {
+		t.Error("Expected healthy backend again")
+	}
+}
@@ -0,0 +1,126 @@
+package frontend
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// LocalityConfig prefers nearby backends. Backends are grouped by
+// priority, the best group gets the requests until its load passes
+// OverflowLoad, then the next one is added. A group without usable
+// backend fails over to the next.
+type LocalityConfig struct {
+	// "" treats all backends alike, "zone" prefers the own Zone, then the
+	// Failover zones in order, then the own Region, "rtt" prefers the
+	// backends with the lowest health check RTT
+	Policy       string
+	Region       string
+	Zone         string
+	Failover     []string
+	Labels       map[string]string // backends need all of them
+	OverflowLoad float64           // of a group, default 0.8
+	RTTTolerance float64           // above the lowest RTT which still counts as near, default 0.5
+}
+
+func (lc *LocalityConfig) setDefaults() {
+	if lc.OverflowLoad == 0 {
+		lc.OverflowLoad = 0.8
+	}
+	if lc.RTTTolerance == 0 {
+		lc.RTTTolerance = 0.5
+	}
+}
+
+func (lc *LocalityConfig) validate() error {
+	switch lc.Policy {
+	case "", "zone", "rtt":
+	default:
+		return fmt.Errorf("unknown locality policy %q", lc.Policy)
+	}
+	if lc.OverflowLoad < 0 || lc.RTTTolerance < 0 {
+		return fmt.Errorf("negative locality thresholds")
+	}
+	return nil
+}
+
+// matches tells if mxc has all Labels.
+func (lc *LocalityConfig) matches(mxc *MuxConnection) bool {
+	for k, v := range lc.Labels {
+		if mxc.state.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (lc *LocalityConfig) zonePriority(mxc *MuxConnection) int {
+	if lc.Zone != "" && mxc.state.Zone == lc.Zone {
+		return 0
+	}
+	for i, zone := range lc.Failover {
+		if mxc.state.Zone == zone {
+			return 1 + i
+		}
+	}
+	if lc.Region != "" && mxc.state.Region == lc.Region {
+		return 1 + len(lc.Failover)
+	}
+	return 2 + len(lc.Failover)
+}
+
+// groups sorts candidates into groups by priority, the best first.
+func (lc *LocalityConfig) groups(candidates []*MuxConnection) [][]*MuxConnection {
+	priority := func(mxc *MuxConnection) int { return 0 }
+	switch lc.Policy {
+	case "zone":
+		priority = lc.zonePriority
+	case "rtt":
+		lowest := time.Duration(0)
+		for _, mxc := range candidates {
+			if rtt := mxc.health.smoothedRTT(); rtt > 0 && (lowest == 0 || rtt < lowest) {
+				lowest = rtt
+			}
+		}
+		near := time.Duration(float64(lowest) * (1 + lc.RTTTolerance))
+		// backends without RTT yet count as near
+		priority = func(mxc *MuxConnection) int {
+			if mxc.health.smoothedRTT() <= near {
+				return 0
+			}
+			return 1
+		}
+	}
+	byPriority := map[int][]*MuxConnection{}
+	priorities := []int{}
+	for _, mxc := range candidates {
+		p := priority(mxc)
+		if _, found := byPriority[p]; !found {
+			priorities = append(priorities, p)
+		}
+		byPriority[p] = append(byPriority[p], mxc)
+	}
+	sort.Ints(priorities)
+	ret := make([][]*MuxConnection, 0, len(priorities))
+	for _, p := range priorities {
+		ret = append(ret, byPriority[p])
+	}
+	return ret
+}
+
+// load is the share of MaxConcurrentStreams in use, or the load average
+// per CPU of backends without limit.
+func (mxc *MuxConnection) load() float64 {
+	if mxc.state.MaxConcurrentStreams > 0 {
+		return float64(mxc.state.ActiveStreams) / float64(mxc.state.MaxConcurrentStreams)
+	}
+	return mxc.state.Load
+}
+
+func groupLoad(group []*MuxConnection) float64 {
+	sum := 0.0
+	for _, mxc := range group {
+		sum += mxc.load()
+	}
+	return sum / float64(len(group))
+}
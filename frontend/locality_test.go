@@ -0,0 +1,71 @@
+package frontend
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_LocalityZone(t *testing.T) {
+	fe, closer := testFrontend(failingBackend, failingBackend, failingBackend, failingBackend)
+	defer closer()
+	mds := fe.muxDownStream
+	mds.Config.Locality = LocalityConfig{Policy: "zone", Region: "eu", Zone: "eu-1", Failover: []string{"us-1"}, Labels: map[string]string{"tier": "web"}}
+	mds.Config.Locality.setDefaults()
+	backends := mds.Backends()
+	for i, zone := range []string{"eu-1", "us-1", "eu-2", "eu-1"} {
+		mxc := mds.active[backends[i].MuxEndPointUrl]
+		mxc.state.Zone = zone
+		mxc.state.Region = zone[:2]
+		mxc.state.Labels = map[string]string{"tier": "web"}
+		mxc.state.MaxConcurrentStreams = 10
+	}
+	// the other eu-1 backend lacks the label
+	mds.active[backends[3].MuxEndPointUrl].state.Labels = nil
+	picks := func() map[int]int {
+		ret := map[int]int{}
+		for i := 0; i < 12; i++ {
+			mxc := mds.pick(nil)
+			for j, info := range backends {
+				if mxc != nil && info.MuxEndPointUrl == mxc.muxEndPointUrl {
+					ret[j]++
+				}
+			}
+		}
+		return ret
+	}
+	if got := picks(); got[0] != 12 {
+		t.Errorf("Expected the own zone only, got %v", got)
+	}
+	mds.active[backends[0].MuxEndPointUrl].state.ActiveStreams = 9
+	if got := picks(); got[0] != 6 || got[1] != 6 {
+		t.Errorf("Expected overflow to the failover zone, got %v", got)
+	}
+	mds.active[backends[0].MuxEndPointUrl].state.Saturated = true
+	mds.active[backends[1].MuxEndPointUrl].drained = true
+	if got := picks(); got[2] != 12 {
+		t.Errorf("Expected the own region after the failover zones, got %v", got)
+	}
+}
+
+func Test_LocalityRTT(t *testing.T) {
+	fe, closer := testFrontend(failingBackend, failingBackend, failingBackend)
+	defer closer()
+	mds := fe.muxDownStream
+	mds.Config.Locality = LocalityConfig{Policy: "rtt"}
+	mds.Config.Locality.setDefaults()
+	backends := mds.Backends()
+	for i, rtt := range []time.Duration{20 * time.Millisecond, 2 * time.Millisecond, 3 * time.Millisecond} {
+		mds.active[backends[i].MuxEndPointUrl].health.observe(rtt)
+	}
+	for i := 0; i < 10; i++ {
+		if mxc := mds.pick(nil); mxc.muxEndPointUrl == backends[0].MuxEndPointUrl {
+			t.Fatal("Expected the backends with low RTT")
+		}
+	}
+	if mds.pick(map[*MuxConnection]bool{mds.active[backends[1].MuxEndPointUrl]: true, mds.active[backends[2].MuxEndPointUrl]: true}) == nil {
+		t.Error("Expected fail over to the far backend")
+	}
+	if (&LocalityConfig{Policy: "nearest"}).validate() == nil {
+		t.Error("Expected an error for an unknown policy")
+	}
+}
@@ -0,0 +1,248 @@
+package frontend
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mabels/h123-reflector/accesslog"
+	"github.com/mabels/h123-reflector/metrics"
+	"github.com/mabels/h123-reflector/models"
+	"github.com/mabels/h123-reflector/tracing"
+	"github.com/mabels/h123-reflector/utils"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var errNoBackend = fmt.Errorf("no backend available")
+
+const (
+	muxKey     = attribute.Key("h123.mux")
+	attemptKey = attribute.Key("h123.attempt")
+)
+
+type muxFrontendHandler struct {
+	frontend *Frontend
+}
+
+func (mxc *MuxConnection) forward(r *http.Request, header http.Header, body io.Reader) (*http.Response, error) {
+	mxc.MuxDownStream.activeMutex.RLock()
+	connection := mxc.connection
+	mxc.MuxDownStream.activeMutex.RUnlock()
+	if connection == nil {
+		mxc.circuit.Release()
+		return nil, fmt.Errorf("backend %s not connected", mxc.muxEndPointUrl)
+	}
+	atomic.AddUint64(&mxc.requests, 1)
+	req, err := utils.NewMuxRequest(r.Context(), mxc.muxEndPointUrl, r, header, body, mxc.MuxDownStream.Config.sessionCache != nil)
+	if err != nil {
+		mxc.circuit.Release()
+		return nil, err
+	}
+	resp, err := connection.http.Do(req)
+	// only transport errors count against the backend, a failing
+	// upstream must not eject a healthy backend
+	if err != nil {
+		mxc.circuit.Failure(time.Now())
+		return nil, err
+	}
+	mxc.circuit.Success(time.Now())
+	return utils.MuxResponse(resp)
+}
+
+// clientHeader is a copy of the client request header without the
+// X-H123 control headers, only the upstream and the txn may be chosen.
+func clientHeader(in http.Header) http.Header {
+	header := in.Clone()
+	for name := range header {
+		if strings.HasPrefix(name, "X-H123-") && name != "X-H123-Backend-Host" && name != "X-H123-Txn" {
+			header.Del(name)
+		}
+	}
+	return header
+}
+
+func (mfh muxFrontendHandler) reflectorResponse(w http.ResponseWriter, r *http.Request, status int, err error) {
+	var errStr *string
+	if err != nil {
+		my := err.Error()
+		errStr = &my
+	}
+	tlsState := utils.ConnState(w, r)
+	out, _ := json.MarshalIndent(models.ReflectorResponse{
+		RemoteAddr: r.RemoteAddr,
+		Protocol:   r.Proto,
+		Url:        r.URL.String(),
+		Header:     r.Header,
+		Method:     r.Method,
+		Error:      errStr,
+		Resumed:    tlsState.Resumed,
+		EarlyData:  tlsState.EarlyData,
+	}, "", "  ")
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(out)
+}
+
+// limit waits for the rate limit of the request, it answers requests
+// over the limit with 429 and returns false.
+func (mfh muxFrontendHandler) limit(w http.ResponseWriter, r *http.Request) bool {
+	mds := mfh.frontend.muxDownStream
+	if mds.rateLimit == nil {
+		return true
+	}
+	upstream := r.Header.Get("X-H123-Backend-Host")
+	if upstream == "" {
+		upstream = "https://" + r.Host
+	}
+	queued, err := mds.rateLimit.Wait(r.Context(), mds.rateLimit.RequestKey(r, upstream))
+	if queued {
+		mds.limited.Inc("rate", "queued")
+	}
+	if err == nil {
+		return true
+	}
+	var lerr *utils.LimitedError
+	if errors.As(err, &lerr) {
+		mds.limited.Inc("rate", "rejected")
+		w.Header().Set("Retry-After", strconv.Itoa(lerr.RetryAfterSeconds()))
+		mfh.reflectorResponse(w, r, http.StatusTooManyRequests, err)
+		return false
+	}
+	// the client is gone
+	mfh.reflectorResponse(w, r, http.StatusServiceUnavailable, err)
+	return false
+}
+
+func (mfh muxFrontendHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint64(&mfh.frontend.muxDownStream.requests, 1)
+	if !mfh.limit(w, r) {
+		return
+	}
+	if r.Method == http.MethodConnect {
+		mfh.serveConnect(w, r)
+		return
+	}
+	mds := mfh.frontend.muxDownStream
+	cfg := &mfh.frontend.Config.Retry
+
+	header := clientHeader(r.Header)
+	if header.Get("X-H123-Backend-Host") == "" {
+		header.Set("X-H123-Backend-Host", "https://"+r.Host)
+	}
+	if header.Get("X-H123-Txn") == "" {
+		header.Set("X-H123-Txn", uuid.New().String())
+	}
+	header.Set("X-H123-Frontend", mfh.frontend.Config.Name)
+	if upstream, err := url.Parse(header.Get("X-H123-Backend-Host")); err == nil {
+		metrics.SetUpstream(r.Context(), upstream.Host)
+	}
+
+	log := mds.log.With("txn", header.Get("X-H123-Txn")).With("upstream", header.Get("X-H123-Backend-Host"))
+	entry := accesslog.FromContext(r.Context())
+	if entry != nil {
+		entry.Txn = header.Get("X-H123-Txn")
+		entry.Upstream = header.Get("X-H123-Backend-Host")
+	}
+	trace.SpanFromContext(r.Context()).SetAttributes(tracing.TxnKey.String(header.Get("X-H123-Txn")))
+	tracer := mfh.frontend.tracing
+	retryable := utils.Retryable(r.Method, r.Header)
+	var buffered []byte
+	var stream io.Reader = r.Body
+	if retryable && r.Body != nil {
+		var err error
+		buffered, err = io.ReadAll(io.LimitReader(r.Body, cfg.MaxBodyBytes+1))
+		if err != nil {
+			mfh.reflectorResponse(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if int64(len(buffered)) > cfg.MaxBodyBytes {
+			// too large to replay, send it once
+			retryable = false
+			stream = io.MultiReader(bytes.NewReader(buffered), r.Body)
+		}
+	}
+
+	mds.retryBudget.request(time.Now())
+	tried := map[*MuxConnection]bool{}
+	attempts := 0
+	var lastErr error
+	for attempts < cfg.MaxAttempts {
+		if attempts > 0 {
+			if !retryable || !mds.retryBudget.withdraw(time.Now()) {
+				break
+			}
+			time.Sleep(cfg.backoff(attempts))
+		}
+		_, selectSpan := tracer.Start(r.Context(), "frontend.select_backend")
+		mxc := mds.pick(tried)
+		if mxc == nil {
+			selectSpan.End()
+			break
+		}
+		selectSpan.SetAttributes(muxKey.String(mxc.muxEndPointUrl))
+		selectSpan.End()
+		tried[mxc] = true
+		attempts++
+		body := stream
+		if retryable {
+			body = bytes.NewReader(buffered)
+		}
+		start := time.Now()
+		ctx, forwardSpan := tracer.Start(r.Context(), "frontend.forward", trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(muxKey.String(mxc.muxEndPointUrl), attemptKey.Int(attempts),
+				tracing.TxnKey.String(header.Get("X-H123-Txn"))))
+		tracer.Inject(ctx, propagation.HeaderCarrier(header))
+		resp, err := mxc.forward(r.WithContext(ctx), header, body)
+		tracing.EndClientSpan(forwardSpan, resp, err)
+		if err != nil {
+			log.Warn().Str("mux", mxc.muxEndPointUrl).Int("attempt", attempts).Err(err).Msg("forward failed")
+			lastErr = err
+			continue
+		}
+		defer resp.Body.Close()
+		if entry != nil {
+			entry.Backend = mxc.muxEndPointUrl
+			entry.OutProto = resp.Proto
+			entry.Attempts = attempts
+			entry.AddTiming("backend", time.Since(start))
+			if d, ok := accesslog.ParseServerTiming(resp.Header, "upstream"); ok {
+				entry.AddTiming("upstream", d)
+			}
+		}
+		for k, vs := range resp.Header {
+			for _, v := range vs {
+				w.Header().Add(k, v)
+			}
+		}
+		w.Header().Set("X-H123-Attempts", strconv.Itoa(attempts))
+		w.WriteHeader(resp.StatusCode)
+		_, err = io.Copy(w, resp.Body)
+		if err != nil {
+			log.Warn().Str("mux", mxc.muxEndPointUrl).Int("status", resp.StatusCode).Err(err).Msg("response aborted")
+			return
+		}
+		log.Debug().Str("mux", mxc.muxEndPointUrl).Int("status", resp.StatusCode).Int("attempts", attempts).Msg("forwarded")
+		return
+	}
+	w.Header().Set("X-H123-Attempts", strconv.Itoa(attempts))
+	if entry != nil {
+		entry.Attempts = attempts
+	}
+	log.Error().Int("attempts", attempts).AnErr("last", lastErr).Msg("no backend answered")
+	if lastErr == nil {
+		mfh.reflectorResponse(w, r, http.StatusServiceUnavailable, errNoBackend)
+		return
+	}
+	mfh.reflectorResponse(w, r, http.StatusBadGateway, lastErr)
+}
@@ -0,0 +1,125 @@
+package frontend
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+type RetryConfig struct {
+	MaxAttempts         int // including the first attempt
+	BudgetPercent       float64
+	MinRetriesPerSecond int
+	BudgetWindow        time.Duration
+	BackoffBase         time.Duration
+	BackoffMax          time.Duration
+	MaxBodyBytes        int64 // bodies above this size are not buffered and not retried
+}
+
+func (rc *RetryConfig) setDefaults() {
+	if rc.MaxAttempts == 0 {
+		rc.MaxAttempts = 3
+	}
+	if rc.BudgetPercent == 0 {
+		rc.BudgetPercent = 20
+	}
+	if rc.MinRetriesPerSecond == 0 {
+		rc.MinRetriesPerSecond = 3
+	}
+	if rc.BudgetWindow == 0 {
+		rc.BudgetWindow = 10 * time.Second
+	}
+	if rc.BackoffBase == 0 {
+		rc.BackoffBase = 25 * time.Millisecond
+	}
+	if rc.BackoffMax == 0 {
+		rc.BackoffMax = time.Second
+	}
+	if rc.MaxBodyBytes == 0 {
+		rc.MaxBodyBytes = 64 * 1024
+	}
+}
+
+// backoff returns the exponential backoff with full jitter before the
+// given retry (starting with 1).
+func (rc *RetryConfig) backoff(retry int) time.Duration {
+	ceil := rc.BackoffBase
+	for i := 1; i < retry && ceil < rc.BackoffMax; i++ {
+		ceil *= 2
+	}
+	if ceil > rc.BackoffMax {
+		ceil = rc.BackoffMax
+	}
+	if ceil <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceil)))
+}
+
+type budgetBucket struct {
+	second   int64
+	requests uint64
+	retries  uint64
+}
+
+// retryBudget allows retries up to a percentage of the requests seen
+// within the window, but at least MinRetriesPerSecond.
+type retryBudget struct {
+	cfg     *RetryConfig
+	mutex   sync.Mutex
+	buckets []budgetBucket
+}
+
+func newRetryBudget(cfg *RetryConfig) *retryBudget {
+	size := int(cfg.BudgetWindow / time.Second)
+	if size < 1 {
+		size = 1
+	}
+	return &retryBudget{
+		cfg:     cfg,
+		buckets: make([]budgetBucket, size),
+	}
+}
+
+func (rb *retryBudget) bucket(now time.Time) *budgetBucket {
+	sec := now.Unix()
+	b := &rb.buckets[sec%int64(len(rb.buckets))]
+	if b.second != sec {
+		*b = budgetBucket{second: sec}
+	}
+	return b
+}
+
+func (rb *retryBudget) sum(now time.Time) (requests uint64, retries uint64) {
+	oldest := now.Unix() - int64(len(rb.buckets))
+	for _, b := range rb.buckets {
+		if b.second > oldest {
+			requests += b.requests
+			retries += b.retries
+		}
+	}
+	return requests, retries
+}
+
+func (rb *retryBudget) request(now time.Time) {
+	rb.mutex.Lock()
+	rb.bucket(now).requests++
+	rb.mutex.Unlock()
+}
+
+// withdraw reserves a retry, it returns false if the budget is exhausted.
+func (rb *retryBudget) withdraw(now time.Time) bool {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+	requests, retries := rb.sum(now)
+	allowed := float64(requests) * rb.cfg.BudgetPercent / 100
+	minAllowed := float64(rb.cfg.MinRetriesPerSecond * len(rb.buckets))
+	if allowed < minAllowed {
+		allowed = minAllowed
+	}
+	if float64(retries+1) > allowed {
+		return false
+	}
+	rb.bucket(now).retries++
+	return true
+}
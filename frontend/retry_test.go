@@ -0,0 +1,190 @@
+package frontend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mabels/h123-reflector/models"
+	"github.com/mabels/h123-reflector/utils"
+)
+
+func Test_RetryBackoff(t *testing.T) {
+	cfg := RetryConfig{BackoffBase: 10 * time.Millisecond, BackoffMax: 50 * time.Millisecond}
+	cfg.setDefaults()
+	for i := 0; i < 100; i++ {
+		for retry := 1; retry < 10; retry++ {
+			d := cfg.backoff(retry)
+			if d < 0 || d >= cfg.BackoffMax {
+				t.Errorf("Expected backoff below %s, got %s", cfg.BackoffMax, d)
+			}
+			if retry == 1 && d >= cfg.BackoffBase {
+				t.Errorf("Expected first backoff below %s, got %s", cfg.BackoffBase, d)
+			}
+		}
+	}
+}
+
+func Test_RetryBudget(t *testing.T) {
+	cfg := RetryConfig{BudgetPercent: 10, MinRetriesPerSecond: 1, BudgetWindow: 2 * time.Second}
+	cfg.setDefaults()
+	rb := newRetryBudget(&cfg)
+	now := time.Unix(1000, 0)
+	// the minimum allows one retry per second of the window
+	if !rb.withdraw(now) || !rb.withdraw(now) {
+		t.Error("Expected minimum retries")
+	}
+	if rb.withdraw(now) {
+		t.Error("Expected exhausted budget")
+	}
+	for i := 0; i < 100; i++ {
+		rb.request(now)
+	}
+	withdrawn := 0
+	for rb.withdraw(now) {
+		withdrawn++
+	}
+	if withdrawn != 8 {
+		t.Errorf("Expected 8 more retries, got %d", withdrawn)
+	}
+	// the window moved on
+	if !rb.withdraw(now.Add(3 * time.Second)) {
+		t.Error("Expected budget to recover")
+	}
+}
+
+func testFrontend(handlers ...http.HandlerFunc) (*Frontend, func()) {
+	fe := &Frontend{}
+	fe.muxDownStream = NewMuxDownStream(&fe.Config)
+	servers := []*httptest.Server{}
+	for _, h := range handlers {
+		srv := httptest.NewServer(h)
+		servers = append(servers, srv)
+		fe.muxDownStream.active[srv.URL] = &MuxConnection{
+			muxEndPointUrl: srv.URL,
+			state:          models.ServerStatus{Status: "online", MuxEndPointUrl: srv.URL},
+			connection:     &BackendConnection{http: srv.Client()},
+			circuit:        utils.NewCircuitBreaker(fe.Config.Circuit),
+			MuxDownStream:  fe.muxDownStream,
+		}
+	}
+	return fe, func() {
+		for _, srv := range servers {
+			srv.Close()
+		}
+	}
+}
+
+func failingBackend(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-H123-Error", "upstream down")
+	w.WriteHeader(http.StatusInternalServerError)
+}
+
+func Test_MuxHandlerRetries(t *testing.T) {
+	fe, closer := testFrontend(failingBackend, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-H123-Txn") == "" {
+			t.Error("Expected X-H123-Txn")
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	})
+	defer closer()
+	for i := 0; i < 4; i++ {
+		w := httptest.NewRecorder()
+		muxFrontendHandler{frontend: fe}.ServeHTTP(w, httptest.NewRequest("PUT", "/path", strings.NewReader("body")))
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected 200, got %d", w.Code)
+		}
+		attempts := w.Header().Get("X-H123-Attempts")
+		if attempts != "1" && attempts != "2" {
+			t.Errorf("Expected 1 or 2 attempts, got %s", attempts)
+		}
+	}
+	state := fe.Status()
+	forwarded := uint64(0)
+	for _, backend := range state.Backends {
+		forwarded += backend.Requests
+	}
+	if state.Requests != 4 || len(state.Backends) != 2 || forwarded < 4 {
+		t.Errorf("Expected 4 requests in the status, got %+v", state)
+	}
+	if _, found := state.Quic["backend"]; !found {
+		t.Errorf("Expected the QUIC parameters in the status, got %v", state.Quic)
+	}
+}
+
+func Test_MuxHandlerNoRetry(t *testing.T) {
+	fe, closer := testFrontend(failingBackend, failingBackend)
+	defer closer()
+	w := httptest.NewRecorder()
+	muxFrontendHandler{frontend: fe}.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader("body")))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("Expected 502, got %d", w.Code)
+	}
+	if w.Header().Get("X-H123-Attempts") != "1" {
+		t.Errorf("Expected 1 attempt, got %s", w.Header().Get("X-H123-Attempts"))
+	}
+	w = httptest.NewRecorder()
+	muxFrontendHandler{frontend: fe}.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Header().Get("X-H123-Attempts") != "2" {
+		t.Errorf("Expected 2 attempts, got %s", w.Header().Get("X-H123-Attempts"))
+	}
+}
+
+func Test_MuxHandlerStripsControlHeaders(t *testing.T) {
+	fe, closer := testFrontend(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-H123-Uplink-Close") != "" || r.Header.Get("X-H123-Tunnel-Challenge") != "" {
+			t.Errorf("Expected the control headers stripped, got %v", r.Header)
+		}
+		if r.Header.Get("X-H123-Txn") != "txn1" || r.Header.Get("X-H123-Frontend") == "spoofed" {
+			t.Errorf("Expected the txn and the frontend name, got %v", r.Header)
+		}
+	})
+	defer closer()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-H123-Uplink-Close", "true")
+	r.Header.Set("X-H123-Tunnel-Challenge", "challenge")
+	r.Header.Set("X-H123-Frontend", "spoofed")
+	r.Header.Set("X-H123-Txn", "txn1")
+	w := httptest.NewRecorder()
+	muxFrontendHandler{frontend: fe}.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected 200, got %d", w.Code)
+	}
+}
+
+func Test_MuxHandlerRateLimit(t *testing.T) {
+	fe, closer := testFrontend(func(w http.ResponseWriter, r *http.Request) {})
+	defer closer()
+	fe.muxDownStream.rateLimit = utils.NewRateLimiter(utils.RateLimitConfig{Rate: 1})
+	for i, expected := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		muxFrontendHandler{frontend: fe}.ServeHTTP(w, httptest.NewRequest("GET", "/path", nil))
+		if w.Code != expected {
+			t.Errorf("Expected %d for request %d, got %d", expected, i, w.Code)
+		}
+	}
+}
+
+func Test_ForwardReleasesProbe(t *testing.T) {
+	fe, closer := testFrontend()
+	defer closer()
+	mxc := &MuxConnection{
+		muxEndPointUrl: "https://127.0.0.1:1",
+		circuit:        utils.NewCircuitBreaker(utils.CircuitConfig{ConsecutiveErrors: 1, BaseEjection: time.Millisecond}),
+		MuxDownStream:  fe.muxDownStream,
+	}
+	mxc.circuit.Failure(time.Now())
+	time.Sleep(2 * time.Millisecond)
+	if !mxc.circuit.Allow(time.Now()) {
+		t.Fatal("Expected a half-open probe")
+	}
+	if _, err := mxc.forward(httptest.NewRequest("GET", "/", nil), http.Header{}, nil); err == nil {
+		t.Fatal("Expected an error without connection")
+	}
+	if !mxc.circuit.Allow(time.Now()) {
+		t.Error("Expected the unsent probe to be released")
+	}
+}
@@ -0,0 +1,92 @@
+package frontend
+
+import (
+	"encoding/json"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/mabels/h123-reflector/models"
+	"github.com/mabels/h123-reflector/utils"
+)
+
+func (mds *MuxDownStream) backendStatus() []models.FrontendBackend {
+	mds.activeMutex.RLock()
+	defer mds.activeMutex.RUnlock()
+	ret := make([]models.FrontendBackend, 0, len(mds.active))
+	for _, mxc := range mds.active {
+		ret = append(ret, models.FrontendBackend{
+			MuxEndPointUrl: mxc.muxEndPointUrl,
+			Connected:      mxc.connection != nil,
+			Tunnel:         mxc.tunnel,
+			Drained:        mxc.drained,
+			Circuit:        mxc.Circuit().State,
+			Health:         mxc.Health(),
+			Requests:       atomic.LoadUint64(&mxc.requests),
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].MuxEndPointUrl < ret[j].MuxEndPointUrl })
+	return ret
+}
+
+// QuicStatus are the effective QUIC parameters by endpoint.
+func (fe *Frontend) QuicStatus() map[string]models.QuicStatus {
+	listen, _ := fe.Config.ListenQuic.Apply(nil)
+	return map[string]models.QuicStatus{
+		"listen":  utils.QuicStatus(listen),
+		"backend": utils.QuicStatus(&fe.Config.BackendQuicCfg),
+	}
+}
+
+// Status is the FrontendStatus without RequestRate and Loop, they are
+// set by the publisher.
+func (fe *Frontend) Status() models.FrontendStatus {
+	state := models.FrontendStatus{
+		Name:              fe.Config.Name,
+		Status:            "online",
+		Now:               time.Now(),
+		Listen:            fe.Config.Listen,
+		Region:            fe.Config.Locality.Region,
+		Zone:              fe.Config.Locality.Zone,
+		TunnelEndPointUrl: fe.Config.TunnelEndPointUrl,
+		Quic:              fe.QuicStatus(),
+		Backends:          fe.muxDownStream.backendStatus(),
+		Requests:          atomic.LoadUint64(&fe.muxDownStream.requests),
+	}
+	if fe.certs != nil {
+		state.Protocols = []string{"HTTP/1.1", "HTTP/2", "HTTP/3"}
+	}
+	return state
+}
+
+func (fe *Frontend) publish(state *models.FrontendStatus) {
+	out, err := json.Marshal(state)
+	if err != nil {
+		fe.log.Fatal().Err(err).Msg("marshal status")
+	}
+	err = fe.Mqtt.Publish(*fe.Config.StatusTopic, 1, false, out)
+	if err != nil {
+		fe.log.Warn().Str("topic", *fe.Config.StatusTopic).Err(err).Msg("publish status")
+	}
+}
+
+// publishStatus announces the frontend every RefreshFreq and offline
+// when it stops.
+func (fe *Frontend) publishStatus() {
+	go func() {
+		last := fe.Status()
+		for c := 0; !fe.muxDownStream.stopped(); c++ {
+			state := fe.Status()
+			if elapsed := state.Now.Sub(last.Now).Seconds(); elapsed > 0 {
+				state.RequestRate = float64(state.Requests-last.Requests) / elapsed
+			}
+			state.Loop = c
+			fe.publish(&state)
+			last = state
+			time.Sleep(fe.Config.RefreshFreq)
+		}
+		state := fe.Status()
+		state.Status = "offline"
+		fe.publish(&state)
+	}()
+}
@@ -0,0 +1,243 @@
+package frontend
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/http3"
+	"github.com/mabels/h123-reflector/models"
+	"github.com/mabels/h123-reflector/utils"
+)
+
+var errTunnelClosed = errors.New("tunnel closed")
+
+// tunnelTransport sends all requests to the one connection of a tunnel,
+// a second host would open a second HTTP/3 client on the same connection.
+type tunnelTransport struct {
+	roundTripper *http3.RoundTripper
+}
+
+func (tt tunnelTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	my := req.Clone(req.Context())
+	my.URL.Host = utils.TunnelHost
+	my.Host = ""
+	return tt.roundTripper.RoundTrip(my)
+}
+
+func newTunnelConnection(cfg *FrontendConfig, conn quic.EarlyConnection) *BackendConnection {
+	roundTripper := &http3.RoundTripper{
+		QuicConfig:      &cfg.BackendQuicCfg,
+		EnableDatagrams: true,
+		Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, qcfg *quic.Config) (quic.EarlyConnection, error) {
+			if conn.Context().Err() != nil {
+				return nil, errTunnelClosed
+			}
+			return conn, nil
+		},
+	}
+	return &BackendConnection{
+		http:         &http.Client{Transport: tunnelTransport{roundTripper: roundTripper}},
+		roundTripper: roundTripper,
+		conn:         conn,
+	}
+}
+
+// identify asks the backend on the other end of a tunnel for its
+// MuxEndPointUrl and checks it proves it with TunnelToken and its client
+// certificate.
+func (bc *BackendConnection) identify(cfg *FrontendConfig) (string, error) {
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	challenge := hex.EncodeToString(nonce)
+	req, err := http.NewRequest("GET", "https://"+utils.TunnelHost+cfg.HealthCheck.Path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-H123-Tunnel-Challenge", challenge)
+	resp, err := bc.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	res := models.ReflectorResponse{}
+	err = json.Unmarshal(body, &res)
+	if err != nil {
+		return "", err
+	}
+	if res.MuxEndPointUrl == "" {
+		return "", fmt.Errorf("tunnel without MuxEndPointUrl: %s", string(body))
+	}
+	if cfg.TunnelToken != "" {
+		proof := utils.TunnelProof(cfg.TunnelToken, challenge, res.MuxEndPointUrl)
+		if !hmac.Equal([]byte(proof), []byte(resp.Header.Get("X-H123-Tunnel-Proof"))) {
+			return "", fmt.Errorf("tunnel of %s without valid token", res.MuxEndPointUrl)
+		}
+	}
+	if cfg.TunnelClientCAs != nil {
+		u, err := url.Parse(res.MuxEndPointUrl)
+		if err != nil {
+			return "", err
+		}
+		// the TLS handshake verified the chain already
+		peers := bc.conn.ConnectionState().TLS.PeerCertificates
+		if len(peers) == 0 {
+			return "", fmt.Errorf("tunnel of %s without client certificate", res.MuxEndPointUrl)
+		}
+		err = peers[0].VerifyHostname(u.Hostname())
+		if err != nil {
+			return "", err
+		}
+	}
+	return res.MuxEndPointUrl, nil
+}
+
+// announcedTunnel tells if a backend announced muxEndPointUrl as tunnel.
+func (mds *MuxDownStream) announcedTunnel(muxEndPointUrl string) bool {
+	mds.updateMutex.Lock()
+	state, found := mds.updated[muxEndPointUrl]
+	mds.updateMutex.Unlock()
+	if found {
+		return state.Tunnel && state.Status == "online"
+	}
+	mds.activeMutex.RLock()
+	defer mds.activeMutex.RUnlock()
+	mxc, found := mds.active[muxEndPointUrl]
+	return found && mxc.tunnel
+}
+
+func (mds *MuxDownStream) acceptTunnel(conn quic.EarlyConnection) {
+	bc := newTunnelConnection(mds.Config, conn)
+	muxEndPointUrl, err := bc.identify(mds.Config)
+	if err == nil && !mds.announcedTunnel(muxEndPointUrl) {
+		err = fmt.Errorf("%s is not announced as tunnel", muxEndPointUrl)
+	}
+	if err != nil {
+		mds.connectFailures.Inc()
+		mds.log.Error().Str("remote", conn.RemoteAddr().String()).Err(err).Msg("identifying tunnel failed")
+		bc.Close()
+		return
+	}
+	mds.log.Info().Str("remote", conn.RemoteAddr().String()).Str("mux", muxEndPointUrl).Msg("tunnel connected")
+	mds.addTunnel(muxEndPointUrl, bc)
+	<-conn.Context().Done()
+	mds.removeTunnel(muxEndPointUrl, bc)
+}
+
+func (mds *MuxDownStream) addTunnel(muxEndPointUrl string, bc *BackendConnection) {
+	mds.activeMutex.Lock()
+	defer mds.activeMutex.Unlock()
+	if prev, found := mds.tunnels[muxEndPointUrl]; found {
+		prev.Close()
+	}
+	mds.tunnels[muxEndPointUrl] = bc
+	if mxc, found := mds.active[muxEndPointUrl]; found && mxc.tunnel {
+		mxc.connection = bc
+	}
+}
+
+func (mds *MuxDownStream) removeTunnel(muxEndPointUrl string, bc *BackendConnection) {
+	mds.activeMutex.Lock()
+	defer mds.activeMutex.Unlock()
+	if mds.tunnels[muxEndPointUrl] == bc {
+		delete(mds.tunnels, muxEndPointUrl)
+	}
+	if mxc, found := mds.active[muxEndPointUrl]; found && mxc.connection == bc {
+		mxc.connection = nil
+	}
+}
+
+// useTunnel connects mxc to the tunnel of its backend if it is already there.
+func (mds *MuxDownStream) useTunnel(mxc *MuxConnection) {
+	mds.activeMutex.Lock()
+	defer mds.activeMutex.Unlock()
+	if bc, found := mds.tunnels[mxc.muxEndPointUrl]; found && mds.active[mxc.muxEndPointUrl] == mxc {
+		mxc.connection = bc
+	}
+}
+
+func (fe *Frontend) startTunnelListener() error {
+	if fe.certs == nil {
+		return fmt.Errorf("the tunnel listener needs a certificate")
+	}
+	if fe.Config.TunnelToken == "" && fe.Config.TunnelClientCAs == nil {
+		return fmt.Errorf("the tunnel listener needs TunnelToken or TunnelClientCAs")
+	}
+	quicCfg := fe.Config.BackendQuicCfg.Clone()
+	quicCfg.EnableDatagrams = true
+	tlsConfig := fe.Config.debug.TLSConfig(fe.certs.TLSConfig())
+	tlsConfig.NextProtos = []string{utils.TunnelNextProto}
+	if fe.Config.TunnelClientCAs != nil {
+		tlsConfig.ClientCAs = fe.Config.TunnelClientCAs
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	ln, err := quic.ListenAddrEarly(fe.Config.TunnelListen, tlsConfig, quicCfg)
+	if err != nil {
+		return err
+	}
+	fe.tunnelListener = ln
+	go func() {
+		for {
+			conn, err := ln.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go fe.muxDownStream.acceptTunnel(conn)
+		}
+	}()
+	return nil
+}
+
+func (fe *Frontend) publishTunnelStatus(status string) {
+	out, err := json.Marshal(models.TunnelStatus{
+		Status:            status,
+		Now:               time.Now(),
+		TunnelEndPointUrl: fe.Config.TunnelEndPointUrl,
+	})
+	if err != nil {
+		fe.log.Error().Err(err).Msg("marshal tunnel status")
+		return
+	}
+	err = fe.Mqtt.Publish(*fe.Config.TunnelTopic, 1, false, out)
+	if err != nil {
+		fe.log.Warn().Str("topic", *fe.Config.TunnelTopic).Err(err).Msg("publish tunnel status")
+	}
+}
+
+func (fe *Frontend) startTunnels() error {
+	if fe.Config.TunnelTopic == nil {
+		my := strings.ReplaceAll(fmt.Sprintf("h123/tunnel/%s", fe.Config.TunnelListen), ":", "_")
+		fe.Config.TunnelTopic = &my
+	}
+	err := fe.startTunnelListener()
+	if err != nil {
+		return err
+	}
+	go func() {
+		for !fe.Mqtt.ToStop {
+			fe.publishTunnelStatus("online")
+			time.Sleep(fe.Config.ReclaimFreq)
+		}
+		fe.publishTunnelStatus("offline")
+		fe.tunnelListener.Close()
+	}()
+	return nil
+}
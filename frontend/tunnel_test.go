@@ -0,0 +1,120 @@
+package frontend
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mabels/h123-reflector/backend"
+	"github.com/mabels/h123-reflector/certs"
+	"github.com/mabels/h123-reflector/models"
+)
+
+// startTunnelPair connects a backend through a reverse tunnel to a frontend.
+func startTunnelPair(t *testing.T, feCfg FrontendConfig, bdCfg backend.BackendConfig) (*Frontend, *backend.Backend) {
+	certFile, keyFile, err := certs.EnsureDevCA(certs.DevCAConfig{Dir: t.TempDir()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	feCfg.BrokerUrl = "mqtt://127.0.0.1:1883"
+	feCfg.ReclaimFreq = 10 * time.Millisecond
+	feCfg.CertFile = certFile
+	feCfg.KeyFile = keyFile
+	feCfg.TunnelEndPointUrl = "https://" + feCfg.TunnelListen
+	if feCfg.TunnelToken == "" {
+		feCfg.TunnelToken = "tunnel-token"
+	}
+	fe, err := NewFrontend(feCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fe.startTunnelListener()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fe.tunnelListener.Close() })
+	fe.muxDownStream.start()
+	t.Cleanup(fe.muxDownStream.stop)
+
+	bdCfg.BrokerUrl = "mqtt://127.0.0.1:1883"
+	bdCfg.Tunnel = true
+	bdCfg.TunnelTLSConfig = &tls.Config{InsecureSkipVerify: true}
+	if bdCfg.TunnelToken == "" {
+		bdCfg.TunnelToken = feCfg.TunnelToken
+	}
+	bd, err := backend.NewBackend(bdCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fe.muxDownStream.updateState(&models.ServerStatus{
+		Status:         "online",
+		Now:            time.Now().Add(time.Hour),
+		MuxEndPointUrl: bd.Config.MuxEndPointUrl,
+		Tunnel:         true,
+	})
+	bd.UpdateTunnel(&models.TunnelStatus{
+		Status:            "online",
+		TunnelEndPointUrl: fe.Config.TunnelEndPointUrl,
+	})
+	t.Cleanup(func() { bd.Srv.Close() })
+	for i := 0; i < 100 && fe.muxDownStream.pick(map[*MuxConnection]bool{}) == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fe, bd
+}
+
+func Test_ReverseTunnel(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+
+	fe, _ := startTunnelPair(t, FrontendConfig{
+		TunnelListen: "127.0.0.1:4605",
+	}, backend.BackendConfig{
+		MuxEndPointUrl: "https://backend.behind.nat:4704",
+		Listen:         "127.0.0.1:4704",
+	})
+	req := httptest.NewRequest("GET", "/path", nil)
+	req.Header.Set("X-H123-Backend-Host", upstream.URL)
+	w := httptest.NewRecorder()
+	muxFrontendHandler{frontend: fe}.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Body.String() != "upstream" {
+		t.Errorf("Expected upstream response, got %d:%s", w.Code, w.Body.String())
+	}
+}
+
+func Test_TunnelRejectsUnknownPeer(t *testing.T) {
+	fe, bd := startTunnelPair(t, FrontendConfig{
+		TunnelListen: "127.0.0.1:4609",
+	}, backend.BackendConfig{
+		MuxEndPointUrl: "https://backend.behind.nat:4708",
+		Listen:         "127.0.0.1:4708",
+		TunnelToken:    "wrong-token",
+	})
+	if fe.muxDownStream.pick(map[*MuxConnection]bool{}) != nil {
+		t.Error("Expected no tunnel with a wrong token")
+	}
+	// the right token but not announced as tunnel
+	impostor, err := backend.NewBackend(backend.BackendConfig{
+		BrokerUrl:       "mqtt://127.0.0.1:1883",
+		MuxEndPointUrl:  bd.Config.MuxEndPointUrl + "/impostor",
+		Listen:          "127.0.0.1:4709",
+		Tunnel:          true,
+		TunnelTLSConfig: &tls.Config{InsecureSkipVerify: true},
+		TunnelToken:     fe.Config.TunnelToken,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer impostor.Srv.Close()
+	impostor.UpdateTunnel(&models.TunnelStatus{Status: "online", TunnelEndPointUrl: fe.Config.TunnelEndPointUrl})
+	time.Sleep(200 * time.Millisecond)
+	fe.muxDownStream.activeMutex.RLock()
+	defer fe.muxDownStream.activeMutex.RUnlock()
+	if len(fe.muxDownStream.tunnels) != 0 {
+		t.Errorf("Expected no tunnels, got %v", fe.muxDownStream.tunnels)
+	}
+}
@@ -1,22 +1,108 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"net/http"
 	"os"
 	"sync"
 
+	"github.com/mabels/h123-reflector/admin"
+	"github.com/mabels/h123-reflector/certs"
+	"github.com/mabels/h123-reflector/quicdebug"
 	"github.com/mabels/h123-reflector/reflector"
+	"github.com/mabels/h123-reflector/utils"
 )
 
+// Config is the file given by -config, flags override its values.
+type Config struct {
+	Listen    string
+	Cert      string
+	Key       string
+	DevCA     bool // a local CA signs Cert and Key if they are missing
+	Quic      utils.QuicConfig
+	QuicDebug *quicdebug.Config // SSLKEYLOGFILE works without
+	Admin     *admin.Config     // switches QuicDebug at runtime, no admin listener if nil
+}
+
+// configFile is the value of -config, read before the other flags get
+// their defaults from the file.
+func configFile(args []string) string {
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	fs.SetOutput(nopWriter{})
+	file := fs.String("config", "", "")
+	for i := range args {
+		if fs.Parse(args[i:]) == nil && *file != "" {
+			return *file
+		}
+	}
+	return ""
+}
+
+type nopWriter struct{}
+
+func (nopWriter) Write(p []byte) (int, error) { return len(p), nil }
+
 func main() {
-	host := "localhost:3000"
-	cert := "./dev.cert"
-	key := "./dev.key"
+	log := utils.NewLogger()
+	cfg := Config{
+		Listen: "localhost:3000",
+		Cert:   "./dev.cert",
+		Key:    "./dev.key",
+	}
+	if file := configFile(os.Args[1:]); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			log.Fatal().Err(err).Msg("read config")
+		}
+		err = json.Unmarshal(data, &cfg)
+		if err != nil {
+			log.Fatal().Err(err).Str("file", file).Msg("parse config")
+		}
+	}
+	flag.String("config", "", "JSON file with Listen, Cert, Key, DevCA, Quic, QuicDebug and Admin")
+	flag.StringVar(&cfg.Listen, "listen", cfg.Listen, "listen address")
+	flag.StringVar(&cfg.Cert, "cert", cfg.Cert, "certificate file")
+	flag.StringVar(&cfg.Key, "key", cfg.Key, "key file")
+	flag.BoolVar(&cfg.DevCA, "dev-ca", cfg.DevCA, "create the certificate with a local CA in .h123-dev-ca if it is missing")
+	adminListen := flag.String("admin", "", "admin listener with /debug/quic, like :9180")
+	cfg.Quic.Flags(flag.CommandLine, "quic")
+	flag.Parse()
+	if *adminListen != "" {
+		if cfg.Admin == nil {
+			cfg.Admin = &admin.Config{}
+		}
+		cfg.Admin.Listen = *adminListen
+	}
+	if _, err := cfg.Quic.Apply(nil); err != nil {
+		log.Fatal().Err(err).Msg("quic config")
+	}
+	debug, err := quicdebug.New(cfg.QuicDebug, "reflector", log)
+	if err != nil {
+		log.Fatal().Err(err).Msg("quic debug config")
+	}
+	if cfg.Admin != nil {
+		srv, err := admin.New(cfg.Admin, log)
+		if err != nil {
+			log.Fatal().Err(err).Msg("admin config")
+		}
+		debug.Routes(srv)
+		err = srv.Start()
+		if err != nil {
+			log.Fatal().Err(err).Msg("admin listener")
+		}
+	}
+
 	wg := sync.WaitGroup{}
 	var handler http.Handler = reflector.ReflectorHandler{}
-	if os.Args[len(os.Args)-1] == "muxfront" {
+	if flag.Arg(flag.NArg()-1) == "muxfront" {
 		// handler = muxFrontendHandler{}
 	}
-	reflector.Start(&wg, host, cert, key, handler)
+	opts := &reflector.ServerOptions{Quic: cfg.Quic, Debug: debug}
+	if cfg.DevCA {
+		// without dev.cert a local CA signs one, trust .h123-dev-ca/ca.crt
+		opts.DevCA = &certs.DevCAConfig{}
+	}
+	reflector.Start(&wg, cfg.Listen, cfg.Cert, cfg.Key, handler, opts)
 	wg.Wait()
 }
@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mabels/h123-reflector/utils"
+)
+
+type upstreamKey struct{}
+
+// MaxUpstreams is the number of distinct upstream labels of a handler,
+// clients choose the upstream, later ones are counted as "other".
+const MaxUpstreams = 100
+
+type upstreamLabels struct {
+	mutex sync.Mutex
+	known map[string]bool
+}
+
+func (ul *upstreamLabels) label(upstream string) string {
+	ul.mutex.Lock()
+	defer ul.mutex.Unlock()
+	if upstream == "" || ul.known[upstream] {
+		return upstream
+	}
+	if len(ul.known) >= MaxUpstreams {
+		return "other"
+	}
+	ul.known[upstream] = true
+	return upstream
+}
+
+// SetUpstream names the upstream host of an instrumented request.
+func SetUpstream(ctx context.Context, upstream string) {
+	if u, ok := ctx.Value(upstreamKey{}).(*string); ok {
+		*u = upstream
+	}
+}
+
+type instrumented struct {
+	component string
+	requests  *Counter
+	duration  *Histogram
+	upstreams *upstreamLabels
+	handler   http.Handler
+}
+
+// Instrument counts the requests and their duration by protocol, status
+// and the upstream host set with SetUpstream.
+func (r *Registry) Instrument(handler http.Handler) http.Handler {
+	labels := []string{"component", "protocol", "status", "upstream"}
+	return instrumented{
+		component: r.Component,
+		requests:  r.Counter("h123_requests_total", "Handled requests.", labels...),
+		duration:  r.Histogram("h123_request_duration_seconds", "Duration of the handled requests.", nil, labels...),
+		upstreams: &upstreamLabels{known: map[string]bool{}},
+		handler:   handler,
+	}
+}
+
+func (i instrumented) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	upstream := ""
+	rw := utils.NewResponseWriter(w)
+	i.handler.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), upstreamKey{}, &upstream)))
+	values := []string{i.component, r.Proto, strconv.Itoa(rw.StatusOrOK()), i.upstreams.label(upstream)}
+	i.requests.Inc(values...)
+	i.duration.Observe(time.Since(start).Seconds(), values...)
+}
+
+// Serve serves the registry on /metrics of listen.
+func (r *Registry) Serve(listen string, log *utils.Logger) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r)
+	srv := &http.Server{Addr: listen, Handler: mux}
+	go func() {
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Error().Str("listen", listen).Err(err).Msg("metrics listener failed")
+		}
+	}()
+	return srv
+}
@@ -0,0 +1,248 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type family interface {
+	write(w io.Writer)
+}
+
+// Registry holds the metrics of one component and writes them in the
+// Prometheus text format.
+type Registry struct {
+	Component  string
+	mutex      sync.Mutex
+	families   map[string]family
+	quicOnce   sync.Once
+	quicTracer *quicTracer
+}
+
+func NewRegistry(component string) *Registry {
+	return &Registry{
+		Component: component,
+		families:  map[string]family{},
+	}
+}
+
+// register returns the family registered under name or adds the new one.
+func (r *Registry) register(name string, fn func() family) family {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	f, found := r.families[name]
+	if !found {
+		f = fn()
+		r.families[name] = f
+	}
+	return f
+}
+
+func (r *Registry) Write(w io.Writer) {
+	r.mutex.Lock()
+	families := make([]family, 0, len(r.families))
+	for _, name := range sortedKeys(r.families) {
+		families = append(families, r.families[name])
+	}
+	r.mutex.Unlock()
+	for _, f := range families {
+		f.write(w)
+	}
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.Write(w)
+}
+
+func header(w io.Writer, name string, help string, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.ReplaceAll(help, "\n", " "))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelString(names []string, values []string, extra ...string) string {
+	parts := make([]string, 0, len(names)+len(extra)/2)
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(value)))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, extra[i], labelEscaper.Replace(extra[i+1])))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+type Counter struct {
+	name   string
+	help   string
+	labels []string
+	mutex  sync.Mutex
+	values map[string]float64
+	keys   map[string][]string
+}
+
+func (r *Registry) Counter(name string, help string, labels ...string) *Counter {
+	return r.register(name, func() family {
+		return &Counter{
+			name:   name,
+			help:   help,
+			labels: labels,
+			values: map[string]float64{},
+			keys:   map[string][]string{},
+		}
+	}).(*Counter)
+}
+
+func (c *Counter) Add(v float64, values ...string) {
+	key := labelKey(values)
+	c.mutex.Lock()
+	c.values[key] += v
+	if _, found := c.keys[key]; !found {
+		c.keys[key] = append([]string{}, values...)
+	}
+	c.mutex.Unlock()
+}
+
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Value is mostly for tests.
+func (c *Counter) Value(values ...string) float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.values[labelKey(values)]
+}
+
+func (c *Counter) write(w io.Writer) {
+	header(w, c.name, c.help, "counter")
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labelString(c.labels, c.keys[key]), formatValue(c.values[key]))
+	}
+}
+
+type Gauge struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+// GaugeFunc reports the value of fn at each scrape.
+func (r *Registry) GaugeFunc(name string, help string, fn func() float64) {
+	r.register(name, func() family {
+		return &Gauge{name: name, help: help, fn: fn}
+	})
+}
+
+func (g *Gauge) write(w io.Writer) {
+	header(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatValue(g.fn()))
+}
+
+type histogramValue struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type Histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mutex   sync.Mutex
+	values  map[string]*histogramValue
+	keys    map[string][]string
+}
+
+func (r *Registry) Histogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	return r.register(name, func() family {
+		return &Histogram{
+			name:    name,
+			help:    help,
+			labels:  labels,
+			buckets: buckets,
+			values:  map[string]*histogramValue{},
+			keys:    map[string][]string{},
+		}
+	}).(*Histogram)
+}
+
+func (h *Histogram) Observe(v float64, values ...string) {
+	key := labelKey(values)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	hv, found := h.values[key]
+	if !found {
+		hv = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+		h.keys[key] = append([]string{}, values...)
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			hv.counts[i]++
+		}
+	}
+	hv.sum += v
+	hv.count++
+}
+
+func (h *Histogram) write(w io.Writer) {
+	header(w, h.name, h.help, "histogram")
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, key := range sortedKeys(h.values) {
+		hv := h.values[key]
+		values := h.keys[key]
+		for i, le := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(h.labels, values, "le", formatValue(le)), hv.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(h.labels, values, "le", "+Inf"), hv.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelString(h.labels, values), formatValue(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelString(h.labels, values), hv.count)
+	}
+}
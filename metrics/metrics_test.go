@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_TextFormat(t *testing.T) {
+	reg := NewRegistry("test")
+	reg.Counter("b_total", "Counts b.", "kind").Add(2, `x"y`)
+	reg.GaugeFunc("a", "Gauge a.", func() float64 { return 3 })
+	h := reg.Histogram("c_seconds", "Histogram c.", []float64{0.1, 1}, "kind")
+	h.Observe(0.05, "z")
+	h.Observe(0.5, "z")
+	out := &bytes.Buffer{}
+	reg.Write(out)
+	expected := `# HELP a Gauge a.
+# TYPE a gauge
+a 3
+# HELP b_total Counts b.
+# TYPE b_total counter
+b_total{kind="x\"y"} 2
+# HELP c_seconds Histogram c.
+# TYPE c_seconds histogram
+c_seconds_bucket{kind="z",le="0.1"} 1
+c_seconds_bucket{kind="z",le="1"} 2
+c_seconds_bucket{kind="z",le="+Inf"} 2
+c_seconds_sum{kind="z"} 0.55
+c_seconds_count{kind="z"} 2
+`
+	if out.String() != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+}
+
+func Test_Instrument(t *testing.T) {
+	reg := NewRegistry("test")
+	handler := reg.Instrument(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SetUpstream(r.Context(), "upstream:443")
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	requests := reg.Counter("h123_requests_total", "")
+	if v := requests.Value("test", "HTTP/1.1", "418", "upstream:443"); v != 1 {
+		t.Errorf("Expected 1 request, got %v", v)
+	}
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(w.Body.String(), `h123_request_duration_seconds_count{component="test",protocol="HTTP/1.1",status="418",upstream="upstream:443"} 1`) {
+		t.Errorf("Expected duration histogram, got:\n%s", w.Body.String())
+	}
+	i := 0
+	handler = reg.Instrument(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SetUpstream(r.Context(), fmt.Sprintf("host-%d:443", i))
+	}))
+	for ; i < MaxUpstreams+5; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	if v := requests.Value("test", "HTTP/1.1", "200", "other"); v != 5 {
+		t.Errorf("Expected the upstreams over the limit as other, got %v", v)
+	}
+}
@@ -0,0 +1,146 @@
+package metrics
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/logging"
+)
+
+var rttBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+
+type quicTracer struct {
+	active      int64
+	connections *Counter
+	rtt         *Histogram
+	sent        *Counter
+	received    *Counter
+	lost        *Counter
+	streams     *Counter
+}
+
+// QuicTracer collects connection, packet, loss, RTT and stream counts of
+// the QUIC connections it is set as quic.Config.Tracer for.
+func (r *Registry) QuicTracer() logging.Tracer {
+	r.quicOnce.Do(func() { r.quicTracer = r.newQuicTracer() })
+	return r.quicTracer
+}
+
+func (r *Registry) newQuicTracer() *quicTracer {
+	qt := &quicTracer{
+		connections: r.Counter("h123_quic_connections_total", "Opened QUIC connections.", "perspective"),
+		rtt:         r.Histogram("h123_quic_rtt_seconds", "QUIC round trip time samples.", rttBuckets),
+		sent:        r.Counter("h123_quic_packets_sent_total", "Sent QUIC packets."),
+		received:    r.Counter("h123_quic_packets_received_total", "Received QUIC packets."),
+		lost:        r.Counter("h123_quic_packets_lost_total", "Lost QUIC packets.", "reason"),
+		streams:     r.Counter("h123_quic_streams_total", "Opened QUIC streams."),
+	}
+	r.GaugeFunc("h123_quic_connections_active", "Open QUIC connections.", func() float64 {
+		return float64(atomic.LoadInt64(&qt.active))
+	})
+	return qt
+}
+
+func (qt *quicTracer) TracerForConnection(ctx context.Context, p logging.Perspective, odcid logging.ConnectionID) logging.ConnectionTracer {
+	perspective := "client"
+	if p == logging.PerspectiveServer {
+		perspective = "server"
+	}
+	qt.connections.Inc(perspective)
+	atomic.AddInt64(&qt.active, 1)
+	return &quicConnectionTracer{tracer: qt, nextStream: [4]int64{0, 1, 2, 3}}
+}
+
+func (qt *quicTracer) SentPacket(net.Addr, *logging.Header, logging.ByteCount, []logging.Frame) {}
+
+func (qt *quicTracer) DroppedPacket(net.Addr, logging.PacketType, logging.ByteCount, logging.PacketDropReason) {
+}
+
+type quicConnectionTracer struct {
+	tracer    *quicTracer
+	mutex     sync.Mutex
+	closeOnce sync.Once
+	// the next unseen stream id by stream type, ids are handed out in order
+	nextStream [4]int64
+}
+
+func (ct *quicConnectionTracer) countStreams(frames []logging.Frame) {
+	ct.mutex.Lock()
+	defer ct.mutex.Unlock()
+	for _, f := range frames {
+		sf, ok := f.(*logging.StreamFrame)
+		if !ok {
+			continue
+		}
+		id := int64(sf.StreamID)
+		typ := id & 3
+		if id >= ct.nextStream[typ] {
+			ct.tracer.streams.Add(float64((id-ct.nextStream[typ])/4 + 1))
+			ct.nextStream[typ] = id + 4
+		}
+	}
+}
+
+func (ct *quicConnectionTracer) StartedConnection(local, remote net.Addr, srcConnID, destConnID logging.ConnectionID) {
+}
+func (ct *quicConnectionTracer) NegotiatedVersion(chosen logging.VersionNumber, clientVersions, serverVersions []logging.VersionNumber) {
+}
+func (ct *quicConnectionTracer) ClosedConnection(error)                                   {}
+func (ct *quicConnectionTracer) SentTransportParameters(*logging.TransportParameters)     {}
+func (ct *quicConnectionTracer) ReceivedTransportParameters(*logging.TransportParameters) {}
+func (ct *quicConnectionTracer) RestoredTransportParameters(*logging.TransportParameters) {}
+func (ct *quicConnectionTracer) SentPacket(hdr *logging.ExtendedHeader, size logging.ByteCount, ack *logging.AckFrame, frames []logging.Frame) {
+	ct.tracer.sent.Inc()
+	ct.countStreams(frames)
+}
+func (ct *quicConnectionTracer) ReceivedVersionNegotiationPacket(*logging.Header, []logging.VersionNumber) {
+}
+func (ct *quicConnectionTracer) ReceivedRetry(*logging.Header) {}
+func (ct *quicConnectionTracer) ReceivedPacket(hdr *logging.ExtendedHeader, size logging.ByteCount, frames []logging.Frame) {
+	ct.tracer.received.Inc()
+	ct.countStreams(frames)
+}
+func (ct *quicConnectionTracer) BufferedPacket(logging.PacketType) {}
+func (ct *quicConnectionTracer) DroppedPacket(logging.PacketType, logging.ByteCount, logging.PacketDropReason) {
+}
+func (ct *quicConnectionTracer) UpdatedMetrics(rttStats *logging.RTTStats, cwnd, bytesInFlight logging.ByteCount, packetsInFlight int) {
+	if rtt := rttStats.LatestRTT(); rtt > 0 {
+		ct.tracer.rtt.Observe(rtt.Seconds())
+	}
+}
+func (ct *quicConnectionTracer) AcknowledgedPacket(logging.EncryptionLevel, logging.PacketNumber) {}
+func (ct *quicConnectionTracer) LostPacket(level logging.EncryptionLevel, pn logging.PacketNumber, reason logging.PacketLossReason) {
+	switch reason {
+	case logging.PacketLossTimeThreshold:
+		ct.tracer.lost.Inc("time_threshold")
+	case logging.PacketLossReorderingThreshold:
+		ct.tracer.lost.Inc("reordering_threshold")
+	default:
+		ct.tracer.lost.Inc("unknown")
+	}
+}
+func (ct *quicConnectionTracer) UpdatedCongestionState(logging.CongestionState)                 {}
+func (ct *quicConnectionTracer) UpdatedPTOCount(value uint32)                                   {}
+func (ct *quicConnectionTracer) UpdatedKeyFromTLS(logging.EncryptionLevel, logging.Perspective) {}
+func (ct *quicConnectionTracer) UpdatedKey(generation logging.KeyPhase, remote bool)            {}
+func (ct *quicConnectionTracer) DroppedEncryptionLevel(logging.EncryptionLevel)                 {}
+func (ct *quicConnectionTracer) DroppedKey(generation logging.KeyPhase)                         {}
+func (ct *quicConnectionTracer) SetLossTimer(logging.TimerType, logging.EncryptionLevel, time.Time) {
+}
+func (ct *quicConnectionTracer) LossTimerExpired(logging.TimerType, logging.EncryptionLevel) {}
+func (ct *quicConnectionTracer) LossTimerCanceled()                                          {}
+func (ct *quicConnectionTracer) Close() {
+	ct.closeOnce.Do(func() { atomic.AddInt64(&ct.tracer.active, -1) })
+}
+func (ct *quicConnectionTracer) Debug(name, msg string) {}
+
+// AddTracer adds tracer to an optional existing one.
+func AddTracer(existing logging.Tracer, tracer logging.Tracer) logging.Tracer {
+	if existing == nil {
+		return tracer
+	}
+	return logging.NewMultiplexedTracer(existing, tracer)
+}
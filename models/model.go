@@ -12,6 +12,25 @@ type ServerStatus struct {
 	FrontendConnections int
 	Requests            uint64
 	Loop                int
+	Upstreams           []UpstreamStatus `json:",omitempty"`
+	DrainDeadline       *time.Time       `json:",omitempty"`
+	Tunnel              bool             `json:",omitempty"`
+	// Quic are the effective transport parameters by endpoint
+	Quic map[string]QuicStatus `json:",omitempty"`
+	// share of the requests, 0 sends none, nil from older backends counts
+	// as 100
+	Weight               *int    `json:",omitempty"`
+	MaxConcurrentStreams int64   `json:",omitempty"`
+	ActiveStreams        int64   `json:",omitempty"`
+	Load                 float64 `json:",omitempty"` // 1 minute load average per CPU
+	MemoryBytes          uint64  `json:",omitempty"`
+	// no new requests should be sent
+	Saturated bool     `json:",omitempty"`
+	Features  []string `json:",omitempty"`
+	// where the backend runs, for the locality of the frontends
+	Region string            `json:",omitempty"`
+	Zone   string            `json:",omitempty"`
+	Labels map[string]string `json:",omitempty"`
 }
 
 type ReflectorResponse struct {
@@ -23,4 +42,101 @@ type ReflectorResponse struct {
 	Body           *string `json:",omitempty"`
 	Method         string
 	Error          *string `json:",omitempty"`
+	Resumed        bool    `json:",omitempty"` // the TLS session was resumed
+	EarlyData      bool    `json:",omitempty"` // received in 0-RTT
+}
+
+type CircuitStatus struct {
+	State             string
+	ConsecutiveErrors int
+	Ejections         int
+	EjectedUntil      *time.Time `json:",omitempty"`
+}
+
+type UpstreamStatus struct {
+	Host    string
+	Circuit CircuitStatus
+}
+
+type HealthStatus struct {
+	Healthy   bool
+	LastCheck time.Time
+	LastError string `json:",omitempty"`
+	RTT       string `json:",omitempty"` // smoothed over the health checks
+}
+
+type TunnelStatus struct {
+	Status            string
+	Now               time.Time
+	TunnelEndPointUrl string
+}
+
+type BackendInfo struct {
+	MuxEndPointUrl string
+	State          ServerStatus
+	Connected      bool
+	Tunnel         bool
+	Drained        bool // by the admin, no new requests are sent
+	Circuit        CircuitStatus
+	Health         HealthStatus
+}
+
+// FrontendStatus is published by every frontend on its StatusTopic.
+type FrontendStatus struct {
+	Name              string
+	Status            string
+	Now               time.Time
+	Listen            string
+	Region            string `json:",omitempty"`
+	Zone              string `json:",omitempty"`
+	Protocols         []string
+	TunnelEndPointUrl string `json:",omitempty"`
+	// Quic are the effective transport parameters by endpoint
+	Quic        map[string]QuicStatus `json:",omitempty"`
+	Backends    []FrontendBackend
+	Requests    uint64
+	RequestRate float64 // per second since the last status
+	Loop        int
+}
+
+// FrontendBackend is a backend as one frontend sees it.
+type FrontendBackend struct {
+	MuxEndPointUrl string
+	Connected      bool
+	Tunnel         bool `json:",omitempty"`
+	Drained        bool `json:",omitempty"`
+	Circuit        string
+	Health         HealthStatus
+	Requests       uint64 // forwarded to it
+}
+
+type UplinkInfo struct {
+	ID          string
+	RemoteAddr  string
+	Frontend    string
+	Requests    uint64
+	LastRequest time.Time
+}
+
+type PooledConnection struct {
+	Key      string
+	Schema   string
+	Host     string
+	Protocol string `json:",omitempty"`
+	Requests int64
+	Circuit  *CircuitStatus `json:",omitempty"`
+}
+
+type QuicStatus struct {
+	MaxIdleTimeout                 string
+	KeepAlivePeriod                string
+	HandshakeIdleTimeout           string
+	InitialStreamReceiveWindow     uint64
+	MaxStreamReceiveWindow         uint64
+	InitialConnectionReceiveWindow uint64
+	MaxConnectionReceiveWindow     uint64
+	MaxIncomingStreams             int64
+	MaxIncomingUniStreams          int64
+	EnableDatagrams                bool
+	Versions                       []string
 }
@@ -0,0 +1,272 @@
+package quicdebug
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/logging"
+	"github.com/lucas-clemente/quic-go/qlog"
+	"github.com/mabels/h123-reflector/admin"
+	"github.com/mabels/h123-reflector/metrics"
+	"github.com/mabels/h123-reflector/utils"
+)
+
+// Config writes a qlog file per QUIC connection and the TLS secrets in the
+// SSLKEYLOGFILE format, both can be switched at runtime by the admin API.
+type Config struct {
+	Dir          string // default h123-debug
+	Qlog         bool   // on at start
+	KeyLog       bool   // on at start, always with SSLKEYLOGFILE
+	KeyLogFile   string // default $SSLKEYLOGFILE or Dir/<name>-keys.log
+	MaxFileBytes int64  // of a qlog file, the rest is dropped, default 16MiB
+	MaxBytes     int64  // of all files, no more is written, default 256MiB
+}
+
+type Status struct {
+	Qlog         bool   `json:"qlog"`
+	KeyLog       bool   `json:"keyLog"`
+	Dir          string `json:"dir"`
+	KeyLogFile   string `json:"keyLogFile"`
+	Written      int64  `json:"written"`
+	MaxFileBytes int64  `json:"maxFileBytes"`
+	MaxBytes     int64  `json:"maxBytes"`
+}
+
+// Debugger is nil if not configured, all methods are noops then.
+type Debugger struct {
+	cfg     Config
+	name    string
+	log     *utils.Logger
+	qlog    int32
+	keyLog  int32
+	written int64
+	mutex   sync.Mutex
+	keys    *os.File
+}
+
+func boolInt(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// New returns nil without config and SSLKEYLOGFILE, name prefixes the
+// files.
+func New(config *Config, name string, log *utils.Logger) (*Debugger, error) {
+	env := os.Getenv("SSLKEYLOGFILE")
+	if config == nil && env == "" {
+		return nil, nil
+	}
+	cfg := Config{}
+	if config != nil {
+		cfg = *config
+	}
+	if cfg.Dir == "" {
+		cfg.Dir = "h123-debug"
+	}
+	if cfg.KeyLogFile == "" {
+		cfg.KeyLogFile = env
+	}
+	if cfg.KeyLogFile == "" {
+		cfg.KeyLogFile = filepath.Join(cfg.Dir, name+"-keys.log")
+	}
+	if env != "" {
+		cfg.KeyLog = true
+	}
+	if cfg.MaxFileBytes == 0 {
+		cfg.MaxFileBytes = 16 * 1024 * 1024
+	}
+	if cfg.MaxBytes == 0 {
+		cfg.MaxBytes = 256 * 1024 * 1024
+	}
+	if cfg.MaxFileBytes < 0 || cfg.MaxBytes < 0 {
+		return nil, fmt.Errorf("negative debug file limits")
+	}
+	if log == nil {
+		log = utils.NewLogger()
+	}
+	d := &Debugger{cfg: cfg, name: name, log: log.Component("quicdebug")}
+	d.Set(cfg.Qlog, cfg.KeyLog)
+	return d, nil
+}
+
+// Set switches the qlog and key log, open connections are not affected.
+func (d *Debugger) Set(qlog bool, keyLog bool) {
+	if d == nil {
+		return
+	}
+	atomic.StoreInt32(&d.qlog, boolInt(qlog))
+	atomic.StoreInt32(&d.keyLog, boolInt(keyLog))
+	d.log.Info().Bool("qlog", qlog).Bool("keyLog", keyLog).Str("dir", d.cfg.Dir).Msg("QUIC debugging")
+	if !keyLog {
+		d.mutex.Lock()
+		if d.keys != nil {
+			d.keys.Close()
+			d.keys = nil
+		}
+		d.mutex.Unlock()
+	}
+}
+
+func (d *Debugger) Status() Status {
+	if d == nil {
+		return Status{}
+	}
+	return Status{
+		Qlog:         atomic.LoadInt32(&d.qlog) != 0,
+		KeyLog:       atomic.LoadInt32(&d.keyLog) != 0,
+		Dir:          d.cfg.Dir,
+		KeyLogFile:   d.cfg.KeyLogFile,
+		Written:      atomic.LoadInt64(&d.written),
+		MaxFileBytes: d.cfg.MaxFileBytes,
+		MaxBytes:     d.cfg.MaxBytes,
+	}
+}
+
+// reserve counts n bytes against MaxBytes.
+func (d *Debugger) reserve(n int64) bool {
+	if atomic.AddInt64(&d.written, n) > d.cfg.MaxBytes {
+		atomic.AddInt64(&d.written, -n)
+		return false
+	}
+	return true
+}
+
+type qlogFile struct {
+	d    *Debugger
+	file *os.File
+	left int64
+}
+
+func (qf *qlogFile) Write(p []byte) (int, error) {
+	n := int64(len(p))
+	if n > qf.left || !qf.d.reserve(n) {
+		// truncated, the connection goes on
+		qf.left = 0
+		return len(p), nil
+	}
+	qf.left -= n
+	return qf.file.Write(p)
+}
+
+func (qf *qlogFile) Close() error {
+	return qf.file.Close()
+}
+
+func (d *Debugger) qlogWriter(p logging.Perspective, connectionID []byte) io.WriteCloser {
+	if atomic.LoadInt32(&d.qlog) == 0 || atomic.LoadInt64(&d.written) >= d.cfg.MaxBytes {
+		return nil
+	}
+	err := os.MkdirAll(d.cfg.Dir, 0700)
+	if err != nil {
+		d.log.Warn().Err(err).Msg("qlog dir")
+		return nil
+	}
+	perspective := "server"
+	if p == logging.PerspectiveClient {
+		perspective = "client"
+	}
+	name := fmt.Sprintf("%s-%s-%s-%s.qlog", d.name, time.Now().UTC().Format("20060102T150405"), perspective, hex.EncodeToString(connectionID))
+	file, err := os.OpenFile(filepath.Join(d.cfg.Dir, name), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		d.log.Warn().Err(err).Msg("qlog file")
+		return nil
+	}
+	return &qlogFile{d: d, file: file, left: d.cfg.MaxFileBytes}
+}
+
+// Tracer writes the qlog of new connections while it is switched on.
+func (d *Debugger) Tracer() logging.Tracer {
+	if d == nil {
+		return nil
+	}
+	return qlog.NewTracer(d.qlogWriter)
+}
+
+// AddTracer adds the qlog tracer to cfg.
+func (d *Debugger) AddTracer(cfg *quic.Config) *quic.Config {
+	if d != nil {
+		cfg.Tracer = metrics.AddTracer(cfg.Tracer, d.Tracer())
+	}
+	return cfg
+}
+
+// Write appends key log lines while the key log is switched on.
+func (d *Debugger) Write(p []byte) (int, error) {
+	if atomic.LoadInt32(&d.keyLog) == 0 || !d.reserve(int64(len(p))) {
+		return len(p), nil
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.keys == nil {
+		err := os.MkdirAll(filepath.Dir(d.cfg.KeyLogFile), 0700)
+		if err != nil {
+			return 0, err
+		}
+		d.keys, err = os.OpenFile(d.cfg.KeyLogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return d.keys.Write(p)
+}
+
+// KeyLogWriter is the tls.Config.KeyLogWriter, nil without debugger.
+func (d *Debugger) KeyLogWriter() io.Writer {
+	if d == nil {
+		return nil
+	}
+	return d
+}
+
+// TLSConfig sets the KeyLogWriter of cfg.
+func (d *Debugger) TLSConfig(cfg *tls.Config) *tls.Config {
+	if d != nil {
+		cfg.KeyLogWriter = d
+	}
+	return cfg
+}
+
+func (d *Debugger) Close() {
+	if d != nil {
+		d.Set(false, false)
+	}
+}
+
+// Routes adds GET /debug/quic and POST /debug/quic?qlog=true&keylog=false,
+// missing parameters stay as they are.
+func (d *Debugger) Routes(s *admin.Server) {
+	if d == nil {
+		return
+	}
+	s.Handle(http.MethodGet, "/debug/quic", func(r *http.Request) (interface{}, error) {
+		return d.Status(), nil
+	})
+	s.Handle(http.MethodPost, "/debug/quic", func(r *http.Request) (interface{}, error) {
+		status := d.Status()
+		for param, target := range map[string]*bool{"qlog": &status.Qlog, "keylog": &status.KeyLog} {
+			value := r.URL.Query().Get(param)
+			if value == "" {
+				continue
+			}
+			on, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, admin.BadRequest("%s: %v", param, err)
+			}
+			*target = on
+		}
+		d.Set(status.Qlog, status.KeyLog)
+		return d.Status(), nil
+	})
+}
@@ -0,0 +1,85 @@
+package quicdebug
+
+import (
+	"context"
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/mabels/h123-reflector/certs"
+)
+
+func connect(t *testing.T, d *Debugger, serverTLS *tls.Config) {
+	ln, err := quic.ListenAddr("127.0.0.1:0", d.TLSConfig(serverTLS.Clone()), d.AddTracer(&quic.Config{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept(context.Background())
+		if err == nil {
+			<-conn.Context().Done()
+		}
+	}()
+	conn, err := quic.DialAddr(ln.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"test"}}, d.AddTracer(&quic.Config{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.CloseWithError(0, "")
+	time.Sleep(100 * time.Millisecond)
+}
+
+func Test_Debugger(t *testing.T) {
+	t.Setenv("SSLKEYLOGFILE", "")
+	if d, err := New(nil, "test", nil); d != nil || err != nil {
+		t.Errorf("Expected no debugger without config, got %v %v", d, err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile, err := certs.EnsureDevCA(certs.DevCAConfig{Dir: filepath.Join(dir, "ca")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{pair}, NextProtos: []string{"test"}}
+
+	d, err := New(&Config{Dir: filepath.Join(dir, "debug"), Qlog: true, KeyLog: true, MaxFileBytes: 2048}, "test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connect(t, d, serverTLS)
+	qlogs, _ := filepath.Glob(filepath.Join(dir, "debug", "*.qlog"))
+	if len(qlogs) != 2 {
+		t.Fatalf("Expected a client and a server qlog, got %v", qlogs)
+	}
+	for _, file := range qlogs {
+		info, _ := os.Stat(file)
+		if info.Size() == 0 || info.Size() > 2048 {
+			t.Errorf("Expected %s within MaxFileBytes, got %d", file, info.Size())
+		}
+	}
+	keys, _ := os.ReadFile(d.Status().KeyLogFile)
+	if !strings.Contains(string(keys), "CLIENT_HANDSHAKE_TRAFFIC_SECRET") {
+		t.Errorf("Expected the TLS secrets, got %q", keys)
+	}
+
+	d.Set(false, false)
+	written := d.Status().Written
+	connect(t, d, serverTLS)
+	qlogs, _ = filepath.Glob(filepath.Join(dir, "debug", "*.qlog"))
+	if len(qlogs) != 2 || d.Status().Written != written {
+		t.Errorf("Expected nothing written when switched off, got %v", qlogs)
+	}
+
+	full, _ := New(&Config{Dir: filepath.Join(dir, "full"), Qlog: true, MaxBytes: 1}, "test", nil)
+	connect(t, full, serverTLS)
+	if qlogs, _ = filepath.Glob(filepath.Join(dir, "full", "*.qlog")); len(qlogs) != 2 || full.Status().Written > 1 {
+		t.Errorf("Expected empty files beyond MaxBytes, got %v %d", qlogs, full.Status().Written)
+	}
+}
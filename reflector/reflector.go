@@ -2,33 +2,38 @@ package reflector
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"sync"
 	"time"
 
 	"github.com/lucas-clemente/quic-go"
 	"github.com/lucas-clemente/quic-go/http3"
+	"github.com/mabels/h123-reflector/certs"
+	"github.com/mabels/h123-reflector/metrics"
 	"github.com/mabels/h123-reflector/models"
+	"github.com/mabels/h123-reflector/quicdebug"
+	"github.com/mabels/h123-reflector/utils"
 )
 
 func h12server(stopper *sync.WaitGroup,
 	listen string,
-	certFile string,
-	keyFile string,
-	handler http.Handler) *http.Server {
+	tlsConfig *tls.Config,
+	handler http.Handler,
+	log *utils.Logger) *http.Server {
 	srv := &http.Server{
-		Addr:    listen,
-		Handler: handler,
+		Addr:      listen,
+		Handler:   handler,
+		TLSConfig: tlsConfig,
 	}
 	stopper.Add(1)
 	go func() {
 		defer stopper.Done()
-		if err := srv.ListenAndServeTLS(certFile, keyFile); err != http.ErrServerClosed {
-			log.Fatalf("ListenAndServeTLS(): %v", err)
+		if err := srv.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+			log.Fatal().Str("listen", listen).Err(err).Msg("ListenAndServeTLS()")
 		}
 	}()
 
@@ -36,14 +41,48 @@ func h12server(stopper *sync.WaitGroup,
 	return srv
 }
 
-func h3server(stopper *sync.WaitGroup, listen string, certFile string, keyFile string, handler http.Handler) *http3.Server {
-	srv := &http3.Server{Addr: listen, Handler: handler}
+type ServerOptions struct {
+	EnableDatagrams    bool
+	AdditionalSettings map[uint64]uint64
+	// Metrics instruments the servers, a registry is created if only
+	// MetricsListen is set.
+	Metrics       *metrics.Registry
+	MetricsListen string
+	Log           *utils.Logger
+	// Certs serves the certificates by SNI, one is created for the cert and
+	// key files of Start if nil
+	Certs *certs.Manager
+	// DevCA creates the cert and key files of Start if they are missing
+	DevCA *certs.DevCAConfig
+	Quic  utils.QuicConfig
+	// Debug writes qlog files and the TLS key log
+	Debug *quicdebug.Debugger
+}
+
+func h3server(stopper *sync.WaitGroup, listen string, tlsConfig *tls.Config, handler http.Handler, opts *ServerOptions) *http3.Server {
+	srv := &http3.Server{
+		Addr:               listen,
+		Handler:            handler,
+		TLSConfig:          tlsConfig,
+		EnableDatagrams:    opts.EnableDatagrams || opts.Quic.EnableDatagrams,
+		AdditionalSettings: opts.AdditionalSettings,
+	}
+	base := &quic.Config{}
+	if opts.Metrics != nil {
+		base.Tracer = opts.Metrics.QuicTracer()
+	}
+	opts.Debug.AddTracer(base)
+	quicCfg, err := opts.Quic.Apply(base)
+	if err != nil {
+		opts.Log.Fatal().Str("listen", listen).Err(err).Msg("QUIC config")
+	}
+	srv.QuicConfig = quicCfg
 	stopper.Add(1)
 	go func() {
 		defer stopper.Done() // let main know we are done cleaning up
 		// return http3.ListenAndServeQUIC(listen, certFile, keyFile, nil)
-		if err := srv.ListenAndServeTLS(certFile, keyFile); err != quic.ErrServerClosed {
-			log.Fatalf("ListenAndServeTLS(): %v", err)
+		if err := srv.ListenAndServe(); err != quic.ErrServerClosed {
+			opts.Log.Fatal().Str("listen", listen).Err(err).Msg("ListenAndServeTLS() quic")
 		}
 	}()
 	return srv
@@ -69,6 +108,7 @@ func (_x ReflectorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		my := err.Error()
 		errStr = &my
 	}
+	tlsState := utils.ConnState(w, r)
 	out, _ := json.MarshalIndent(models.ReflectorResponse{
 		RemoteAddr: r.RemoteAddr,
 		Protocol:   r.Proto,
@@ -77,18 +117,58 @@ func (_x ReflectorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		Method:     r.Method,
 		Body:       bodyStr,
 		Error:      errStr,
+		Resumed:    tlsState.Resumed,
+		EarlyData:  tlsState.EarlyData,
 	}, "", "  ")
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(200)
 	w.Write(out)
 }
 
-func Start(wg *sync.WaitGroup, host string, cert string, key string, handler http.Handler) func() {
-	h12 := h12server(wg, host, cert, key, handler)
-	h3 := h3server(wg, host, cert, key, handler)
+func Start(wg *sync.WaitGroup, host string, cert string, key string, handler http.Handler, opts ...*ServerOptions) func() {
+	opt := &ServerOptions{}
+	if len(opts) > 0 && opts[0] != nil {
+		my := *opts[0]
+		opt = &my
+	}
+	if opt.Log == nil {
+		opt.Log = utils.NewLogger().Component("reflector")
+	}
+	if opt.Metrics == nil && opt.MetricsListen != "" {
+		opt.Metrics = metrics.NewRegistry("reflector")
+	}
+	if opt.Metrics != nil {
+		handler = opt.Metrics.Instrument(handler)
+	}
+	var metricsSrv *http.Server
+	if opt.MetricsListen != "" {
+		metricsSrv = opt.Metrics.Serve(opt.MetricsListen, opt.Log)
+	}
+	certManager := opt.Certs
+	if certManager == nil {
+		var err error
+		certManager, err = certs.New(certs.Config{
+			CertFile: cert,
+			KeyFile:  key,
+			DevCA:    opt.DevCA.WithHosts(certs.ListenHosts(host)...),
+		}, opt.Log)
+		if err != nil {
+			opt.Log.Fatal().Str("cert", cert).Err(err).Msg("load certificate")
+		}
+		certManager.Start()
+	}
+	h12 := h12server(wg, host, opt.Debug.TLSConfig(certManager.TLSConfig()), handler, opt.Log)
+	h3 := h3server(wg, host, opt.Debug.TLSConfig(certManager.TLSConfig()), handler, opt)
 	return func() {
-		ctx, _ := context.WithDeadline(context.Background(), time.Now())
+		ctx, cancel := context.WithDeadline(context.Background(), time.Now())
+		defer cancel()
 		h12.Shutdown(ctx)
 		h3.Close()
+		if opt.Certs == nil {
+			certManager.Close()
+		}
+		if metricsSrv != nil {
+			metricsSrv.Close()
+		}
 	}
 }
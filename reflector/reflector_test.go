@@ -2,15 +2,19 @@ package reflector
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"io"
 	"net/http"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/lucas-clemente/quic-go"
 	"github.com/lucas-clemente/quic-go/http3"
+	"github.com/mabels/h123-reflector/certs"
 	"github.com/mabels/h123-reflector/models"
 )
 
@@ -118,3 +122,54 @@ func Test_H3(t *testing.T) {
 	}
 	stopper()
 }
+
+func Test_ResumeAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	start := func() func() {
+		manager, err := certs.New(certs.Config{
+			DevCA:                &certs.DevCAConfig{Dir: dir},
+			SessionTicketKeyFile: filepath.Join(dir, "tickets.key"),
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg := sync.WaitGroup{}
+		return Start(&wg, "127.0.0.1:4713", "", "", ReflectorHandler{}, &ServerOptions{Certs: manager})
+	}
+	roots := x509.NewCertPool()
+	sessions := tls.NewLRUClientSessionCache(8)
+	get := func(method string) models.ReflectorResponse {
+		roundTripper := &http3.RoundTripper{TLSClientConfig: &tls.Config{RootCAs: roots, ClientSessionCache: sessions}}
+		defer roundTripper.Close()
+		req, _ := http.NewRequest(method, "https://127.0.0.1:4713/", nil)
+		resp, err := roundTripper.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		res := models.ReflectorResponse{}
+		json.NewDecoder(resp.Body).Decode(&res)
+		// the session ticket follows the handshake
+		time.Sleep(50 * time.Millisecond)
+		return res
+	}
+
+	stopper := start()
+	caPEM, _ := os.ReadFile(filepath.Join(dir, "ca.crt"))
+	roots.AppendCertsFromPEM(caPEM)
+	if res := get(http.MethodGet); res.Resumed || res.EarlyData {
+		t.Errorf("Expected a full handshake, got %+v", res)
+	}
+	stopper()
+	time.Sleep(50 * time.Millisecond)
+
+	stopper = start()
+	defer stopper()
+	if res := get(http3.MethodGet0RTT); !res.Resumed || !res.EarlyData || res.Method != http.MethodGet {
+		t.Errorf("Expected a resumed GET in early data after the restart, got %+v", res)
+	}
+	// a GET after the handshake may still arrive before the server completed it
+	if res := get(http.MethodGet); !res.Resumed {
+		t.Errorf("Expected a resumed GET, got %+v", res)
+	}
+}
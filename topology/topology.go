@@ -0,0 +1,184 @@
+package topology
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/mabels/h123-reflector/models"
+)
+
+// Edge is a backend as a frontend sees it.
+type Edge struct {
+	Frontend       string `json:"frontend"`
+	MuxEndPointUrl string `json:"muxEndPointUrl"`
+	Connected      bool   `json:"connected"`
+	Healthy        bool   `json:"healthy"`
+	Circuit        string `json:"circuit"`
+	RTT            string `json:"rtt,omitempty"`
+	Requests       uint64 `json:"requests"`
+	Announced      bool   `json:"announced"`        // the backend publishes its status
+	Status         string `json:"status,omitempty"` // announced by the backend, e.g. draining
+}
+
+// Graph of the frontends and backends, sorted by name.
+type Graph struct {
+	Frontends []models.FrontendStatus `json:"frontends"`
+	Backends  []models.ServerStatus   `json:"backends"`
+	Edges     []Edge                  `json:"edges"`
+}
+
+// Collector keeps the last status of every frontend and backend.
+type Collector struct {
+	mutex     sync.Mutex
+	frontends map[string]models.FrontendStatus
+	backends  map[string]models.ServerStatus
+}
+
+func NewCollector() *Collector {
+	return &Collector{
+		frontends: map[string]models.FrontendStatus{},
+		backends:  map[string]models.ServerStatus{},
+	}
+}
+
+func (c *Collector) ReceiveFrontend(client mqtt.Client, msg mqtt.Message) {
+	state := models.FrontendStatus{}
+	if json.Unmarshal(msg.Payload(), &state) != nil || state.Name == "" {
+		return
+	}
+	c.mutex.Lock()
+	c.frontends[state.Name] = state
+	c.mutex.Unlock()
+}
+
+func (c *Collector) ReceiveBackend(client mqtt.Client, msg mqtt.Message) {
+	state := models.ServerStatus{}
+	if json.Unmarshal(msg.Payload(), &state) != nil || state.MuxEndPointUrl == "" {
+		return
+	}
+	c.mutex.Lock()
+	c.backends[state.MuxEndPointUrl] = state
+	c.mutex.Unlock()
+}
+
+// Graph leaves out offline nodes and the ones without status since
+// staleAfter, 0 keeps all. Draining backends are kept.
+func (c *Collector) Graph(now time.Time, staleAfter time.Duration) Graph {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	current := func(at time.Time) bool {
+		return staleAfter == 0 || at.Add(staleAfter).After(now)
+	}
+	g := Graph{Frontends: []models.FrontendStatus{}, Backends: []models.ServerStatus{}, Edges: []Edge{}}
+	announced := map[string]string{}
+	for muxEndPointUrl, state := range c.backends {
+		if state.Status != "offline" && current(state.Now) {
+			g.Backends = append(g.Backends, state)
+			announced[muxEndPointUrl] = state.Status
+		}
+	}
+	for _, state := range c.frontends {
+		if state.Status != "online" || !current(state.Now) {
+			continue
+		}
+		g.Frontends = append(g.Frontends, state)
+		for _, backend := range state.Backends {
+			g.Edges = append(g.Edges, Edge{
+				Frontend:       state.Name,
+				MuxEndPointUrl: backend.MuxEndPointUrl,
+				Connected:      backend.Connected,
+				Healthy:        backend.Health.Healthy,
+				Circuit:        backend.Circuit,
+				RTT:            backend.Health.RTT,
+				Requests:       backend.Requests,
+				Announced:      announced[backend.MuxEndPointUrl] != "",
+				Status:         announced[backend.MuxEndPointUrl],
+			})
+		}
+	}
+	sort.Slice(g.Frontends, func(i, j int) bool { return g.Frontends[i].Name < g.Frontends[j].Name })
+	sort.Slice(g.Backends, func(i, j int) bool { return g.Backends[i].MuxEndPointUrl < g.Backends[j].MuxEndPointUrl })
+	sort.Slice(g.Edges, func(i, j int) bool {
+		if g.Edges[i].Frontend != g.Edges[j].Frontend {
+			return g.Edges[i].Frontend < g.Edges[j].Frontend
+		}
+		return g.Edges[i].MuxEndPointUrl < g.Edges[j].MuxEndPointUrl
+	})
+	return g
+}
+
+func (e Edge) describe() string {
+	parts := []string{}
+	if !e.Connected {
+		parts = append(parts, "disconnected")
+	} else if !e.Healthy {
+		parts = append(parts, "unhealthy")
+	}
+	if e.Circuit != "" && e.Circuit != "closed" {
+		parts = append(parts, "circuit "+e.Circuit)
+	}
+	if !e.Announced {
+		parts = append(parts, "not announced")
+	} else if e.Status != "online" {
+		parts = append(parts, e.Status)
+	}
+	if e.RTT != "" {
+		parts = append(parts, "rtt "+e.RTT)
+	}
+	parts = append(parts, fmt.Sprintf("%d requests", e.Requests))
+	return strings.Join(parts, ", ")
+}
+
+// WriteText lists every frontend with its backends, then the backends
+// which no frontend uses.
+func (g Graph) WriteText(w io.Writer) {
+	used := map[string]bool{}
+	for _, fe := range g.Frontends {
+		fmt.Fprintf(w, "frontend %s %s %s %.1f req/s\n", fe.Name, fe.Listen, strings.Join(fe.Protocols, ","), fe.RequestRate)
+		for _, e := range g.Edges {
+			if e.Frontend == fe.Name {
+				used[e.MuxEndPointUrl] = true
+				fmt.Fprintf(w, "  -> %s (%s)\n", e.MuxEndPointUrl, e.describe())
+			}
+		}
+	}
+	for _, bd := range g.Backends {
+		if !used[bd.MuxEndPointUrl] {
+			fmt.Fprintf(w, "backend %s without frontend, %d uplinks\n", bd.MuxEndPointUrl, bd.FrontendConnections)
+		}
+	}
+}
+
+// WriteDot writes the graph for graphviz.
+func (g Graph) WriteDot(w io.Writer) {
+	fmt.Fprintln(w, "digraph h123 {")
+	fmt.Fprintln(w, "  rankdir=LR;")
+	for _, fe := range g.Frontends {
+		fmt.Fprintf(w, "  %q [shape=box label=%q];\n", "fe:"+fe.Name, fmt.Sprintf("%s\n%.1f req/s", fe.Name, fe.RequestRate))
+	}
+	for _, bd := range g.Backends {
+		label := bd.MuxEndPointUrl
+		if bd.Status != "online" {
+			label += "\n" + bd.Status
+		}
+		fmt.Fprintf(w, "  %q [label=%q];\n", "bd:"+bd.MuxEndPointUrl, label)
+	}
+	for _, e := range g.Edges {
+		style := "solid"
+		if !e.Connected || !e.Healthy {
+			style = "dashed"
+		}
+		label := e.RTT
+		if e.Announced && e.Status != "online" {
+			label = strings.TrimSpace(label + " " + e.Status)
+		}
+		fmt.Fprintf(w, "  %q -> %q [label=%q style=%s];\n", "fe:"+e.Frontend, "bd:"+e.MuxEndPointUrl, label, style)
+	}
+	fmt.Fprintln(w, "}")
+}
@@ -0,0 +1,78 @@
+package topology
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mabels/h123-reflector/models"
+)
+
+type message struct {
+	payload []byte
+}
+
+func (m message) Duplicate() bool   { return false }
+func (m message) Qos() byte         { return 1 }
+func (m message) Retained() bool    { return false }
+func (m message) Topic() string     { return "test" }
+func (m message) MessageID() uint16 { return 0 }
+func (m message) Payload() []byte   { return m.payload }
+func (m message) Ack()              {}
+
+func publish(t *testing.T, receive func(message), v interface{}) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive(message{payload: out})
+}
+
+func Test_Graph(t *testing.T) {
+	now := time.Now()
+	c := NewCollector()
+	frontend := func(m message) { c.ReceiveFrontend(nil, m) }
+	backend := func(m message) { c.ReceiveBackend(nil, m) }
+	publish(t, frontend, models.FrontendStatus{Name: "fe-b", Status: "online", Now: now, Backends: []models.FrontendBackend{
+		{MuxEndPointUrl: "https://bd-1", Connected: true, Health: models.HealthStatus{Healthy: true, RTT: "2ms"}, Requests: 7},
+		{MuxEndPointUrl: "https://bd-gone", Connected: false},
+	}})
+	publish(t, frontend, models.FrontendStatus{Name: "fe-a", Status: "online", Now: now, Backends: []models.FrontendBackend{
+		{MuxEndPointUrl: "https://bd-1", Connected: true, Health: models.HealthStatus{Healthy: true}},
+		{MuxEndPointUrl: "https://bd-drain", Connected: true, Health: models.HealthStatus{Healthy: true}},
+	}})
+	publish(t, frontend, models.FrontendStatus{Name: "fe-old", Status: "online", Now: now.Add(-time.Minute)})
+	publish(t, frontend, models.FrontendStatus{Name: "fe-stopped", Status: "offline", Now: now})
+	publish(t, backend, models.ServerStatus{MuxEndPointUrl: "https://bd-1", Status: "online", Now: now})
+	publish(t, backend, models.ServerStatus{MuxEndPointUrl: "https://bd-idle", Status: "online", Now: now})
+	publish(t, backend, models.ServerStatus{MuxEndPointUrl: "https://bd-drain", Status: "draining", Now: now})
+	publish(t, backend, models.ServerStatus{MuxEndPointUrl: "https://bd-stopped", Status: "offline", Now: now})
+	backend(message{payload: []byte("broken")})
+
+	g := c.Graph(now, 5*time.Second)
+	if len(g.Frontends) != 2 || g.Frontends[0].Name != "fe-a" || len(g.Backends) != 3 {
+		t.Fatalf("Expected the current frontends and backends, got %+v", g)
+	}
+	if len(g.Edges) != 4 || g.Edges[2].Frontend != "fe-b" || g.Edges[2].RTT != "2ms" || !g.Edges[2].Announced || g.Edges[3].Announced {
+		t.Errorf("Unexpected edges %+v", g.Edges)
+	}
+	if all := c.Graph(now, 0); len(all.Frontends) != 3 {
+		t.Errorf("Expected stale frontends without staleAfter, got %+v", all.Frontends)
+	}
+
+	text := bytes.Buffer{}
+	g.WriteText(&text)
+	for _, line := range []string{"frontend fe-a", "  -> https://bd-drain (draining, 0 requests)", "  -> https://bd-gone (disconnected, not announced, 0 requests)", "backend https://bd-idle without frontend"} {
+		if !strings.Contains(text.String(), line) {
+			t.Errorf("Expected %q in\n%s", line, text.String())
+		}
+	}
+	dot := bytes.Buffer{}
+	g.WriteDot(&dot)
+	if !strings.Contains(dot.String(), `"fe:fe-b" -> "bd:https://bd-gone" [label="" style=dashed];`) ||
+		!strings.Contains(dot.String(), `"fe:fe-a" -> "bd:https://bd-drain" [label="draining" style=solid];`) {
+		t.Errorf("Unexpected dot\n%s", dot.String())
+	}
+}
@@ -0,0 +1,54 @@
+package tracing
+
+import (
+	"net/http"
+
+	"github.com/mabels/h123-reflector/utils"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type handler struct {
+	tracing *Tracing
+	name    string
+	handler http.Handler
+}
+
+// Handler continues the trace of the traceparent header in a server span
+// named name, without tracing the handler is returned as it is.
+func Handler(t *Tracing, name string, h http.Handler) http.Handler {
+	if t == nil {
+		return h
+	}
+	return handler{tracing: t, name: name, handler: h}
+}
+
+func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := h.tracing.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := h.tracing.Start(ctx, h.name, trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.HTTPServerAttributesFromHTTPRequest("", r.URL.Path, r)...))
+	defer span.End()
+	if txn := r.Header.Get("X-H123-Txn"); txn != "" {
+		span.SetAttributes(TxnKey.String(txn))
+	}
+	rw := utils.NewResponseWriter(w)
+	h.handler.ServeHTTP(rw, r.WithContext(ctx))
+	status := rw.StatusOrOK()
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(status))
+	if status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+}
+
+// EndClientSpan ends a span around a round trip with its outcome.
+func EndClientSpan(span trace.Span, resp *http.Response, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else {
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(resp.StatusCode))
+	}
+	span.End()
+}
@@ -0,0 +1,148 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+	ExporterFile   = "file"
+)
+
+// TxnKey links the spans of a request to its X-H123-Txn.
+const TxnKey = attribute.Key("h123.txn")
+
+type Config struct {
+	Exporter string // otlp, stdout or file
+	// OTLP over HTTP, host:port of the collector, default localhost:4318
+	Endpoint string
+	Insecure bool
+	Headers  map[string]string
+	File     string    // for the file exporter
+	Output   io.Writer // for the stdout exporter, default os.Stdout
+	// ServiceName defaults to h123-<component>
+	ServiceName string
+	SampleRatio float64 // of the new traces, default 1
+}
+
+// Tracing creates the spans of a component, a nil Tracing creates no spans.
+type Tracing struct {
+	provider   *sdktrace.TracerProvider
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+	file       *os.File
+}
+
+func (cfg *Config) exporter(ctx context.Context) (sdktrace.SpanExporter, *os.File, error) {
+	switch cfg.Exporter {
+	case ExporterOTLP:
+		opts := []otlptracehttp.Option{}
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		if len(cfg.Headers) > 0 {
+			opts = append(opts, otlptracehttp.WithHeaders(cfg.Headers))
+		}
+		exp, err := otlptracehttp.New(ctx, opts...)
+		return exp, nil, err
+	case ExporterStdout:
+		out := cfg.Output
+		if out == nil {
+			out = os.Stdout
+		}
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(out))
+		return exp, nil, err
+	case ExporterFile:
+		file, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, nil, err
+		}
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(file))
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		return exp, file, nil
+	}
+	return nil, nil, fmt.Errorf("unknown trace exporter: %s", cfg.Exporter)
+}
+
+func New(config *Config, component string) (*Tracing, error) {
+	cfg := Config{}
+	if config != nil {
+		cfg = *config
+	}
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = "h123-" + component
+	}
+	if cfg.SampleRatio == 0 {
+		cfg.SampleRatio = 1
+	}
+	exp, file, err := cfg.exporter(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String(cfg.ServiceName))),
+	)
+	return &Tracing{
+		provider:   provider,
+		tracer:     provider.Tracer("github.com/mabels/h123-reflector/" + component),
+		propagator: propagation.TraceContext{},
+		file:       file,
+	}, nil
+}
+
+// Start starts a span below the one in ctx.
+func (t *Tracing) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	if t == nil {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	return t.tracer.Start(ctx, name, opts...)
+}
+
+// Inject writes traceparent and tracestate of the span in ctx.
+func (t *Tracing) Inject(ctx context.Context, carrier propagation.TextMapCarrier) {
+	if t == nil {
+		return
+	}
+	t.propagator.Inject(ctx, carrier)
+}
+
+func (t *Tracing) Extract(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	if t == nil {
+		return ctx
+	}
+	return t.propagator.Extract(ctx, carrier)
+}
+
+// Shutdown exports the pending spans.
+func (t *Tracing) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	err := t.provider.Shutdown(ctx)
+	if t.file != nil {
+		t.file.Close()
+	}
+	return err
+}
@@ -0,0 +1,50 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func Test_Propagation(t *testing.T) {
+	out := &bytes.Buffer{}
+	tr, err := New(&Config{Exporter: ExporterStdout, Output: out}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var serverSpan trace.SpanContext
+	h := Handler(tr, "test.request", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverSpan = trace.SpanContextFromContext(r.Context())
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	ctx, span := tr.Start(context.Background(), "test.forward")
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-H123-Txn", "t1")
+	tr.Inject(ctx, propagation.HeaderCarrier(req.Header))
+	if !strings.HasPrefix(req.Header.Get("traceparent"), "00-"+span.SpanContext().TraceID().String()) {
+		t.Errorf("Unexpected traceparent %q", req.Header.Get("traceparent"))
+	}
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	span.End()
+	if serverSpan.TraceID() != span.SpanContext().TraceID() || serverSpan.SpanID() == span.SpanContext().SpanID() {
+		t.Errorf("Expected a child span of %v, got %v", span.SpanContext(), serverSpan)
+	}
+	tr.Shutdown(context.Background())
+	for _, expected := range []string{`"test.request"`, `"test.forward"`, `"h123.txn"`, `"t1"`, `"Error"`} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected %s in the exported spans", expected)
+		}
+	}
+
+	var none *Tracing
+	_, span = none.Start(context.Background(), "nothing")
+	if span.SpanContext().IsValid() || Handler(none, "x", h) == nil {
+		t.Error("Expected no spans without tracing")
+	}
+}
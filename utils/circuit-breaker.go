@@ -0,0 +1,186 @@
+package utils
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/mabels/h123-reflector/models"
+)
+
+var ErrCircuitOpen = errors.New("circuit open")
+
+type CircuitState string
+
+const (
+	CircuitClosed   CircuitState = "closed"
+	CircuitOpen     CircuitState = "open"
+	CircuitHalfOpen CircuitState = "half-open"
+)
+
+type CircuitConfig struct {
+	ConsecutiveErrors int     // trip after this many errors in a row
+	ErrorRate         float64 // trip if errors/requests within Window reaches this (0..1)
+	MinRequests       int     // ErrorRate is only checked with this many requests in Window
+	Window            time.Duration
+	BaseEjection      time.Duration // doubled on every ejection up to MaxEjection
+	MaxEjection       time.Duration
+	HalfOpenRequests  int // probes let through after the ejection
+}
+
+func (cc *CircuitConfig) setDefaults() {
+	if cc.ConsecutiveErrors == 0 {
+		cc.ConsecutiveErrors = 5
+	}
+	if cc.ErrorRate == 0 {
+		cc.ErrorRate = 0.5
+	}
+	if cc.MinRequests == 0 {
+		cc.MinRequests = 20
+	}
+	if cc.Window == 0 {
+		cc.Window = 10 * time.Second
+	}
+	if cc.BaseEjection == 0 {
+		cc.BaseEjection = time.Second
+	}
+	if cc.MaxEjection == 0 {
+		cc.MaxEjection = time.Minute
+	}
+	if cc.HalfOpenRequests == 0 {
+		cc.HalfOpenRequests = 1
+	}
+}
+
+type CircuitBreaker struct {
+	cfg          CircuitConfig
+	mutex        sync.Mutex
+	state        CircuitState
+	consecutive  int
+	windowStart  time.Time
+	requests     int
+	errors       int
+	ejections    int
+	ejectedUntil time.Time
+	closedSince  time.Time
+	probes       int
+}
+
+func NewCircuitBreaker(cfg CircuitConfig) *CircuitBreaker {
+	cfg.setDefaults()
+	return &CircuitBreaker{cfg: cfg, state: CircuitClosed}
+}
+
+// Allow reports if a request may be sent, in half-open state every
+// allowed request is counted as a probe.
+func (cb *CircuitBreaker) Allow(now time.Time) bool {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	switch cb.state {
+	case CircuitOpen:
+		if now.Before(cb.ejectedUntil) {
+			return false
+		}
+		cb.state = CircuitHalfOpen
+		cb.probes = 0
+		fallthrough
+	case CircuitHalfOpen:
+		if cb.probes >= cb.cfg.HalfOpenRequests {
+			return false
+		}
+		cb.probes++
+	}
+	return true
+}
+
+// Release returns the probe of an allowed request which was never sent.
+func (cb *CircuitBreaker) Release() {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	if cb.state == CircuitHalfOpen && cb.probes > 0 {
+		cb.probes--
+	}
+}
+
+func (cb *CircuitBreaker) count(now time.Time, failed bool) {
+	if now.Sub(cb.windowStart) > cb.cfg.Window {
+		cb.windowStart = now
+		cb.requests = 0
+		cb.errors = 0
+	}
+	cb.requests++
+	if failed {
+		cb.errors++
+	}
+}
+
+func (cb *CircuitBreaker) Success(now time.Time) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	switch cb.state {
+	case CircuitHalfOpen:
+		cb.state = CircuitClosed
+		cb.closedSince = now
+		cb.windowStart = now
+		cb.requests = 0
+		cb.errors = 0
+	case CircuitClosed:
+		// forget old ejections after a quiet period
+		if cb.ejections > 0 && now.Sub(cb.closedSince) > cb.cfg.MaxEjection {
+			cb.ejections = 0
+		}
+	}
+	cb.consecutive = 0
+	cb.count(now, false)
+}
+
+func (cb *CircuitBreaker) Failure(now time.Time) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	cb.consecutive++
+	switch cb.state {
+	case CircuitHalfOpen:
+		cb.trip(now)
+	case CircuitClosed:
+		cb.count(now, true)
+		if cb.consecutive >= cb.cfg.ConsecutiveErrors ||
+			(cb.requests >= cb.cfg.MinRequests &&
+				float64(cb.errors)/float64(cb.requests) >= cb.cfg.ErrorRate) {
+			cb.trip(now)
+		}
+	}
+}
+
+func (cb *CircuitBreaker) trip(now time.Time) {
+	cb.ejections++
+	ejection := cb.cfg.BaseEjection
+	for i := 1; i < cb.ejections && ejection < cb.cfg.MaxEjection; i++ {
+		ejection *= 2
+	}
+	if ejection > cb.cfg.MaxEjection {
+		ejection = cb.cfg.MaxEjection
+	}
+	cb.state = CircuitOpen
+	cb.ejectedUntil = now.Add(ejection)
+}
+
+func (cb *CircuitBreaker) State() CircuitState {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	return cb.state
+}
+
+func (cb *CircuitBreaker) Status() models.CircuitStatus {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	ret := models.CircuitStatus{
+		State:             string(cb.state),
+		ConsecutiveErrors: cb.consecutive,
+		Ejections:         cb.ejections,
+	}
+	if cb.state != CircuitClosed {
+		ejectedUntil := cb.ejectedUntil
+		ret.EjectedUntil = &ejectedUntil
+	}
+	return ret
+}
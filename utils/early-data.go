@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"net/http"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/http3"
+)
+
+// TLSState tells how the connection of a request was set up.
+type TLSState struct {
+	Resumed   bool // from a session ticket
+	Used0RTT  bool // early data was accepted on the connection
+	EarlyData bool // the request arrived before the handshake completed on a 0-RTT connection
+}
+
+// QuicConnection is the connection of a HTTP/3 response, nil for others.
+func QuicConnection(w http.ResponseWriter) quic.EarlyConnection {
+	if h, ok := w.(http3.Hijacker); ok {
+		if conn, ok := h.StreamCreator().(quic.EarlyConnection); ok {
+			return conn
+		}
+	}
+	return nil
+}
+
+// ConnState is the TLSState of the connection r arrived on.
+func ConnState(w http.ResponseWriter, r *http.Request) TLSState {
+	if conn := QuicConnection(w); conn != nil {
+		// before ConnectionState, it waits for the handshake
+		early := false
+		select {
+		case <-conn.HandshakeComplete().Done():
+		default:
+			early = true
+		}
+		state := conn.ConnectionState().TLS
+		// a 1-RTT request may still race the handshake of the server
+		return TLSState{Resumed: state.DidResume, Used0RTT: state.Used0RTT, EarlyData: early && state.Used0RTT}
+	}
+	if r.TLS != nil {
+		return TLSState{Resumed: r.TLS.DidResume}
+	}
+	return TLSState{}
+}
+
+// ReplaySafe are the methods which may be answered from early data, a
+// replayed request must not change anything.
+func ReplaySafe(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// HandshakeKind is full, resumed or 0rtt, it waits for the handshake.
+func HandshakeKind(conn quic.Connection) string {
+	if ec, ok := conn.(quic.EarlyConnection); ok {
+		select {
+		case <-ec.HandshakeComplete().Done():
+		case <-conn.Context().Done():
+		}
+	}
+	state := conn.ConnectionState().TLS
+	switch {
+	case state.Used0RTT:
+		return "0rtt"
+	case state.DidResume:
+		return "resumed"
+	}
+	return "full"
+}
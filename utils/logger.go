@@ -0,0 +1,165 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+type LogConfig struct {
+	Level   string            // default info
+	Levels  map[string]string // by component, overrides Level
+	Console bool              // human readable instead of JSON
+	Output  io.Writer         // default os.Stderr
+}
+
+// logLevels are shared by all loggers derived from one NewLogger.
+type logLevels struct {
+	mutex  sync.Mutex
+	def    zerolog.Level
+	levels map[string]*int32
+}
+
+func (ll *logLevels) get(component string) *int32 {
+	ll.mutex.Lock()
+	defer ll.mutex.Unlock()
+	level, found := ll.levels[component]
+	if !found {
+		level = new(int32)
+		*level = int32(ll.def)
+		ll.levels[component] = level
+	}
+	return level
+}
+
+// Logger writes structured lines with the fields added by With, each
+// component has its own level which can be changed at runtime.
+type Logger struct {
+	component string
+	level     *int32
+	levels    *logLevels
+	zl        zerolog.Logger
+}
+
+func NewLogger(cfgs ...*LogConfig) *Logger {
+	cfg := &LogConfig{}
+	if len(cfgs) > 0 && cfgs[0] != nil {
+		cfg = cfgs[0]
+	}
+	out := cfg.Output
+	if out == nil {
+		out = os.Stderr
+	}
+	if cfg.Console {
+		out = zerolog.ConsoleWriter{Out: out, TimeFormat: time.RFC3339}
+	}
+	def, err := zerolog.ParseLevel(cfg.Level)
+	if err != nil || cfg.Level == "" {
+		def = zerolog.InfoLevel
+	}
+	levels := &logLevels{def: def, levels: map[string]*int32{}}
+	for component, level := range cfg.Levels {
+		l, err := zerolog.ParseLevel(level)
+		if err == nil {
+			*levels.get(component) = int32(l)
+		}
+	}
+	return &Logger{
+		level:  levels.get(""),
+		levels: levels,
+		zl:     zerolog.New(out).With().Timestamp().Logger(),
+	}
+}
+
+// Component returns a logger for the named component.
+func (l *Logger) Component(name string) *Logger {
+	return &Logger{
+		component: name,
+		level:     l.levels.get(name),
+		levels:    l.levels,
+		zl:        l.zl.With().Str("component", name).Logger(),
+	}
+}
+
+func (l *Logger) With(key string, value string) *Logger {
+	my := *l
+	my.zl = l.zl.With().Str(key, value).Logger()
+	return &my
+}
+
+// SetLevel changes the level of a component, of all if component is "".
+func (l *Logger) SetLevel(component string, level string) error {
+	if level == "" {
+		return fmt.Errorf("missing level")
+	}
+	zlevel, err := zerolog.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	if component != "" {
+		atomic.StoreInt32(l.levels.get(component), int32(zlevel))
+		return nil
+	}
+	l.levels.mutex.Lock()
+	defer l.levels.mutex.Unlock()
+	l.levels.def = zlevel
+	for _, lvl := range l.levels.levels {
+		atomic.StoreInt32(lvl, int32(zlevel))
+	}
+	return nil
+}
+
+// Levels returns the level by component, "" is the default.
+func (l *Logger) Levels() map[string]string {
+	l.levels.mutex.Lock()
+	defer l.levels.mutex.Unlock()
+	ret := map[string]string{}
+	names := make([]string, 0, len(l.levels.levels))
+	for name := range l.levels.levels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ret[name] = zerolog.Level(atomic.LoadInt32(l.levels.levels[name])).String()
+	}
+	return ret
+}
+
+// event returns nil if level is disabled, zerolog ignores calls on nil events.
+func (l *Logger) event(level zerolog.Level) *zerolog.Event {
+	if level < zerolog.Level(atomic.LoadInt32(l.level)) {
+		return nil
+	}
+	return l.zl.WithLevel(level)
+}
+
+func (l *Logger) Trace() *zerolog.Event {
+	return l.event(zerolog.TraceLevel)
+}
+
+func (l *Logger) Debug() *zerolog.Event {
+	return l.event(zerolog.DebugLevel)
+}
+
+func (l *Logger) Info() *zerolog.Event {
+	return l.event(zerolog.InfoLevel)
+}
+
+func (l *Logger) Warn() *zerolog.Event {
+	return l.event(zerolog.WarnLevel)
+}
+
+func (l *Logger) Error() *zerolog.Event {
+	return l.event(zerolog.ErrorLevel)
+}
+
+// Fatal logs regardless of the level and exits.
+func (l *Logger) Fatal() *zerolog.Event {
+	return l.zl.Fatal()
+}
@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func Test_LoggerLevels(t *testing.T) {
+	out := &bytes.Buffer{}
+	log := NewLogger(&LogConfig{
+		Level:  "warn",
+		Levels: map[string]string{"mux": "debug"},
+		Output: out,
+	})
+	mux := log.Component("mux").With("txn", "t1")
+	backend := log.Component("backend")
+
+	mux.Debug().Msg("shown")
+	backend.Info().Msg("hidden")
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected one line, got %q", out.String())
+	}
+	line := map[string]string{}
+	json.Unmarshal([]byte(lines[0]), &line)
+	if line["component"] != "mux" || line["txn"] != "t1" || line["level"] != "debug" || line["message"] != "shown" {
+		t.Errorf("Unexpected line %s", lines[0])
+	}
+
+	out.Reset()
+	err := log.SetLevel("backend", "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.Info().Msg("shown")
+	if !strings.Contains(out.String(), `"component":"backend"`) {
+		t.Errorf("Expected backend line after SetLevel, got %q", out.String())
+	}
+
+	out.Reset()
+	log.SetLevel("", "error")
+	mux.Warn().Msg("hidden")
+	log.Component("new").Warn().Msg("hidden")
+	if out.Len() != 0 {
+		t.Errorf("Expected no lines, got %q", out.String())
+	}
+	if log.Levels()["mux"] != "error" || log.SetLevel("mux", "loud") == nil {
+		t.Errorf("Unexpected levels %v", log.Levels())
+	}
+}
@@ -2,7 +2,6 @@ package utils
 
 import (
 	"fmt"
-	"log"
 	"net/url"
 	"time"
 
@@ -18,6 +17,7 @@ type MqttConnection struct {
 	ToStop        bool
 	State         models.ServerStatus
 	ClientOptions *mqtt.ClientOptions
+	Log           *Logger
 }
 
 func (mq *MqttConnection) Stop() {
@@ -32,7 +32,7 @@ func NewMqttConnection(brokerUrl string, opts ...*mqtt.ClientOptions) (*MqttConn
 	if cu.Scheme == "mqtt" {
 		cu.Scheme = "tcp"
 	}
-	ret := MqttConnection{}
+	ret := MqttConnection{Log: NewLogger().Component("mqtt")}
 	// ret.MqttPath = path.Join(cu.Path[1:], "#")
 	cu.Path = "/"
 	ret.ConnectionUrl = cu.String()
@@ -59,7 +59,7 @@ func (mq *MqttConnection) Connect() error {
 }
 
 func (mq *MqttConnection) Subscribe(subPath string, pubFn func(client mqtt.Client, msg mqtt.Message)) error {
-	log.Printf("Mqtt Subscribe on %s:%s", mq.ConnectionUrl, subPath)
+	mq.Log.Info().Str("broker", mq.ConnectionUrl).Str("topic", subPath).Msg("subscribe")
 	if token := mq.c.Subscribe(subPath, 1, pubFn); token.Wait() && token.Error() != nil {
 		return token.Error()
 	}
@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/http3"
+)
+
+// MuxURL is target on the mux endpoint, the path is appended as it is,
+// neither cleaned nor unescaped.
+func MuxURL(muxEndPointUrl string, target *url.URL) (*url.URL, error) {
+	u, err := url.Parse(muxEndPointUrl)
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.TrimSuffix(u.EscapedPath(), "/")
+	u.Path = strings.TrimSuffix(u.Path, "/") + target.Path
+	u.RawPath = prefix + target.EscapedPath()
+	u.RawQuery = target.RawQuery
+	return u, nil
+}
+
+// NewMuxRequest is r sent to the mux endpoint with header and body, a GET
+// goes out in 0-RTT if early is set.
+func NewMuxRequest(ctx context.Context, muxEndPointUrl string, r *http.Request, header http.Header, body io.Reader, early bool) (*http.Request, error) {
+	u, err := MuxURL(muxEndPointUrl, r.URL)
+	if err != nil {
+		return nil, err
+	}
+	method := r.Method
+	if method == http.MethodGet && early {
+		// sent in 0-RTT on a connection which is still resuming
+		method = http3.MethodGet0RTT
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header
+	return req, nil
+}
+
+// MuxResponse fails if the backend failed before the upstream sent
+// anything, or refused early data, the request may go to another backend.
+func MuxResponse(resp *http.Response) (*http.Response, error) {
+	if (resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooEarly) && resp.Header.Get("X-H123-Error") != "" {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", resp.Status, resp.Header.Get("X-H123-Error"))
+	}
+	return resp, nil
+}
+
+// RedialOnClose makes rt dial the backend again after it closed the
+// connection, connected is called with each new connection.
+func RedialOnClose(rt *http3.RoundTripper, connected func(conn quic.EarlyConnection)) {
+	rt.Dial = func(ctx context.Context, addr string, tlsCfg *tls.Config, qcfg *quic.Config) (quic.EarlyConnection, error) {
+		conn, err := quic.DialAddrEarlyContext(ctx, addr, tlsCfg, qcfg)
+		if err == nil {
+			if connected != nil {
+				connected(conn)
+			}
+			// http3 does not dial a closed connection again
+			go func() {
+				<-conn.Context().Done()
+				rt.Close()
+			}()
+		}
+		return conn, err
+	}
+}
+
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+// Retryable tells if a request may be sent again to another backend.
+func Retryable(method string, header http.Header) bool {
+	return idempotentMethods[method] || header.Get("Idempotency-Key") != ""
+}
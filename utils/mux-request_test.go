@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func Test_MuxURL(t *testing.T) {
+	for target, expected := range map[string]string{
+		"/a/b/":          "https://mux:4433/a/b/",
+		"/a/../b?x=1":    "https://mux:4433/a/../b?x=1",
+		"/files/a%2Fb":   "https://mux:4433/files/a%2Fb",
+		"/with%20space/": "https://mux:4433/with%20space/",
+	} {
+		r, _ := url.Parse(target)
+		for _, mux := range []string{"https://mux:4433", "https://mux:4433/"} {
+			u, err := MuxURL(mux, r)
+			if err != nil || u.String() != expected {
+				t.Errorf("Expected %s for %s on %s, got %v %v", expected, target, mux, u, err)
+			}
+		}
+	}
+	r, _ := url.Parse("/x%2Fy")
+	u, _ := MuxURL("https://mux/pre%2Ffix/", r)
+	if u.String() != "https://mux/pre%2Ffix/x%2Fy" {
+		t.Errorf("Expected the escaped prefix kept, got %s", u)
+	}
+}
+
+func Test_Retryable(t *testing.T) {
+	for _, method := range []string{"GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE"} {
+		if !Retryable(method, http.Header{}) {
+			t.Errorf("Expected %s to be retryable", method)
+		}
+	}
+	header := http.Header{}
+	if Retryable("POST", header) {
+		t.Error("Expected POST not to be retryable")
+	}
+	header.Set("Idempotency-Key", "key1")
+	if !Retryable("POST", header) {
+		t.Error("Expected POST with Idempotency-Key to be retryable")
+	}
+}
+
+func Test_MuxResponse(t *testing.T) {
+	for status, failed := range map[int]bool{200: false, 425: true, 502: true} {
+		resp := &http.Response{Status: http.StatusText(status), StatusCode: status, Header: http.Header{}, Body: http.NoBody}
+		resp.Header.Set("X-H123-Error", "dial failed")
+		_, err := MuxResponse(resp)
+		if (err != nil) != failed {
+			t.Errorf("Expected failed %v for %d, got %v", failed, status, err)
+		}
+	}
+	resp := &http.Response{StatusCode: 502, Header: http.Header{}, Body: http.NoBody}
+	if _, err := MuxResponse(resp); err != nil {
+		t.Errorf("Expected an upstream 502 passed on, got %v", err)
+	}
+}
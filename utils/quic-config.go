@@ -0,0 +1,238 @@
+package utils
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/mabels/h123-reflector/models"
+)
+
+// QuicConfig are the tunable transport parameters of a QUIC endpoint, zero
+// values keep the quic-go defaults.
+type QuicConfig struct {
+	MaxIdleTimeout                 time.Duration
+	KeepAlivePeriod                time.Duration
+	HandshakeIdleTimeout           time.Duration
+	InitialStreamReceiveWindow     uint64
+	MaxStreamReceiveWindow         uint64
+	InitialConnectionReceiveWindow uint64
+	MaxConnectionReceiveWindow     uint64
+	MaxIncomingStreams             int64 // negative allows none
+	MaxIncomingUniStreams          int64 // negative allows none
+	EnableDatagrams                bool
+	Versions                       []string // v1, v2 or draft-29, default all
+}
+
+var quicVersions = map[string]quic.VersionNumber{
+	"v1":       quic.Version1,
+	"v2":       quic.Version2,
+	"draft-29": quic.VersionDraft29,
+}
+
+func quicVersionName(v quic.VersionNumber) string {
+	for name, version := range quicVersions {
+		if version == v {
+			return name
+		}
+	}
+	return v.String()
+}
+
+// Apply returns a copy of base with the values which are set.
+func (qc QuicConfig) Apply(base *quic.Config) (*quic.Config, error) {
+	cfg := &quic.Config{}
+	if base != nil {
+		cfg = base.Clone()
+	}
+	if qc.MaxIdleTimeout != 0 {
+		cfg.MaxIdleTimeout = qc.MaxIdleTimeout
+	}
+	if qc.KeepAlivePeriod != 0 {
+		cfg.KeepAlivePeriod = qc.KeepAlivePeriod
+	}
+	if qc.HandshakeIdleTimeout != 0 {
+		cfg.HandshakeIdleTimeout = qc.HandshakeIdleTimeout
+	}
+	if qc.InitialStreamReceiveWindow != 0 {
+		cfg.InitialStreamReceiveWindow = qc.InitialStreamReceiveWindow
+	}
+	if qc.MaxStreamReceiveWindow != 0 {
+		cfg.MaxStreamReceiveWindow = qc.MaxStreamReceiveWindow
+	}
+	if qc.InitialConnectionReceiveWindow != 0 {
+		cfg.InitialConnectionReceiveWindow = qc.InitialConnectionReceiveWindow
+	}
+	if qc.MaxConnectionReceiveWindow != 0 {
+		cfg.MaxConnectionReceiveWindow = qc.MaxConnectionReceiveWindow
+	}
+	if qc.MaxIncomingStreams != 0 {
+		cfg.MaxIncomingStreams = qc.MaxIncomingStreams
+	}
+	if qc.MaxIncomingUniStreams != 0 {
+		cfg.MaxIncomingUniStreams = qc.MaxIncomingUniStreams
+	}
+	if qc.EnableDatagrams {
+		cfg.EnableDatagrams = true
+	}
+	if len(qc.Versions) > 0 {
+		cfg.Versions = nil
+		for _, name := range qc.Versions {
+			version, found := quicVersions[name]
+			if !found {
+				return nil, fmt.Errorf("unknown QUIC version %s", name)
+			}
+			cfg.Versions = append(cfg.Versions, version)
+		}
+	}
+	return cfg, ValidateQuicConfig(cfg)
+}
+
+// effective fills the quic-go defaults into the unset values of cfg.
+func effective(cfg *quic.Config) quic.Config {
+	my := quic.Config{}
+	if cfg != nil {
+		my = *cfg
+	}
+	if my.MaxIdleTimeout == 0 {
+		my.MaxIdleTimeout = 30 * time.Second
+	}
+	if my.HandshakeIdleTimeout == 0 {
+		my.HandshakeIdleTimeout = 5 * time.Second
+	}
+	if my.InitialStreamReceiveWindow == 0 {
+		my.InitialStreamReceiveWindow = 512 * 1024
+	}
+	if my.MaxStreamReceiveWindow == 0 {
+		my.MaxStreamReceiveWindow = 6 * 1024 * 1024
+	}
+	if my.InitialConnectionReceiveWindow == 0 {
+		my.InitialConnectionReceiveWindow = 768 * 1024
+	}
+	if my.MaxConnectionReceiveWindow == 0 {
+		my.MaxConnectionReceiveWindow = 15 * 1024 * 1024
+	}
+	if my.MaxIncomingStreams == 0 {
+		my.MaxIncomingStreams = 100
+	} else if my.MaxIncomingStreams < 0 {
+		my.MaxIncomingStreams = 0
+	}
+	if my.MaxIncomingUniStreams == 0 {
+		my.MaxIncomingUniStreams = 100
+	} else if my.MaxIncomingUniStreams < 0 {
+		my.MaxIncomingUniStreams = 0
+	}
+	if len(my.Versions) == 0 {
+		my.Versions = []quic.VersionNumber{quic.Version1, quic.Version2, quic.VersionDraft29}
+	}
+	return my
+}
+
+// ValidateQuicConfig checks the values of cfg with the defaults of the
+// unset ones.
+func ValidateQuicConfig(cfg *quic.Config) error {
+	my := effective(cfg)
+	switch {
+	case my.MaxIdleTimeout < 0 || my.HandshakeIdleTimeout < 0 || my.KeepAlivePeriod < 0:
+		return fmt.Errorf("QUIC timeouts must not be negative")
+	case my.KeepAlivePeriod >= my.MaxIdleTimeout:
+		return fmt.Errorf("QUIC KeepAlivePeriod %s must be shorter than MaxIdleTimeout %s", my.KeepAlivePeriod, my.MaxIdleTimeout)
+	case my.InitialStreamReceiveWindow > my.MaxStreamReceiveWindow:
+		return fmt.Errorf("QUIC InitialStreamReceiveWindow %d exceeds MaxStreamReceiveWindow %d", my.InitialStreamReceiveWindow, my.MaxStreamReceiveWindow)
+	case my.InitialConnectionReceiveWindow > my.MaxConnectionReceiveWindow:
+		return fmt.Errorf("QUIC InitialConnectionReceiveWindow %d exceeds MaxConnectionReceiveWindow %d", my.InitialConnectionReceiveWindow, my.MaxConnectionReceiveWindow)
+	case my.MaxStreamReceiveWindow > my.MaxConnectionReceiveWindow:
+		return fmt.Errorf("QUIC MaxStreamReceiveWindow %d exceeds MaxConnectionReceiveWindow %d", my.MaxStreamReceiveWindow, my.MaxConnectionReceiveWindow)
+	case my.MaxIncomingStreams > 1<<60 || my.MaxIncomingUniStreams > 1<<60:
+		return fmt.Errorf("QUIC MaxIncomingStreams must not exceed 2^60")
+	}
+	return nil
+}
+
+// QuicStatus reports the effective values of cfg.
+func QuicStatus(cfg *quic.Config) models.QuicStatus {
+	my := effective(cfg)
+	versions := []string{}
+	for _, v := range my.Versions {
+		versions = append(versions, quicVersionName(v))
+	}
+	return models.QuicStatus{
+		MaxIdleTimeout:                 my.MaxIdleTimeout.String(),
+		KeepAlivePeriod:                my.KeepAlivePeriod.String(),
+		HandshakeIdleTimeout:           my.HandshakeIdleTimeout.String(),
+		InitialStreamReceiveWindow:     my.InitialStreamReceiveWindow,
+		MaxStreamReceiveWindow:         my.MaxStreamReceiveWindow,
+		InitialConnectionReceiveWindow: my.InitialConnectionReceiveWindow,
+		MaxConnectionReceiveWindow:     my.MaxConnectionReceiveWindow,
+		MaxIncomingStreams:             my.MaxIncomingStreams,
+		MaxIncomingUniStreams:          my.MaxIncomingUniStreams,
+		EnableDatagrams:                my.EnableDatagrams,
+		Versions:                       versions,
+	}
+}
+
+// UnmarshalJSON reads the durations as strings like 30s.
+func (qc *QuicConfig) UnmarshalJSON(data []byte) error {
+	type plain QuicConfig
+	my := struct {
+		*plain
+		MaxIdleTimeout       string
+		KeepAlivePeriod      string
+		HandshakeIdleTimeout string
+	}{plain: (*plain)(qc)}
+	err := json.Unmarshal(data, &my)
+	if err != nil {
+		return err
+	}
+	for _, d := range []struct {
+		name   string
+		value  string
+		target *time.Duration
+	}{
+		{"MaxIdleTimeout", my.MaxIdleTimeout, &qc.MaxIdleTimeout},
+		{"KeepAlivePeriod", my.KeepAlivePeriod, &qc.KeepAlivePeriod},
+		{"HandshakeIdleTimeout", my.HandshakeIdleTimeout, &qc.HandshakeIdleTimeout},
+	} {
+		if d.value == "" {
+			continue
+		}
+		*d.target, err = time.ParseDuration(d.value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", d.name, err)
+		}
+	}
+	return nil
+}
+
+type stringsFlag struct{ values *[]string }
+
+func (sf stringsFlag) String() string {
+	if sf.values == nil {
+		return ""
+	}
+	return strings.Join(*sf.values, ",")
+}
+
+func (sf stringsFlag) Set(value string) error {
+	*sf.values = strings.Split(value, ",")
+	return nil
+}
+
+// Flags adds the values as flags named prefix-max-idle-timeout and so on,
+// the current values are the defaults.
+func (qc *QuicConfig) Flags(fs *flag.FlagSet, prefix string) {
+	fs.DurationVar(&qc.MaxIdleTimeout, prefix+"-max-idle-timeout", qc.MaxIdleTimeout, "QUIC idle timeout")
+	fs.DurationVar(&qc.KeepAlivePeriod, prefix+"-keep-alive-period", qc.KeepAlivePeriod, "QUIC keep-alive period, 0 disables")
+	fs.DurationVar(&qc.HandshakeIdleTimeout, prefix+"-handshake-idle-timeout", qc.HandshakeIdleTimeout, "QUIC handshake idle timeout")
+	fs.Uint64Var(&qc.InitialStreamReceiveWindow, prefix+"-initial-stream-window", qc.InitialStreamReceiveWindow, "QUIC initial stream flow-control window")
+	fs.Uint64Var(&qc.MaxStreamReceiveWindow, prefix+"-max-stream-window", qc.MaxStreamReceiveWindow, "QUIC max stream flow-control window")
+	fs.Uint64Var(&qc.InitialConnectionReceiveWindow, prefix+"-initial-connection-window", qc.InitialConnectionReceiveWindow, "QUIC initial connection flow-control window")
+	fs.Uint64Var(&qc.MaxConnectionReceiveWindow, prefix+"-max-connection-window", qc.MaxConnectionReceiveWindow, "QUIC max connection flow-control window")
+	fs.Int64Var(&qc.MaxIncomingStreams, prefix+"-max-incoming-streams", qc.MaxIncomingStreams, "QUIC max incoming bidirectional streams")
+	fs.Int64Var(&qc.MaxIncomingUniStreams, prefix+"-max-incoming-uni-streams", qc.MaxIncomingUniStreams, "QUIC max incoming unidirectional streams")
+	fs.BoolVar(&qc.EnableDatagrams, prefix+"-datagrams", qc.EnableDatagrams, "QUIC datagram support")
+	fs.Var(stringsFlag{values: &qc.Versions}, prefix+"-versions", "QUIC versions, comma separated v1, v2 or draft-29")
+}
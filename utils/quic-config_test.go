@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"encoding/json"
+	"flag"
+	"testing"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+func Test_QuicConfig(t *testing.T) {
+	qc := QuicConfig{}
+	err := json.Unmarshal([]byte(`{"MaxIdleTimeout":"1m","KeepAlivePeriod":"15s","MaxIncomingStreams":500,"Versions":["v1"]}`), &qc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qc.MaxIdleTimeout != time.Minute || qc.KeepAlivePeriod != 15*time.Second || qc.MaxIncomingStreams != 500 {
+		t.Errorf("Expected the JSON values, got %+v", qc)
+	}
+	if json.Unmarshal([]byte(`{"MaxIdleTimeout":"soon"}`), &QuicConfig{}) == nil {
+		t.Error("Expected an error for a broken duration")
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	qc.Flags(fs, "quic")
+	if err := fs.Parse([]string{"-quic-max-stream-window", "1048576", "-quic-versions", "v1,v2"}); err != nil {
+		t.Fatal(err)
+	}
+	base := &quic.Config{EnableDatagrams: true}
+	cfg, err := qc.Apply(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg == base || !cfg.EnableDatagrams || cfg.MaxStreamReceiveWindow != 1<<20 || cfg.MaxIdleTimeout != time.Minute {
+		t.Errorf("Expected a copy of base with the values, got %+v", cfg)
+	}
+	status := QuicStatus(cfg)
+	if status.MaxIdleTimeout != "1m0s" || status.MaxIncomingUniStreams != 100 || len(status.Versions) != 2 || status.Versions[1] != "v2" {
+		t.Errorf("Expected the effective values, got %+v", status)
+	}
+
+	for _, broken := range []QuicConfig{
+		{KeepAlivePeriod: time.Minute},
+		{InitialStreamReceiveWindow: 8 << 20},
+		{MaxStreamReceiveWindow: 32 << 20},
+		{Versions: []string{"v3"}},
+	} {
+		if _, err := broken.Apply(nil); err == nil {
+			t.Errorf("Expected an error for %+v", broken)
+		}
+	}
+}
@@ -1,8 +1,8 @@
 package utils
 
 import (
+	"crypto/tls"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
 	"path"
@@ -10,16 +10,18 @@ import (
 	"github.com/google/uuid"
 	"github.com/lucas-clemente/quic-go"
 	"github.com/lucas-clemente/quic-go/http3"
+	"github.com/lucas-clemente/quic-go/logging"
 )
 
 type Quicer struct {
 	Cfg          quic.Config
 	RoundTripper *http3.RoundTripper
 	Client       *http.Client
+	Log          *Logger
 }
 
 func QuicConnect(cfg *quic.Config) (*Quicer, error) {
-	quicer := Quicer{}
+	quicer := Quicer{Log: NewLogger().Component("quicer")}
 	if cfg != nil {
 		quicer.Cfg = *cfg
 	}
@@ -28,7 +30,7 @@ func QuicConnect(cfg *quic.Config) (*Quicer, error) {
 	quicer.RoundTripper = &http3.RoundTripper{
 		QuicConfig: &quicer.Cfg,
 		StreamHijacker: func(ftype http3.FrameType, conn quic.Connection, stream quic.Stream, _err error) (hijacked bool, err error) {
-			log.Printf("HIJACKED:%s", conn.RemoteAddr().String())
+			quicer.Log.Debug().Str("remote", conn.RemoteAddr().String()).Uint64("frame", uint64(ftype)).Msg("unknown frame")
 			return false, nil
 		},
 	}
@@ -38,6 +40,32 @@ func QuicConnect(cfg *quic.Config) (*Quicer, error) {
 	return &quicer, nil
 }
 
+// SetKeyLog writes the TLS secrets of new connections to w in the
+// SSLKEYLOGFILE format, nil keeps them secret.
+func (q *Quicer) SetKeyLog(w io.Writer) {
+	if w == nil {
+		return
+	}
+	tlsCfg := &tls.Config{}
+	if q.RoundTripper.TLSClientConfig != nil {
+		tlsCfg = q.RoundTripper.TLSClientConfig.Clone()
+	}
+	tlsCfg.KeyLogWriter = w
+	q.RoundTripper.TLSClientConfig = tlsCfg
+}
+
+// SetTracer adds tracer to the connections dialed from now on, nil
+// changes nothing.
+func (q *Quicer) SetTracer(tracer logging.Tracer) {
+	if tracer == nil {
+		return
+	}
+	if q.Cfg.Tracer != nil {
+		tracer = logging.NewMultiplexedTracer(q.Cfg.Tracer, tracer)
+	}
+	q.Cfg.Tracer = tracer
+}
+
 func (q *Quicer) Close() {
 	q.RoundTripper.Close()
 }
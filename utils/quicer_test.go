@@ -0,0 +1,26 @@
+package utils
+
+import (
+	"io"
+	"testing"
+
+	"github.com/lucas-clemente/quic-go/logging"
+	"github.com/lucas-clemente/quic-go/qlog"
+)
+
+func Test_QuicerTracer(t *testing.T) {
+	q, _ := QuicConnect(nil)
+	q.SetTracer(nil)
+	if q.Cfg.Tracer != nil {
+		t.Error("Expected no tracer")
+	}
+	tracer := qlog.NewTracer(func(logging.Perspective, []byte) io.WriteCloser { return nil })
+	q.SetTracer(tracer)
+	if q.RoundTripper.QuicConfig.Tracer != tracer {
+		t.Error("Expected the tracer in the config of the round tripper")
+	}
+	q.SetTracer(tracer)
+	if q.Cfg.Tracer == tracer {
+		t.Error("Expected both tracers")
+	}
+}
@@ -0,0 +1,268 @@
+package utils
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrLimited = errors.New("limit exceeded")
+
+// LimitedError tells when a rejected request may be tried again.
+type LimitedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LimitedError) Error() string {
+	return ErrLimited.Error()
+}
+
+func (e *LimitedError) Unwrap() error {
+	return ErrLimited
+}
+
+// RetryAfterSeconds is the Retry-After header value, at least 1.
+func (e *LimitedError) RetryAfterSeconds() int {
+	return int(math.Max(1, math.Ceil(e.RetryAfter.Seconds())))
+}
+
+const (
+	RateKeyIP       = "ip"
+	RateKeyUpstream = "upstream"
+	RateKeyHeader   = "header:" // followed by the header name
+)
+
+type RateLimitConfig struct {
+	Rate  float64 // requests per second, 0 disables the limit
+	Burst int     // default Rate rounded up
+	// Key selects the bucket: ip (default), upstream or header:<Name>
+	Key string
+	// QueueTimeout lets requests wait up to this for their turn instead
+	// of being rejected at once.
+	QueueTimeout time.Duration
+	MaxKeys      int // buckets kept, the least recently used is dropped, default 10000
+}
+
+func (rc *RateLimitConfig) setDefaults() {
+	if rc.Burst == 0 {
+		rc.Burst = int(math.Ceil(rc.Rate))
+	}
+	if rc.Key == "" {
+		rc.Key = RateKeyIP
+	}
+	if rc.MaxKeys == 0 {
+		rc.MaxKeys = 10000
+	}
+}
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter is a token bucket per key, a nil RateLimiter allows all.
+type RateLimiter struct {
+	cfg     RateLimitConfig
+	mutex   sync.Mutex
+	order   *list.List // of the buckets, the most recently used first
+	buckets map[string]*list.Element
+}
+
+func NewRateLimiter(cfg RateLimitConfig) *RateLimiter {
+	if cfg.Rate <= 0 {
+		return nil
+	}
+	cfg.setDefaults()
+	return &RateLimiter{cfg: cfg, order: list.New(), buckets: map[string]*list.Element{}}
+}
+
+// RequestKey is the bucket key of a request, upstream is used for the
+// upstream key.
+func (rl *RateLimiter) RequestKey(r *http.Request, upstream string) string {
+	switch {
+	case rl.cfg.Key == RateKeyUpstream:
+		return upstream
+	case strings.HasPrefix(rl.cfg.Key, RateKeyHeader):
+		return r.Header.Get(strings.TrimPrefix(rl.cfg.Key, RateKeyHeader))
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// bucket returns the bucket of key, a new one replaces the least
+// recently used one if there are MaxKeys.
+func (rl *RateLimiter) bucket(key string, now time.Time) *bucket {
+	if el, found := rl.buckets[key]; found {
+		rl.order.MoveToFront(el)
+		return el.Value.(*bucket)
+	}
+	if rl.order.Len() >= rl.cfg.MaxKeys {
+		oldest := rl.order.Back()
+		rl.order.Remove(oldest)
+		delete(rl.buckets, oldest.Value.(*bucket).key)
+	}
+	b := &bucket{key: key, tokens: float64(rl.cfg.Burst), last: now}
+	rl.buckets[key] = rl.order.PushFront(b)
+	return b
+}
+
+// Reserve takes a token of key. If there is none the request has to
+// wait, within QueueTimeout the token is reserved and ok is true.
+func (rl *RateLimiter) Reserve(key string, now time.Time) (wait time.Duration, ok bool) {
+	if rl == nil {
+		return 0, true
+	}
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	b := rl.bucket(key, now)
+	b.tokens = math.Min(float64(rl.cfg.Burst), b.tokens+now.Sub(b.last).Seconds()*rl.cfg.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	wait = time.Duration((1 - b.tokens) / rl.cfg.Rate * float64(time.Second))
+	if wait > rl.cfg.QueueTimeout {
+		return wait, false
+	}
+	b.tokens--
+	return wait, true
+}
+
+// cancel gives back a token Reserve took for a request which gave up.
+func (rl *RateLimiter) cancel(key string) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	if el, found := rl.buckets[key]; found {
+		b := el.Value.(*bucket)
+		b.tokens = math.Min(float64(rl.cfg.Burst), b.tokens+1)
+	}
+}
+
+// Wait takes a token of key, waiting for it within QueueTimeout. It
+// returns queued if the request had to wait or a *LimitedError.
+func (rl *RateLimiter) Wait(ctx context.Context, key string) (queued bool, err error) {
+	wait, ok := rl.Reserve(key, time.Now())
+	if !ok {
+		return false, &LimitedError{RetryAfter: wait}
+	}
+	if wait == 0 {
+		return false, nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true, nil
+	case <-ctx.Done():
+		rl.cancel(key)
+		return true, ctx.Err()
+	}
+}
+
+type ConcurrencyConfig struct {
+	MaxInFlight  int // per key, 0 disables the limit
+	QueueTimeout time.Duration
+}
+
+// ConcurrencyLimiter limits the requests in flight per key, a nil
+// ConcurrencyLimiter allows all.
+type ConcurrencyLimiter struct {
+	cfg   ConcurrencyConfig
+	mutex sync.Mutex
+	slots map[string]*keySlots
+}
+
+// keySlots are the slots of a key, they are dropped once nobody holds
+// or waits for one.
+type keySlots struct {
+	slots chan struct{}
+	users int
+}
+
+func NewConcurrencyLimiter(cfg ConcurrencyConfig) *ConcurrencyLimiter {
+	if cfg.MaxInFlight <= 0 {
+		return nil
+	}
+	return &ConcurrencyLimiter{cfg: cfg, slots: map[string]*keySlots{}}
+}
+
+func (cl *ConcurrencyLimiter) keySlots(key string) *keySlots {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	ks, found := cl.slots[key]
+	if !found {
+		ks = &keySlots{slots: make(chan struct{}, cl.cfg.MaxInFlight)}
+		cl.slots[key] = ks
+	}
+	ks.users++
+	return ks
+}
+
+func (cl *ConcurrencyLimiter) done(key string, ks *keySlots) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	ks.users--
+	if ks.users == 0 {
+		delete(cl.slots, key)
+	}
+}
+
+// Acquire waits up to QueueTimeout for a slot of key, release has to be
+// called once the request is done. It returns queued if the request had
+// to wait or a *LimitedError.
+func (cl *ConcurrencyLimiter) Acquire(ctx context.Context, key string) (release func(), queued bool, err error) {
+	if cl == nil {
+		return func() {}, false, nil
+	}
+	ks := cl.keySlots(key)
+	release = func() {
+		<-ks.slots
+		cl.done(key, ks)
+	}
+	select {
+	case ks.slots <- struct{}{}:
+		return release, false, nil
+	default:
+	}
+	if cl.cfg.QueueTimeout == 0 {
+		cl.done(key, ks)
+		return nil, false, &LimitedError{RetryAfter: time.Second}
+	}
+	timer := time.NewTimer(cl.cfg.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case ks.slots <- struct{}{}:
+		return release, true, nil
+	case <-timer.C:
+		cl.done(key, ks)
+		return nil, true, &LimitedError{RetryAfter: cl.cfg.QueueTimeout}
+	case <-ctx.Done():
+		cl.done(key, ks)
+		return nil, true, ctx.Err()
+	}
+}
+
+// InFlight is the number of requests holding a slot.
+func (cl *ConcurrencyLimiter) InFlight() int {
+	if cl == nil {
+		return 0
+	}
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	n := 0
+	for _, ks := range cl.slots {
+		n += len(ks.slots)
+	}
+	return n
+}
@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_RateLimiter(t *testing.T) {
+	if NewRateLimiter(RateLimitConfig{}) != nil {
+		t.Error("Expected no limiter without rate")
+	}
+	rl := NewRateLimiter(RateLimitConfig{Rate: 2, Burst: 2, QueueTimeout: 300 * time.Millisecond})
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if wait, ok := rl.Reserve("a", now); wait != 0 || !ok {
+			t.Errorf("Expected burst token %d, got %v %v", i, wait, ok)
+		}
+	}
+	if wait, ok := rl.Reserve("a", now); wait != 500*time.Millisecond || ok {
+		t.Errorf("Expected rejection after the burst, got %v %v", wait, ok)
+	}
+	if wait, ok := rl.Reserve("b", now); wait != 0 || !ok {
+		t.Error("Expected an own bucket per key")
+	}
+	// 0.5 token refilled, the next one is 250ms away
+	if wait, ok := rl.Reserve("a", now.Add(250*time.Millisecond)); wait != 250*time.Millisecond || !ok {
+		t.Errorf("Expected to queue, got %v %v", wait, ok)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:4711"
+	req.Header.Set("X-Api-Key", "k1")
+	for key, expected := range map[string]string{"": "10.0.0.1", "upstream": "up:443", "header:X-Api-Key": "k1"} {
+		rl := NewRateLimiter(RateLimitConfig{Rate: 1, Key: key})
+		if got := rl.RequestKey(req, "up:443"); got != expected {
+			t.Errorf("Expected key %s for %q, got %s", expected, key, got)
+		}
+	}
+
+	rl = NewRateLimiter(RateLimitConfig{Rate: 1})
+	rl.Wait(context.Background(), "c")
+	_, err := rl.Wait(context.Background(), "c")
+	var lerr *LimitedError
+	if !errors.As(err, &lerr) || lerr.RetryAfterSeconds() != 1 {
+		t.Errorf("Expected limited error, got %v", err)
+	}
+
+	// a cancelled wait gives its token back
+	rl = NewRateLimiter(RateLimitConfig{Rate: 1, QueueTimeout: time.Second})
+	rl.Wait(context.Background(), "d")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if queued, err := rl.Wait(ctx, "d"); !queued || err == nil {
+		t.Errorf("Expected the wait to be cancelled, got %v %v", queued, err)
+	}
+	if wait, _ := rl.Reserve("d", time.Now()); wait > 1500*time.Millisecond {
+		t.Errorf("Expected the token back, wait %v", wait)
+	}
+
+	rl = NewRateLimiter(RateLimitConfig{Rate: 1, MaxKeys: 2})
+	rl.Reserve("e", now)
+	rl.Reserve("f", now)
+	rl.Reserve("e", now)
+	rl.Reserve("g", now)
+	if len(rl.buckets) != 2 || rl.buckets["f"] != nil {
+		t.Errorf("Expected the least recently used bucket dropped, got %v", rl.buckets)
+	}
+}
+
+func Test_ConcurrencyLimiter(t *testing.T) {
+	cl := NewConcurrencyLimiter(ConcurrencyConfig{MaxInFlight: 1, QueueTimeout: 50 * time.Millisecond})
+	release, queued, err := cl.Acquire(context.Background(), "up")
+	if err != nil || queued || cl.InFlight() != 1 {
+		t.Fatalf("Expected a slot, got %v %v", queued, err)
+	}
+	_, queued, err = cl.Acquire(context.Background(), "up")
+	if !errors.Is(err, ErrLimited) || !queued {
+		t.Errorf("Expected to time out, got %v %v", queued, err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		release()
+	}()
+	release, queued, err = cl.Acquire(context.Background(), "up")
+	if err != nil || !queued {
+		t.Errorf("Expected the released slot, got %v %v", queued, err)
+	}
+	release()
+	if cl.InFlight() != 0 || len(cl.slots) != 0 {
+		t.Errorf("Expected no requests in flight, got %d of %d keys", cl.InFlight(), len(cl.slots))
+	}
+	var none *ConcurrencyLimiter
+	if release, _, err := none.Acquire(context.Background(), "up"); err != nil || release == nil {
+		t.Error("Expected no limit")
+	}
+}
@@ -0,0 +1,346 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/quicvarint"
+)
+
+// RelayFrameType starts a bidirectional stream a frontend opens to a
+// backend to relay a CONNECT or CONNECT-UDP to the target.
+const RelayFrameType = 0x48313233
+
+// capsuleDatagram is the DATAGRAM capsule type of RFC 9297.
+const capsuleDatagram = 0x00
+
+const maxRelayHeader = 64 * 1024
+
+var ErrDatagramStreamClosed = errors.New("datagram stream closed")
+
+type RelayRequest struct {
+	Network string // tcp or udp
+	Address string
+	Txn     string `json:",omitempty"`
+}
+
+type RelayResponse struct {
+	Error string `json:",omitempty"`
+}
+
+// WriteRelayHeader writes the length prefixed json of v, with the frame
+// type in front if frameType is not 0.
+func WriteRelayHeader(w io.Writer, frameType uint64, v interface{}) error {
+	out, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	if frameType != 0 {
+		quicvarint.Write(buf, frameType)
+	}
+	quicvarint.Write(buf, uint64(len(out)))
+	buf.Write(out)
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+func ReadRelayHeader(r io.Reader, v interface{}) error {
+	l, err := quicvarint.Read(quicvarint.NewReader(r))
+	if err != nil {
+		return err
+	}
+	if l > maxRelayHeader {
+		return fmt.Errorf("relay header too large: %d", l)
+	}
+	buf := make([]byte, l)
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// RelayStream adapts a quic stream to Relay, CloseWrite finishes the
+// sending side while Close gives up on both sides.
+type RelayStream struct {
+	quic.Stream
+}
+
+func (rs RelayStream) CloseWrite() error {
+	return rs.Stream.Close()
+}
+
+func (rs RelayStream) Close() error {
+	rs.Stream.CancelRead(0)
+	return rs.Stream.Close()
+}
+
+// Relay copies between a and b until both directions are done. A side
+// which supports it is half closed at the end of its direction, else and
+// on errors both are closed right away.
+func Relay(a io.ReadWriteCloser, b io.ReadWriteCloser) {
+	done := make(chan error, 2)
+	forward := func(to io.ReadWriteCloser, from io.ReadWriteCloser) {
+		_, err := io.Copy(to, from)
+		if err == nil {
+			if cw, ok := to.(closeWriter); ok {
+				err = cw.CloseWrite()
+			} else {
+				err = io.EOF
+			}
+		}
+		done <- err
+	}
+	go forward(a, b)
+	go forward(b, a)
+	if <-done != nil {
+		a.Close()
+		b.Close()
+	}
+	<-done
+	a.Close()
+	b.Close()
+}
+
+type DatagramConn interface {
+	ReadDatagram() ([]byte, error)
+	WriteDatagram([]byte) error
+	Close() error
+}
+
+// RelayDatagrams forwards datagrams between a and b until one side fails.
+func RelayDatagrams(a DatagramConn, b DatagramConn) {
+	done := make(chan struct{}, 2)
+	forward := func(from DatagramConn, to DatagramConn) {
+		defer func() { done <- struct{}{} }()
+		for {
+			p, err := from.ReadDatagram()
+			if err != nil {
+				return
+			}
+			if to.WriteDatagram(p) != nil {
+				return
+			}
+		}
+	}
+	go forward(a, b)
+	go forward(b, a)
+	<-done
+	a.Close()
+	b.Close()
+	<-done
+}
+
+// datagramMux dispatches the QUIC datagrams of a connection to the
+// request streams by their quarter stream id (RFC 9297).
+type datagramMux struct {
+	mutex   sync.Mutex
+	streams map[uint64]chan []byte
+}
+
+var datagramMuxes = struct {
+	sync.Mutex
+	m map[quic.Connection]*datagramMux
+}{m: map[quic.Connection]*datagramMux{}}
+
+func datagramMuxFor(conn quic.Connection) *datagramMux {
+	datagramMuxes.Lock()
+	defer datagramMuxes.Unlock()
+	mux, found := datagramMuxes.m[conn]
+	if found {
+		return mux
+	}
+	mux = &datagramMux{streams: map[uint64]chan []byte{}}
+	datagramMuxes.m[conn] = mux
+	go func() {
+		for {
+			msg, err := conn.ReceiveMessage()
+			if err != nil {
+				break
+			}
+			r := bytes.NewReader(msg)
+			quarter, err := quicvarint.Read(r)
+			if err != nil {
+				continue
+			}
+			mux.mutex.Lock()
+			ch, found := mux.streams[quarter]
+			if found {
+				select {
+				case ch <- msg[len(msg)-r.Len():]:
+				default:
+					// like UDP, drop if nobody keeps up
+				}
+			}
+			mux.mutex.Unlock()
+		}
+		datagramMuxes.Lock()
+		delete(datagramMuxes.m, conn)
+		datagramMuxes.Unlock()
+	}()
+	return mux
+}
+
+func (mux *datagramMux) register(quarter uint64) chan []byte {
+	mux.mutex.Lock()
+	defer mux.mutex.Unlock()
+	ch := make(chan []byte, 64)
+	mux.streams[quarter] = ch
+	return ch
+}
+
+func (mux *datagramMux) unregister(quarter uint64) {
+	mux.mutex.Lock()
+	defer mux.mutex.Unlock()
+	delete(mux.streams, quarter)
+}
+
+// DatagramStream carries the HTTP datagrams of one stream, as QUIC
+// datagrams if the connection supports them, as capsules on the stream
+// otherwise. Received capsules are accepted in any case.
+type DatagramStream struct {
+	conn        quic.Connection
+	stream      io.ReadWriteCloser
+	quarter     uint64
+	mux         *datagramMux
+	incoming    chan []byte
+	done        chan struct{}
+	closeOnce   sync.Once
+	writeMutex  sync.Mutex
+	useDatagram bool
+}
+
+func NewDatagramStream(conn quic.Connection, stream io.ReadWriteCloser, streamID quic.StreamID) *DatagramStream {
+	ds := &DatagramStream{
+		conn:        conn,
+		stream:      stream,
+		quarter:     uint64(streamID) / 4,
+		done:        make(chan struct{}),
+		useDatagram: conn.ConnectionState().SupportsDatagrams,
+	}
+	if ds.useDatagram {
+		ds.mux = datagramMuxFor(conn)
+		ds.incoming = ds.mux.register(ds.quarter)
+	} else {
+		ds.incoming = make(chan []byte, 64)
+	}
+	go ds.readCapsules()
+	return ds
+}
+
+func (ds *DatagramStream) readCapsules() {
+	defer ds.Close()
+	r := quicvarint.NewReader(ds.stream)
+	for {
+		capsuleType, err := quicvarint.Read(r)
+		if err != nil {
+			return
+		}
+		l, err := quicvarint.Read(r)
+		if err != nil || l > maxRelayHeader {
+			return
+		}
+		buf := make([]byte, l)
+		_, err = io.ReadFull(ds.stream, buf)
+		if err != nil {
+			return
+		}
+		if capsuleType != capsuleDatagram {
+			// unknown capsules are skipped
+			continue
+		}
+		select {
+		case ds.incoming <- buf:
+		case <-ds.done:
+			return
+		}
+	}
+}
+
+// ReadDatagram returns the payload of the next datagram with context id 0.
+func (ds *DatagramStream) ReadDatagram() ([]byte, error) {
+	for {
+		select {
+		case msg := <-ds.incoming:
+			r := bytes.NewReader(msg)
+			contextID, err := quicvarint.Read(r)
+			if err != nil || contextID != 0 {
+				continue
+			}
+			return msg[len(msg)-r.Len():], nil
+		case <-ds.done:
+			return nil, ErrDatagramStreamClosed
+		}
+	}
+}
+
+func (ds *DatagramStream) WriteDatagram(p []byte) error {
+	payload := &bytes.Buffer{}
+	quicvarint.Write(payload, 0) // context id
+	payload.Write(p)
+	if ds.useDatagram {
+		msg := &bytes.Buffer{}
+		quicvarint.Write(msg, ds.quarter)
+		msg.Write(payload.Bytes())
+		if ds.conn.SendMessage(msg.Bytes()) == nil {
+			return nil
+		}
+		// too large for a QUIC datagram, send it as capsule
+	}
+	capsule := &bytes.Buffer{}
+	quicvarint.Write(capsule, capsuleDatagram)
+	quicvarint.Write(capsule, uint64(payload.Len()))
+	capsule.Write(payload.Bytes())
+	ds.writeMutex.Lock()
+	defer ds.writeMutex.Unlock()
+	_, err := ds.stream.Write(capsule.Bytes())
+	return err
+}
+
+func (ds *DatagramStream) Close() error {
+	ds.closeOnce.Do(func() {
+		close(ds.done)
+		ds.stream.Close()
+		if ds.mux != nil {
+			ds.mux.unregister(ds.quarter)
+		}
+	})
+	return nil
+}
+
+// UDPDatagramConn closes after IdleTimeout without a received datagram.
+type UDPDatagramConn struct {
+	Conn        *net.UDPConn
+	IdleTimeout time.Duration
+}
+
+func (u UDPDatagramConn) ReadDatagram() ([]byte, error) {
+	buf := make([]byte, 64*1024)
+	u.Conn.SetReadDeadline(time.Now().Add(u.IdleTimeout))
+	n, err := u.Conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func (u UDPDatagramConn) WriteDatagram(p []byte) error {
+	_, err := u.Conn.Write(p)
+	return err
+}
+
+func (u UDPDatagramConn) Close() error {
+	return u.Conn.Close()
+}
@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/http3"
+)
+
+// ResponseWriter records the status and size of a response, the Flusher
+// and Hijackers of the wrapped writer stay reachable.
+type ResponseWriter struct {
+	http.ResponseWriter
+	Status int
+	Bytes  int64
+}
+
+// NewResponseWriter wraps w, an already wrapped w is returned as it is.
+func NewResponseWriter(w http.ResponseWriter) *ResponseWriter {
+	if rw, ok := w.(*ResponseWriter); ok {
+		return rw
+	}
+	return &ResponseWriter{ResponseWriter: w}
+}
+
+func (rw *ResponseWriter) WriteHeader(status int) {
+	if rw.Status == 0 {
+		rw.Status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *ResponseWriter) Write(p []byte) (int, error) {
+	if rw.Status == 0 {
+		rw.Status = http.StatusOK
+	}
+	n, err := rw.ResponseWriter.Write(p)
+	rw.Bytes += int64(n)
+	return n, err
+}
+
+// StatusOrOK is the status of the response, handlers which did not
+// write anything answered 200.
+func (rw *ResponseWriter) StatusOrOK() int {
+	if rw.Status == 0 {
+		return http.StatusOK
+	}
+	return rw.Status
+}
+
+func (rw *ResponseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rw *ResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := rw.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, fmt.Errorf("%T is no http.Hijacker", rw.ResponseWriter)
+}
+
+func (rw *ResponseWriter) StreamCreator() http3.StreamCreator {
+	if h, ok := rw.ResponseWriter.(http3.Hijacker); ok {
+		return h.StreamCreator()
+	}
+	return nil
+}
+
+// RequestBody counts the bytes read from a request body, a HTTP/3 body
+// can still be taken over with HTTPStream.
+type RequestBody struct {
+	io.ReadCloser
+	Bytes int64
+}
+
+func (rb *RequestBody) Read(p []byte) (int, error) {
+	n, err := rb.ReadCloser.Read(p)
+	rb.Bytes += int64(n)
+	return n, err
+}
+
+func (rb *RequestBody) HTTPStream() http3.Stream {
+	if s, ok := rb.ReadCloser.(http3.HTTPStreamer); ok {
+		return s.HTTPStream()
+	}
+	return nil
+}
+
+// StreamID is the one of a HTTP/3 request, 0 otherwise.
+func (rb *RequestBody) StreamID() quic.StreamID {
+	if s, ok := rb.ReadCloser.(interface{ StreamID() quic.StreamID }); ok {
+		return s.StreamID()
+	}
+	return 0
+}
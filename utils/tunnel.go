@@ -0,0 +1,25 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// TunnelNextProto is the ALPN of QUIC connections a backend opens to a
+// frontend to serve HTTP/3 in reverse.
+const TunnelNextProto = "h123-tunnel"
+
+// TunnelHost replaces the host of requests sent over a tunnel, there is
+// only one connection per tunnel whatever the backend is called.
+const TunnelHost = "h123-tunnel"
+
+// TunnelProof answers the challenge of a frontend, it proves the backend
+// knows the shared token and binds it to its MuxEndPointUrl.
+func TunnelProof(token string, challenge string, muxEndPointUrl string) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte(challenge))
+	mac.Write([]byte{0})
+	mac.Write([]byte(muxEndPointUrl))
+	return hex.EncodeToString(mac.Sum(nil))
+}